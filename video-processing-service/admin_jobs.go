@@ -0,0 +1,343 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrCodeInvalidState is returned with 409 when a job is not in a status the
+// requested operation applies to
+const ErrCodeInvalidState = "invalid_state"
+
+// Most jobs a single bulk operation may touch
+const maxBulkJobs = 1000
+
+// Administrative operations on jobs, as named in the admin API
+const (
+	JobOperationCancel          = "cancel"
+	JobOperationRetry           = "retry"
+	JobOperationRequeueCallback = "requeue-callback"
+	JobOperationSetPriority     = "set-priority"
+	JobOperationPurge           = "purge"
+)
+
+// Statuses of jobs that are finished for good and may be purged
+var finishedJobStatuses = []JobStatus{JobStatusCallbackSuccess, JobStatusCallbackFailed, JobStatusCancelled}
+
+// updateJobIf applies an administrative update to a job if it matches the
+// condition, and records the operation in the job's history in the same
+// transaction. Reports whether the job was updated.
+func (s *sqlStore) updateJobIf(jobID, eventType, detail, assignments string, assignmentArgs []interface{}, condition string, conditionArgs ...interface{}) (bool, error) {
+	args := append(append(append([]interface{}{}, assignmentArgs...), jobID), conditionArgs...)
+	var updated bool
+	err := s.inTx(func(tx *sql.Tx) error {
+		var status int
+		err := tx.QueryRow(s.rebind(`UPDATE jobs SET `+assignments+`, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ? AND (`+condition+`)
+			RETURNING status`), args...).Scan(&status)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		updated = true
+		return s.insertJobEvent(tx, JobEvent{JobID: jobID, Type: eventType, Status: JobStatus(status), Detail: detail})
+	})
+	return updated, err
+}
+
+// Cancel a job that is queued, running or waiting to be retried, and queue
+// its cancellation callback. A worker running it loses its lease, which
+// kills its ffmpeg. The job becomes cancelled once the callback is delivered.
+func (s *sqlStore) CancelJob(jobID, detail string) (bool, error) {
+	return s.updateJobIf(jobID, JobEventCancelled, detail,
+		`status = ?, outcome = ?, worker_id = NULL, lease_expires_at = NULL, finished_at = CURRENT_TIMESTAMP`,
+		[]interface{}{int(JobStatusCallbackPending), JobOutcomeCancelled},
+		`status IN (?, ?, ?)`, int(JobStatusEncodingPending), int(JobStatusEncodingRunning), int(JobStatusEncodingFailed))
+}
+
+// Queue a failed or cancelled job to be encoded again straight away, with
+// its encoding and callback attempts reset
+func (s *sqlStore) RetryJob(jobID, detail string) (bool, error) {
+	return s.updateJobIf(jobID, JobEventRetried, detail,
+		`status = ?, failed_count = 0, callback_failures = 0, outcome = NULL, encoded_seconds = 0,
+		 started_at = NULL, finished_at = NULL, worker_id = NULL, lease_expires_at = NULL, next_attempt_at = CURRENT_TIMESTAMP`,
+		[]interface{}{int(JobStatusEncodingPending)},
+		`status IN (?, ?) OR (status IN (?, ?, ?) AND outcome IN (?, ?))`,
+		int(JobStatusEncodingFailed), int(JobStatusCancelled),
+		int(JobStatusCallbackPending), int(JobStatusCallbackFailed), int(JobStatusCallbackSuccess), JobOutcomeFailed, JobOutcomeCancelled)
+}
+
+// Queue the callback of a job whose callback failed or was already
+// delivered to be sent again, with its callback attempts reset
+func (s *sqlStore) RequeueCallback(jobID, detail string) (bool, error) {
+	return s.updateJobIf(jobID, JobEventCallbackRequeued, detail,
+		`status = ?, callback_failures = 0, worker_id = NULL, lease_expires_at = NULL`,
+		[]interface{}{int(JobStatusCallbackPending)},
+		`status IN (?, ?, ?)`, int(JobStatusCallbackFailed), int(JobStatusCallbackSuccess), int(JobStatusCancelled))
+}
+
+// Change the priority of a job that is waiting to be encoded
+func (s *sqlStore) SetJobPriority(jobID string, priority int, detail string) (bool, error) {
+	return s.updateJobIf(jobID, JobEventPriorityChanged, detail,
+		`priority = ?`, []interface{}{priority},
+		`status IN (?, ?)`, int(JobStatusEncodingPending), int(JobStatusEncodingFailed))
+}
+
+// Delete a finished job together with its history
+func (s *sqlStore) PurgeJob(jobID string) (bool, error) {
+	var purged bool
+	err := s.inTx(func(tx *sql.Tx) error {
+		args := []interface{}{jobID}
+		for _, status := range finishedJobStatuses {
+			args = append(args, int(status))
+		}
+		res, err := tx.Exec(s.rebind(`DELETE FROM jobs WHERE id = ? AND status IN (`+placeholders(len(finishedJobStatuses))+`)`), args...)
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+			return err
+		}
+		purged = true
+		_, err = tx.Exec(s.rebind(`DELETE FROM job_events WHERE job_id = ?`), jobID)
+		return err
+	})
+	return purged, err
+}
+
+// JobOperationRequest is the optional body of a job operation. Reason is
+// recorded in the job's history; Priority is required to set the priority.
+type JobOperationRequest struct {
+	Reason   string `json:"reason,omitempty"`
+	Priority *int   `json:"priority,omitempty"`
+}
+
+// validate checks that the request has what the operation needs
+func (req JobOperationRequest) validate(operation string) []FieldError {
+	if operation != JobOperationSetPriority {
+		return nil
+	}
+	if req.Priority == nil {
+		return []FieldError{{Field: "priority", Code: FieldCodeRequired, Message: "is required"}}
+	}
+	if *req.Priority < minPriority || *req.Priority > maxPriority {
+		return []FieldError{{Field: "priority", Code: FieldCodeOutOfRange, Message: fmt.Sprintf("must be between %d and %d", minPriority, maxPriority)}}
+	}
+	return nil
+}
+
+// isJobOperation reports whether the admin API has an operation of that name
+func isJobOperation(operation string) bool {
+	switch operation {
+	case JobOperationCancel, JobOperationRetry, JobOperationRequeueCallback, JobOperationSetPriority, JobOperationPurge:
+		return true
+	}
+	return false
+}
+
+// ApplyJobOperation applies a validated operation to a job, reporting
+// whether the job was in a status the operation applies to
+func ApplyJobOperation(ctx *AppContext, job *Job, operation string, req JobOperationRequest) (bool, error) {
+	store := ctx.Store
+	detail := "admin"
+	if req.Reason != "" {
+		detail += ": " + req.Reason
+	}
+	switch operation {
+	case JobOperationCancel:
+		return CancelJob(ctx, job.ID, detail)
+	case JobOperationRetry:
+		return store.RetryJob(job.ID, detail)
+	case JobOperationRequeueCallback:
+		return store.RequeueCallback(job.ID, detail)
+	case JobOperationSetPriority:
+		detail = fmt.Sprintf("%s, priority %d to %d", detail, job.Priority, *req.Priority)
+		return store.SetJobPriority(job.ID, *req.Priority, detail)
+	case JobOperationPurge:
+		return store.PurgeJob(job.ID)
+	}
+	return false, fmt.Errorf("unknown job operation %q", operation)
+}
+
+// decodeAdminBody strictly decodes an optional JSON body into v
+func decodeAdminBody(ctx *AppContext, w http.ResponseWriter, r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, ctx.Config.MaxRequestBodyBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// JobOperationHandler applies the operation named in the path to a job of
+// any tenant. Purged jobs are answered with 204, others with the job as it
+// is after the operation.
+func JobOperationHandler(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		operation := r.PathValue("operation")
+		if !isJobOperation(operation) {
+			writeError(w, http.StatusNotFound, ErrCodeNotFound, "Unknown job operation", nil)
+			return
+		}
+		var req JobOperationRequest
+		if err := decodeAdminBody(ctx, w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid JSON: "+err.Error(), nil)
+			return
+		}
+		if fields := req.validate(operation); len(fields) > 0 {
+			writeError(w, http.StatusBadRequest, ErrCodeValidationFailed, "Request validation failed", fields)
+			return
+		}
+
+		job, err := ctx.Store.GetJob(r.PathValue("id"))
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, ErrCodeNotFound, "Job not found", nil)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch job: "+err.Error(), nil)
+			return
+		}
+		applied, err := ApplyJobOperation(ctx, job, operation, req)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to "+operation+" job: "+err.Error(), nil)
+			return
+		}
+		if !applied {
+			writeError(w, http.StatusConflict, ErrCodeInvalidState, fmt.Sprintf("Cannot %s a job that is %s", operation, job.Status), nil)
+			return
+		}
+		if operation == JobOperationPurge {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		ctx.Notifier.Notify()
+
+		job, err = ctx.Store.GetJob(job.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch job: "+err.Error(), nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(NewJobResponse(job))
+	}
+}
+
+// BulkJobFilter selects the jobs of a bulk operation. At least one field
+// must be set.
+type BulkJobFilter struct {
+	TenantID string   `json:"tenantId,omitempty"`
+	VideoID  string   `json:"videoId,omitempty"`
+	Statuses []string `json:"statuses,omitempty"`
+}
+
+type BulkJobOperationRequest struct {
+	Operation string        `json:"operation"`
+	Filter    BulkJobFilter `json:"filter"`
+	JobOperationRequest
+}
+
+type BulkJobResult struct {
+	JobID   string `json:"jobId"`
+	Status  string `json:"status"`
+	Applied bool   `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BulkJobOperationResponse reports every job matching the filter in Matched,
+// but only the first maxBulkJobs are operated on and listed in Jobs, in which
+// case Truncated is set and the operation can be repeated for the rest.
+type BulkJobOperationResponse struct {
+	Matched   int             `json:"matched"`
+	Applied   int             `json:"applied"`
+	Truncated bool            `json:"truncated"`
+	Jobs      []BulkJobResult `json:"jobs"`
+}
+
+// jobFilter validates the bulk filter and converts it to a JobFilter
+func (f BulkJobFilter) jobFilter() (JobFilter, []FieldError) {
+	filter := JobFilter{TenantID: f.TenantID, VideoID: f.VideoID, Limit: maxBulkJobs}
+	var fields []FieldError
+	for i, name := range f.Statuses {
+		status, ok := ParseJobStatus(name)
+		if !ok {
+			fields = append(fields, FieldError{Field: fmt.Sprintf("filter.statuses[%d]", i), Code: FieldCodeInvalidFormat, Message: "unknown job status"})
+		}
+		filter.Statuses = append(filter.Statuses, status)
+	}
+	if f.TenantID == "" && f.VideoID == "" && len(f.Statuses) == 0 {
+		fields = append(fields, FieldError{Field: "filter", Code: FieldCodeRequired, Message: "must select jobs by tenant, video or status"})
+	}
+	return filter, fields
+}
+
+// BulkJobOperationHandler applies an operation to every job matching a
+// filter, up to maxBulkJobs at a time, reporting whether more jobs matched.
+// Jobs the operation does not apply to are skipped and reported as not
+// applied, as are jobs it failed on.
+func BulkJobOperationHandler(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req BulkJobOperationRequest
+		if err := decodeAdminBody(ctx, w, r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid JSON: "+err.Error(), nil)
+			return
+		}
+		filter, fields := req.Filter.jobFilter()
+		if !isJobOperation(req.Operation) {
+			fields = append(fields, FieldError{Field: "operation", Code: FieldCodeInvalidFormat, Message: "unknown job operation"})
+		} else {
+			fields = append(fields, req.validate(req.Operation)...)
+		}
+		if len(fields) > 0 {
+			writeError(w, http.StatusBadRequest, ErrCodeValidationFailed, "Request validation failed", fields)
+			return
+		}
+
+		jobs, err := ctx.Store.ListJobs(filter)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to list jobs: "+err.Error(), nil)
+			return
+		}
+		counts, err := ctx.Store.CountJobsByStatus(filter)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to count jobs: "+err.Error(), nil)
+			return
+		}
+		resp := BulkJobOperationResponse{Jobs: []BulkJobResult{}}
+		for _, count := range counts {
+			resp.Matched += count
+		}
+		// Jobs may change status between listing and counting them, so only
+		// a full listing can have left jobs out
+		if resp.Matched < len(jobs) {
+			resp.Matched = len(jobs)
+		}
+		resp.Truncated = len(jobs) == maxBulkJobs && resp.Matched > len(jobs)
+		for i := range jobs {
+			applied, err := ApplyJobOperation(ctx, &jobs[i], req.Operation, req.JobOperationRequest)
+			result := BulkJobResult{JobID: jobs[i].ID, Status: jobs[i].Status.String(), Applied: applied}
+			if err != nil {
+				result.Error = err.Error()
+			} else if applied {
+				resp.Applied++
+				if job, err := ctx.Store.GetJob(jobs[i].ID); err == nil {
+					result.Status = job.Status.String()
+				} else if req.Operation == JobOperationPurge {
+					result.Status = "purged"
+				}
+			}
+			resp.Jobs = append(resp.Jobs, result)
+		}
+		if resp.Applied > 0 {
+			ctx.Notifier.Notify()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, ctx *AppContext, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatalf("failed to marshal body: %v", err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	NewRouter(ctx).ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminJobOperationsAreRecordedInHistory(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Config.AdminAPIKey = "admin-secret"
+	opts := testDequeueOptions(ctx)
+	jobs := submitTestJobs(t, ctx, DefaultTenantID, 1)
+	jobID := jobs[0].ID
+
+	// Cancelling a running job takes its lease away from the worker
+	if job, err := ctx.Store.DequeueJob(opts, time.Now()); err != nil || job == nil {
+		t.Fatalf("DequeueJob returned %v, %v", job, err)
+	}
+	rec := adminRequest(t, ctx, http.MethodPost, "/admin/jobs/"+jobID+"/cancel", JobOperationRequest{Reason: "wrong input"})
+	var job JobResponse
+	json.NewDecoder(rec.Body).Decode(&job)
+	if rec.Code != http.StatusOK || job.Status != "callback_pending" || job.Outcome != JobOutcomeCancelled {
+		t.Fatalf("Expected job to be cancelled, got %d %+v", rec.Code, job)
+	}
+	if err := ctx.Store.RenewLease(jobID, opts.WorkerID, time.Now().Add(time.Minute)); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Expected worker to lose the lease of the cancelled job, got %v", err)
+	}
+	if rec := adminRequest(t, ctx, http.MethodPost, "/admin/jobs/"+jobID+"/cancel", nil); rec.Code != http.StatusConflict {
+		t.Errorf("Expected cancelling a cancelled job to conflict, got %d", rec.Code)
+	}
+
+	// Retrying resets the job's attempts
+	if err := ctx.Store.(testStore).incrementFailedCount(jobID); err != nil {
+		t.Fatalf("incrementFailedCount failed: %v", err)
+	}
+	rec = adminRequest(t, ctx, http.MethodPost, "/admin/jobs/"+jobID+"/retry", nil)
+	job = JobResponse{}
+	json.NewDecoder(rec.Body).Decode(&job)
+	if rec.Code != http.StatusOK || job.Status != "encoding_pending" || job.FailedCount != 0 {
+		t.Fatalf("Expected job to be queued again, got %d %+v", rec.Code, job)
+	}
+
+	if rec := adminRequest(t, ctx, http.MethodPost, "/admin/jobs/"+jobID+"/set-priority", JobOperationRequest{}); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected setting no priority to be rejected, got %d", rec.Code)
+	}
+	priority := 9
+	rec = adminRequest(t, ctx, http.MethodPost, "/admin/jobs/"+jobID+"/set-priority", JobOperationRequest{Priority: &priority})
+	job = JobResponse{}
+	json.NewDecoder(rec.Body).Decode(&job)
+	if rec.Code != http.StatusOK || job.Priority != 9 {
+		t.Fatalf("Expected priority to change, got %d %+v", rec.Code, job)
+	}
+
+	events, err := ctx.Store.ListJobEvents(jobID)
+	if err != nil {
+		t.Fatalf("ListJobEvents failed: %v", err)
+	}
+	var recorded []string
+	for _, event := range events[2:] {
+		recorded = append(recorded, event.Type+" "+event.Detail)
+	}
+	want := []string{
+		JobEventCancelled + " admin: wrong input",
+		JobEventRetried + " admin",
+		JobEventPriorityChanged + " admin, priority 5 to 9",
+	}
+	if len(recorded) != len(want) {
+		t.Fatalf("Expected events %q, got %q", want, recorded)
+	}
+	for i := range want {
+		if recorded[i] != want[i] {
+			t.Errorf("Expected event %q, got %q", want[i], recorded[i])
+		}
+	}
+}
+
+func TestAdminRetryRejectsEncodedJobWhoseCallbackFailed(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Config.AdminAPIKey = "admin-secret"
+	opts := testDequeueOptions(ctx)
+	jobID := submitTestJobs(t, ctx, DefaultTenantID, 1)[0].ID
+
+	if job, err := ctx.Store.DequeueJob(opts, time.Now()); err != nil || job == nil {
+		t.Fatalf("DequeueJob returned %v, %v", job, err)
+	}
+	if err := ctx.Store.MarkJobEncoded(jobID, opts.WorkerID, 60, Attempt{}); err != nil {
+		t.Fatalf("MarkJobEncoded failed: %v", err)
+	}
+	if job, err := ctx.Store.DequeueCallbackJob("callback-worker", 1, time.Now().Add(time.Minute)); err != nil || job == nil {
+		t.Fatalf("DequeueCallbackJob returned %v, %v", job, err)
+	}
+	if err := ctx.Store.CompleteCallback(jobID, "callback-worker", Attempt{Error: "connection refused"}, 1); err != nil {
+		t.Fatalf("CompleteCallback failed: %v", err)
+	}
+
+	// The encode succeeded, so only its callback may be sent again
+	if rec := adminRequest(t, ctx, http.MethodPost, "/admin/jobs/"+jobID+"/retry", nil); rec.Code != http.StatusConflict {
+		t.Errorf("Expected retrying a succeeded job to conflict, got %d", rec.Code)
+	}
+	if rec := adminRequest(t, ctx, http.MethodPost, "/admin/jobs/"+jobID+"/requeue-callback", nil); rec.Code != http.StatusOK {
+		t.Errorf("Expected the callback to be requeued, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAdminBulkJobOperations(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Config.AdminAPIKey = "admin-secret"
+	jobs := submitTestJobs(t, ctx, "acme", 3)
+	submitTestJobs(t, ctx, "other", 1)
+
+	if rec := adminRequest(t, ctx, http.MethodPost, "/admin/jobs/bulk", BulkJobOperationRequest{Operation: JobOperationCancel}); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a bulk operation without filter to be rejected, got %d", rec.Code)
+	}
+
+	rec := adminRequest(t, ctx, http.MethodPost, "/admin/jobs/bulk", BulkJobOperationRequest{
+		Operation: JobOperationCancel,
+		Filter:    BulkJobFilter{VideoID: "acme-video", Statuses: []string{"encoding_pending"}},
+	})
+	var resp BulkJobOperationResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.Matched != 3 || resp.Applied != 3 || resp.Truncated || resp.Jobs[0].Status != "callback_pending" {
+		t.Fatalf("Expected the tenant's three jobs to be cancelled, got %d %+v", rec.Code, resp)
+	}
+
+	// Cancelled jobs are finished once their callback is sent, and may then
+	// be purged with their history
+	if rec := adminRequest(t, ctx, http.MethodPost, "/admin/jobs/"+jobs[0].ID+"/purge", nil); rec.Code != http.StatusConflict {
+		t.Fatalf("Expected purging a job awaiting its callback to conflict, got %d", rec.Code)
+	}
+	if moved, err := ctx.Store.TransitionJob(jobs[0].ID, JobStatusCancelled); err != nil || !moved {
+		t.Fatalf("TransitionJob returned %v, %v", moved, err)
+	}
+	rec = adminRequest(t, ctx, http.MethodPost, "/admin/jobs/"+jobs[0].ID+"/purge", nil)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected purge to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, err := ctx.Store.GetJob(jobs[0].ID); err == nil {
+		t.Errorf("Expected purged job to be gone")
+	}
+	if events, _ := ctx.Store.ListJobEvents(jobs[0].ID); len(events) != 0 {
+		t.Errorf("Expected purged job's history to be gone, got %d events", len(events))
+	}
+	if pending, _ := ctx.Store.ListJobs(JobFilter{Statuses: []JobStatus{JobStatusEncodingPending}}); len(pending) != 1 || pending[0].TenantID != "other" {
+		t.Errorf("Expected other tenant's job to be untouched, got %+v", pending)
+	}
+}
+
+func TestAdminBulkJobOperationReportsTruncation(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Config.AdminAPIKey = "admin-secret"
+	var jobs []Job
+	for i := 0; i <= maxBulkJobs; i++ {
+		jobs = append(jobs, newTestJob("acme", 720))
+	}
+	if err := insertTestJobs(ctx.Store, jobs); err != nil {
+		t.Fatalf("InsertJobs failed: %v", err)
+	}
+
+	rec := adminRequest(t, ctx, http.MethodPost, "/admin/jobs/bulk", BulkJobOperationRequest{
+		Operation: JobOperationCancel,
+		Filter:    BulkJobFilter{TenantID: "acme"},
+	})
+	var resp BulkJobOperationResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.Matched != maxBulkJobs+1 || !resp.Truncated || resp.Applied != maxBulkJobs || len(resp.Jobs) != maxBulkJobs {
+		t.Fatalf("Expected the operation to stop at %d of %d jobs, got %d matched %d applied %d truncated %v",
+			maxBulkJobs, maxBulkJobs+1, rec.Code, resp.Matched, resp.Applied, resp.Truncated)
+	}
+
+	// Repeating the operation picks up the rest
+	rec = adminRequest(t, ctx, http.MethodPost, "/admin/jobs/bulk", BulkJobOperationRequest{
+		Operation: JobOperationCancel,
+		Filter:    BulkJobFilter{TenantID: "acme", Statuses: []string{"encoding_pending"}},
+	})
+	resp = BulkJobOperationResponse{}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.Matched != 1 || resp.Applied != 1 || resp.Truncated {
+		t.Errorf("Expected the remaining job to be cancelled, got %d %+v", rec.Code, resp)
+	}
+}
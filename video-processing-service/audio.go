@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Audio codecs of a profile. Copy keeps the source audio as it is and none
+// drops it; audio-only renditions are encoded to AAC or Opus.
+const (
+	AudioCodecAAC  = "aac"
+	AudioCodecOpus = "opus"
+	AudioCodecCopy = "copy"
+	AudioCodecNone = "none"
+)
+
+// ffmpeg encoders of the audio codecs
+var audioEncoders = map[string]string{
+	AudioCodecAAC:  "aac",
+	AudioCodecOpus: "libopus",
+}
+
+// Bitrates in kbit/s of audio encoded without one
+var defaultAudioBitrates = map[string]int{
+	AudioCodecAAC:  128,
+	AudioCodecOpus: 96,
+}
+
+// EBU R128 targets used for loudness normalization unless overridden
+const (
+	defaultIntegratedLoudness = -23
+	defaultTruePeak           = -1
+	defaultLoudnessRange      = 7
+)
+
+// Limits enforced on audio settings
+const (
+	minAudioBitrate  = 8
+	maxAudioBitrate  = 512
+	maxAudioChannels = 8
+	maxAudioTrack    = 63
+)
+
+// Sample rates audio may be resampled to. Opus only supports some of them.
+var (
+	audioSampleRates = []int{8000, 11025, 12000, 16000, 22050, 24000, 32000, 44100, 48000}
+	opusSampleRates  = []int{8000, 12000, 16000, 24000, 48000}
+)
+
+// ISO 639-2 language codes, as ffmpeg reads them from stream metadata
+var languagePattern = regexp.MustCompile(`^[a-z]{3}$`)
+
+// AudioProfile configures the audio of a rendition. Profiles without one
+// encode the source's default audio track with ffmpeg's defaults.
+type AudioProfile struct {
+	// Codec is aac, opus, copy or none, aac if empty
+	Codec string `json:"codec,omitempty"`
+	// Bitrate in kbit/s, 128 for AAC and 96 for Opus if zero
+	Bitrate int `json:"bitrate,omitempty"`
+	// Channels and SampleRate are those of the source if zero
+	Channels   int `json:"channels,omitempty"`
+	SampleRate int `json:"sampleRate,omitempty"`
+	// Normalize adjusts the loudness to the target in two passes
+	Normalize *LoudnessTarget `json:"normalize,omitempty"`
+	// Track selects an audio stream of the source by its index among the
+	// audio streams, and Language by its language tag. At most one is set.
+	Track    *int   `json:"track,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// LoudnessTarget is an EBU R128 loudness target. Omitted fields take the
+// defaults of the recommendation; a true peak of 0 dBTP is a valid target.
+type LoudnessTarget struct {
+	// Integrated loudness in LUFS, -23 if omitted
+	Integrated *float64 `json:"integrated,omitempty"`
+	// TruePeak in dBTP, -1 if omitted
+	TruePeak *float64 `json:"truePeak,omitempty"`
+	// Range is the loudness range in LU, 7 if omitted
+	Range *float64 `json:"range,omitempty"`
+}
+
+// audioFieldErrors checks the audio settings of profiles[i]
+func audioFieldErrors(i int, audio *AudioProfile, audioOnly bool) []FieldError {
+	var fields []FieldError
+	add := func(name, code, message string) {
+		fields = append(fields, FieldError{Field: fmt.Sprintf("profiles[%d].audio.%s", i, name), Code: code, Message: message})
+	}
+	codec := audio.Codec
+	if codec == "" {
+		codec = AudioCodecAAC
+	}
+	switch codec {
+	case AudioCodecAAC, AudioCodecOpus:
+	case AudioCodecCopy, AudioCodecNone:
+		if audioOnly {
+			add("codec", FieldCodeInvalidFormat, "audio-only renditions must be encoded to aac or opus")
+		}
+		if audio.Bitrate != 0 || audio.Channels != 0 || audio.SampleRate != 0 || audio.Normalize != nil {
+			add("codec", FieldCodeInvalidFormat, fmt.Sprintf("%s audio cannot be re-encoded or normalized", codec))
+		}
+		if codec == AudioCodecNone && (audio.Track != nil || audio.Language != "") {
+			add("codec", FieldCodeInvalidFormat, "no audio track can be selected when audio is dropped")
+		}
+	default:
+		add("codec", FieldCodeInvalidFormat, "must be one of aac, opus, copy, none")
+	}
+
+	if audio.Bitrate != 0 && (audio.Bitrate < minAudioBitrate || audio.Bitrate > maxAudioBitrate) {
+		add("bitrate", FieldCodeOutOfRange, fmt.Sprintf("must be between %d and %d kbit/s", minAudioBitrate, maxAudioBitrate))
+	}
+	if audio.Channels < 0 || audio.Channels > maxAudioChannels {
+		add("channels", FieldCodeOutOfRange, fmt.Sprintf("must be between 1 and %d", maxAudioChannels))
+	}
+	if audio.SampleRate != 0 {
+		rates := audioSampleRates
+		if codec == AudioCodecOpus {
+			rates = opusSampleRates
+		}
+		if !containsInt(rates, audio.SampleRate) {
+			add("sampleRate", FieldCodeOutOfRange, fmt.Sprintf("must be one of %v for %s", rates, codec))
+		}
+	}
+	if n := audio.Normalize; n != nil {
+		if n.Integrated != nil && (*n.Integrated < -70 || *n.Integrated > -5) {
+			add("normalize.integrated", FieldCodeOutOfRange, "must be between -70 and -5 LUFS")
+		}
+		if n.TruePeak != nil && (*n.TruePeak < -9 || *n.TruePeak > 0) {
+			add("normalize.truePeak", FieldCodeOutOfRange, "must be between -9 and 0 dBTP")
+		}
+		if n.Range != nil && (*n.Range < 1 || *n.Range > 20) {
+			add("normalize.range", FieldCodeOutOfRange, "must be between 1 and 20 LU")
+		}
+	}
+	if audio.Track != nil && (*audio.Track < 0 || *audio.Track > maxAudioTrack) {
+		add("track", FieldCodeOutOfRange, fmt.Sprintf("must be between 0 and %d", maxAudioTrack))
+	}
+	if audio.Language != "" {
+		if !languagePattern.MatchString(audio.Language) {
+			add("language", FieldCodeInvalidFormat, "must be a lowercase ISO 639-2 code such as eng")
+		} else if audio.Track != nil {
+			add("language", FieldCodeInvalidFormat, "cannot be combined with track")
+		}
+	}
+	return fields
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// withAudioDefaults returns a copy of valid audio settings with the codec,
+// bitrate and loudness targets filled in, as stored with jobs
+func withAudioDefaults(audio *AudioProfile) *AudioProfile {
+	if audio == nil {
+		return nil
+	}
+	settings := *audio
+	if settings.Codec == "" {
+		settings.Codec = AudioCodecAAC
+	}
+	if settings.Bitrate == 0 {
+		settings.Bitrate = defaultAudioBitrates[settings.Codec]
+	}
+	if audio.Normalize != nil {
+		settings.Normalize = &LoudnessTarget{
+			Integrated: floatOrDefault(audio.Normalize.Integrated, defaultIntegratedLoudness),
+			TruePeak:   floatOrDefault(audio.Normalize.TruePeak, defaultTruePeak),
+			Range:      floatOrDefault(audio.Normalize.Range, defaultLoudnessRange),
+		}
+		// loudnorm resamples to 192 kHz, so bring the audio back down
+		if settings.SampleRate == 0 {
+			settings.SampleRate = 48000
+		}
+	}
+	return &settings
+}
+
+// floatOrDefault returns a copy of f, or of def if f is nil
+func floatOrDefault(f *float64, def float64) *float64 {
+	v := def
+	if f != nil {
+		v = *f
+	}
+	return &v
+}
+
+// AudioOutputFileName is the name of the file an audio-only job encodes to,
+// such as audio-eng-aac-128k.m4a. Every setting that changes the encoded audio
+// is part of the name, so renditions differing in any of them do not overwrite
+// each other: audio-aac-128k-2ch-48000hz-loudnorm-i23-tp1-lra7.m4a is a stereo
+// rendition normalized to -23 LUFS and -1 dBTP. Opus is written to .mp4,
+// since ffmpeg's .m4a muxer does not take Opus.
+func AudioOutputFileName(audio *AudioProfile) string {
+	name := "audio"
+	if audio.Language != "" {
+		name += "-" + audio.Language
+	} else if audio.Track != nil {
+		name += fmt.Sprintf("-track%d", *audio.Track)
+	}
+	name += fmt.Sprintf("-%s-%dk", audio.Codec, audio.Bitrate)
+	if audio.Channels != 0 {
+		name += fmt.Sprintf("-%dch", audio.Channels)
+	}
+	if audio.SampleRate != 0 {
+		name += fmt.Sprintf("-%dhz", audio.SampleRate)
+	}
+	// Loudness targets and true peaks are never positive, so their sign is left out
+	if n := audio.Normalize; n != nil {
+		name += fmt.Sprintf("-loudnorm-i%s-tp%s-lra%s", formatFloat(math.Abs(*n.Integrated)), formatFloat(math.Abs(*n.TruePeak)), formatFloat(*n.Range))
+	}
+	if audio.Codec == AudioCodecOpus {
+		return name + ".mp4"
+	}
+	return name + ".m4a"
+}
+
+// audioStreamSpecifier is the ffmpeg stream specifier of the selected audio
+// track, or empty to let ffmpeg pick
+func audioStreamSpecifier(audio *AudioProfile) string {
+	switch {
+	case audio == nil:
+		return ""
+	case audio.Language != "":
+		return "0:a:m:language:" + audio.Language
+	case audio.Track != nil:
+		return fmt.Sprintf("0:a:%d", *audio.Track)
+	}
+	return ""
+}
+
+// LoudnessMeasurement is what the first pass of loudness normalization
+// measures of the source, as printed by ffmpeg's loudnorm filter
+type LoudnessMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// loudnormFilter returns the loudnorm filter of a target with its defaults
+// filled in, applying a first pass measurement if there is one
+func loudnormFilter(target *LoudnessTarget, measured *LoudnessMeasurement) string {
+	filter := fmt.Sprintf("loudnorm=I=%s:TP=%s:LRA=%s", formatFloat(*target.Integrated), formatFloat(*target.TruePeak), formatFloat(*target.Range))
+	if measured == nil {
+		return filter + ":print_format=json"
+	}
+	return filter + fmt.Sprintf(":measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		measured.InputI, measured.InputTP, measured.InputLRA, measured.InputThresh, measured.TargetOffset)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseLoudnessMeasurement extracts the measurement loudnorm prints as the
+// last JSON object of ffmpeg's output
+func parseLoudnessMeasurement(output []byte) (*LoudnessMeasurement, error) {
+	start := bytes.LastIndexByte(output, '{')
+	end := bytes.LastIndexByte(output, '}')
+	if start < 0 || end < start {
+		return nil, errors.New("ffmpeg printed no loudness measurement")
+	}
+	var measured LoudnessMeasurement
+	if err := json.Unmarshal(output[start:end+1], &measured); err != nil {
+		return nil, fmt.Errorf("invalid loudness measurement: %w", err)
+	}
+	if measured.InputI == "" || measured.TargetOffset == "" {
+		return nil, errors.New("incomplete loudness measurement")
+	}
+	// Silent sources measure as -inf, which the second pass rejects
+	if i, err := strconv.ParseFloat(measured.InputI, 64); err != nil || math.IsInf(i, 0) {
+		return nil, fmt.Errorf("source loudness cannot be measured: input_i is %s", measured.InputI)
+	}
+	return &measured, nil
+}
+
+// MeasureLoudness runs the first pass of loudness normalization over the
+// selected audio track of a file. Like ConvertVideo, it kills ffmpeg if it
+// reports no progress for stallTimeout.
+func MeasureLoudness(ctx context.Context, logger *slog.Logger, rawVideoName string, audio *AudioProfile, stallTimeout time.Duration) (*LoudnessMeasurement, error) {
+	args := []string{"-hide_banner", "-i", rawVideoName}
+	if spec := audioStreamSpecifier(audio); spec != "" {
+		args = append(args, "-map", spec)
+	}
+	args = append(args, "-vn", "-af", loudnormFilter(audio.Normalize, nil), "-f", "null", "-")
+	watchdog := newFFmpegWatchdog(ctx, stallTimeout)
+	defer watchdog.stop()
+	cmd := exec.CommandContext(watchdog.ctx, "ffmpeg", args...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stderr pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	logger.Info("Measuring loudness", "args", cmd.Args)
+	tail := logFFmpegOutput(logger, stderr, watchdog.progress)
+	if err := cmd.Wait(); err != nil {
+		exitCode := -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+		return nil, &FFmpegError{ExitCode: exitCode, StderrTail: stderrTail(tail), Err: fmt.Errorf("loudness measurement failed: %w", watchdog.wrap(err))}
+	}
+	return parseLoudnessMeasurement(tail)
+}
+
+// audioArgs returns the ffmpeg output options encoding the audio of a
+// rendition
+func audioArgs(audio *AudioProfile, measured *LoudnessMeasurement) []string {
+	switch audio.Codec {
+	case AudioCodecNone:
+		return []string{"-an"}
+	case AudioCodecCopy:
+		return []string{"-c:a", "copy"}
+	}
+	args := []string{"-c:a", audioEncoders[audio.Codec], "-b:a", fmt.Sprintf("%dk", audio.Bitrate)}
+	if audio.Channels != 0 {
+		args = append(args, "-ac", strconv.Itoa(audio.Channels))
+	}
+	if audio.Normalize != nil {
+		args = append(args, "-af", loudnormFilter(audio.Normalize, measured))
+	}
+	if audio.SampleRate != 0 {
+		args = append(args, "-ar", strconv.Itoa(audio.SampleRate))
+	}
+	return args
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProfileAudioValidation(t *testing.T) {
+	track := 1
+	cases := []struct {
+		name    string
+		profile Profile
+		field   string
+		code    string
+	}{
+		{"unknown codec", Profile{Resolution: "720", Audio: &AudioProfile{Codec: "mp3"}}, "profiles[0].audio.codec", FieldCodeInvalidFormat},
+		{"bitrate", Profile{Resolution: "720", Audio: &AudioProfile{Bitrate: 1000}}, "profiles[0].audio.bitrate", FieldCodeOutOfRange},
+		{"opus sample rate", Profile{Resolution: "720", Audio: &AudioProfile{Codec: AudioCodecOpus, SampleRate: 44100}}, "profiles[0].audio.sampleRate", FieldCodeOutOfRange},
+		{"copy cannot normalize", Profile{Resolution: "720", Audio: &AudioProfile{Codec: AudioCodecCopy, Normalize: &LoudnessTarget{}}}, "profiles[0].audio.codec", FieldCodeInvalidFormat},
+		{"loudness target", Profile{Resolution: "720", Audio: &AudioProfile{Normalize: &LoudnessTarget{Integrated: floatPtr(-2)}}}, "profiles[0].audio.normalize.integrated", FieldCodeOutOfRange},
+		{"track and language", Profile{Resolution: "720", Audio: &AudioProfile{Track: &track, Language: "eng"}}, "profiles[0].audio.language", FieldCodeInvalidFormat},
+		{"language", Profile{Resolution: "720", Audio: &AudioProfile{Language: "English"}}, "profiles[0].audio.language", FieldCodeInvalidFormat},
+		{"audio only with resolution", Profile{Resolution: "720", AudioOnly: true}, "profiles[0].resolution", FieldCodeInvalidFormat},
+		{"audio only copy", Profile{AudioOnly: true, Audio: &AudioProfile{Codec: AudioCodecCopy}}, "profiles[0].audio.codec", FieldCodeInvalidFormat},
+		{"video without resolution", Profile{Crf: 23}, "profiles[0].resolution", FieldCodeRequired},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fields := profileFieldErrors([]Profile{tc.profile})
+			for _, f := range fields {
+				if f.Field == tc.field && f.Code == tc.code {
+					return
+				}
+			}
+			t.Errorf("Expected %s to fail with %s, got %+v", tc.field, tc.code, fields)
+		})
+	}
+
+	// Audio-only renditions are told apart by their output file
+	fields := profileFieldErrors([]Profile{
+		{Resolution: "720", Crf: 23},
+		{AudioOnly: true},
+		{AudioOnly: true, Audio: &AudioProfile{Codec: AudioCodecAAC, Bitrate: 128}},
+		{AudioOnly: true, Audio: &AudioProfile{Language: "fra"}},
+		{AudioOnly: true, Audio: &AudioProfile{Codec: AudioCodecOpus}},
+		{AudioOnly: true, Audio: &AudioProfile{Channels: 2}},
+		{AudioOnly: true, Audio: &AudioProfile{SampleRate: 44100}},
+		{AudioOnly: true, Audio: &AudioProfile{Normalize: &LoudnessTarget{}}},
+		{AudioOnly: true, Audio: &AudioProfile{Normalize: &LoudnessTarget{Integrated: floatPtr(-16)}}},
+	})
+	if len(fields) != 1 || fields[0].Field != "profiles[2].audio" || fields[0].Code != FieldCodeDuplicate {
+		t.Errorf("Expected only the repeated AAC rendition to be a duplicate, got %+v", fields)
+	}
+}
+
+func TestAudioOutputFileName(t *testing.T) {
+	track := 2
+	cases := map[string]*AudioProfile{
+		"audio-eng-aac-128k.m4a":                             {Language: "eng"},
+		"audio-track2-opus-96k.mp4":                          {Codec: AudioCodecOpus, Track: &track},
+		"audio-aac-64k-1ch-22050hz.m4a":                      {Bitrate: 64, Channels: 1, SampleRate: 22050},
+		"audio-aac-128k-48000hz-loudnorm-i16-tp0-lra11.m4a":  {Normalize: &LoudnessTarget{Integrated: floatPtr(-16), TruePeak: floatPtr(0), Range: floatPtr(11)}},
+		"audio-opus-96k-48000hz-loudnorm-i23-tp1.5-lra7.mp4": {Codec: AudioCodecOpus, Normalize: &LoudnessTarget{TruePeak: floatPtr(-1.5)}},
+	}
+	for want, audio := range cases {
+		if got := AudioOutputFileName(withAudioDefaults(audio)); got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+}
+
+func TestFFmpegArgs(t *testing.T) {
+	parse := func(profile Profile) ParsedProfile {
+		t.Helper()
+		parsed, err := ParseProfiles([]Profile{profile})
+		if err != nil {
+			t.Fatalf("ParseProfiles failed: %v", err)
+		}
+		return parsed[0]
+	}
+	measured := &LoudnessMeasurement{InputI: "-30.12", InputTP: "-8.50", InputLRA: "4.20", InputThresh: "-40.60", TargetOffset: "0.35"}
+
+	cases := []struct {
+		name     string
+		profile  Profile
+		measured *LoudnessMeasurement
+		want     string
+	}{
+		{"defaults", Profile{Resolution: "720", Crf: 23}, nil,
+			"-hide_banner -i in.mp4 -vf scale=-2:720 -c:v libx264 -preset fast -crf 23 out.mp4"},
+		{"normalized language track", Profile{Resolution: "480", Crf: 28, Audio: &AudioProfile{Channels: 2, Language: "eng", Normalize: &LoudnessTarget{Integrated: floatPtr(-16)}}}, measured,
+			"-hide_banner -i in.mp4 -map 0:v:0 -map 0:a:m:language:eng -vf scale=-2:480 -c:v libx264 -preset fast -crf 28 " +
+				"-c:a aac -b:a 128k -ac 2 -af loudnorm=I=-16:TP=-1:LRA=7:measured_I=-30.12:measured_TP=-8.50:measured_LRA=4.20:measured_thresh=-40.60:offset=0.35:linear=true -ar 48000 out.mp4"},
+		{"no audio", Profile{Resolution: "360", Crf: 30, Audio: &AudioProfile{Codec: AudioCodecNone}}, nil,
+			"-hide_banner -i in.mp4 -vf scale=-2:360 -c:v libx264 -preset fast -crf 30 -an out.mp4"},
+		{"audio only opus", Profile{AudioOnly: true, Audio: &AudioProfile{Codec: AudioCodecOpus}}, nil,
+			"-hide_banner -i in.mp4 -map 0:a:0 -vn -c:a libopus -b:a 96k out.mp4"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := strings.Join(ffmpegArgs("in.mp4", "out.mp4", parse(tc.profile), tc.measured), " ")
+			if got != tc.want {
+				t.Errorf("Unexpected arguments\n got: %s\nwant: %s", got, tc.want)
+			}
+		})
+	}
+
+	// The first pass measures the same track with the same target
+	target := parse(Profile{Resolution: "720", Audio: &AudioProfile{Normalize: &LoudnessTarget{}}}).Audio.Normalize
+	if filter := loudnormFilter(target, nil); filter != "loudnorm=I=-23:TP=-1:LRA=7:print_format=json" {
+		t.Errorf("Unexpected first pass filter %s", filter)
+	}
+	// A true peak of 0 dBTP is a target, not a request for the default
+	target = parse(Profile{Resolution: "720", Audio: &AudioProfile{Normalize: &LoudnessTarget{TruePeak: floatPtr(0)}}}).Audio.Normalize
+	if filter := loudnormFilter(target, nil); filter != "loudnorm=I=-23:TP=0:LRA=7:print_format=json" {
+		t.Errorf("Unexpected filter for a 0 dBTP target %s", filter)
+	}
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
+
+func TestParseLoudnessMeasurement(t *testing.T) {
+	output := []byte(`[Parsed_loudnorm_0 @ 0x5581]
+{
+	"input_i" : "-27.61",
+	"input_tp" : "-4.47",
+	"input_lra" : "18.06",
+	"input_thresh" : "-39.20",
+	"output_i" : "-16.58",
+	"output_tp" : "-1.50",
+	"output_lra" : "14.78",
+	"output_thresh" : "-27.71",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.58"
+}
+`)
+	measured, err := parseLoudnessMeasurement(output)
+	if err != nil {
+		t.Fatalf("parseLoudnessMeasurement failed: %v", err)
+	}
+	want := LoudnessMeasurement{InputI: "-27.61", InputTP: "-4.47", InputLRA: "18.06", InputThresh: "-39.20", TargetOffset: "0.58"}
+	if !reflect.DeepEqual(*measured, want) {
+		t.Errorf("Expected %+v, got %+v", want, *measured)
+	}
+
+	silent := []byte(`{"input_i" : "-inf", "input_tp" : "-inf", "input_lra" : "0.00", "input_thresh" : "-70.00", "target_offset" : "inf"}`)
+	if _, err := parseLoudnessMeasurement(silent); err == nil {
+		t.Error("Expected a silent source to fail the measurement")
+	}
+	if _, err := parseLoudnessMeasurement([]byte("Stream map '0:a:m:language:eng' matches no streams.")); err == nil {
+		t.Error("Expected output without a measurement to fail")
+	}
+}
+
+func TestAudioSettingsStoredWithJobs(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	jobs, _, err := SubmitJobs(context.Background(), ctx, DefaultTenantID, &RequestPayload{
+		VideoId: "audio-video",
+		Input:   Input{Bucket: "input-bucket", Key: "input.mkv"},
+		Output:  Output{Bucket: "output-bucket", BasePath: "outputs/"},
+		Profiles: []Profile{
+			{Resolution: "720", Crf: 23, Audio: &AudioProfile{Language: "eng", Normalize: &LoudnessTarget{}}},
+			{AudioOnly: true, Audio: &AudioProfile{Codec: AudioCodecOpus, Language: "eng"}},
+		},
+		CallbackURL: "http://callback.example.com/done",
+	})
+	if err != nil {
+		t.Fatalf("SubmitJobs failed: %v", err)
+	}
+
+	byOutput := map[string]*Job{}
+	for i := range jobs {
+		job, err := ctx.Store.GetJob(jobs[i].ID)
+		if err != nil {
+			t.Fatalf("GetJob failed: %v", err)
+		}
+		byOutput[OutputKey(job)] = job
+	}
+	video, audio := byOutput["outputs/720p.mp4"], byOutput["outputs/audio-eng-opus-96k.mp4"]
+	if video == nil || audio == nil {
+		t.Fatalf("Unexpected outputs %v", byOutput)
+	}
+	want := &AudioProfile{Codec: AudioCodecAAC, Bitrate: 128, SampleRate: 48000, Language: "eng",
+		Normalize: &LoudnessTarget{Integrated: floatPtr(-23), TruePeak: floatPtr(-1), Range: floatPtr(7)}}
+	if video.AudioOnly || !reflect.DeepEqual(video.Audio, want) {
+		t.Errorf("Expected video job to keep its audio settings with defaults, got %+v", video.Audio)
+	}
+	if !audio.AudioOnly || audio.Resolution != 0 || audio.Audio.Codec != AudioCodecOpus {
+		t.Errorf("Expected an audio-only Opus job, got %+v", audio)
+	}
+
+	plain := submitTestJobs(t, ctx, DefaultTenantID, 1)
+	if job, _ := ctx.Store.GetJob(plain[0].ID); job.Audio != nil || job.AudioOnly {
+		t.Errorf("Expected jobs without audio settings to leave audio to ffmpeg, got %+v", job.Audio)
+	}
+}
+
+func TestAudioOnlyRenditionsShareIdempotencyKey(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	payload := &RequestPayload{
+		VideoId: "podcast",
+		Input:   Input{Bucket: "input-bucket", Key: "episode.wav"},
+		Output:  Output{Bucket: "output-bucket", BasePath: "outputs/"},
+		Profiles: []Profile{
+			{AudioOnly: true, Audio: &AudioProfile{Codec: AudioCodecAAC}},
+			{AudioOnly: true, Audio: &AudioProfile{Codec: AudioCodecOpus}},
+		},
+		CallbackURL:    "http://callback.example.com/done",
+		IdempotencyKey: "episode-1",
+	}
+	jobs, replayed, err := SubmitJobs(context.Background(), ctx, DefaultTenantID, payload)
+	if err != nil || replayed || len(jobs) != 2 {
+		t.Fatalf("Expected both audio-only renditions to be stored, got %+v, %v, %v", jobs, replayed, err)
+	}
+	again, replayed, err := SubmitJobs(context.Background(), ctx, DefaultTenantID, payload)
+	if err != nil || !replayed || len(again) != 2 {
+		t.Errorf("Expected resubmission to be replayed, got %+v, %v, %v", again, replayed, err)
+	}
+}
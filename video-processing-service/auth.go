@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// DefaultTenantID owns jobs submitted while authentication is disabled
+const DefaultTenantID = "default"
+
+// Prefix of generated API keys, making them easy to recognise in logs and scanners
+const apiKeyPrefix = "vps_"
+
+// Error codes used by the authentication layer
+const (
+	ErrCodeUnauthorized = "unauthorized"
+	ErrCodeForbidden    = "forbidden"
+	ErrCodeNotFound     = "not_found"
+)
+
+// APIKey is a tenant-scoped credential. A bucket or host list containing "*"
+// allows any value; callback hosts may also use a leading "*." wildcard.
+type APIKey struct {
+	ID            string   `json:"id"`
+	TenantID      string   `json:"tenantId"`
+	Name          string   `json:"name"`
+	InputBuckets  []string `json:"inputBuckets"`
+	OutputBuckets []string `json:"outputBuckets"`
+	CallbackHosts []string `json:"callbackHosts"`
+	CreatedAt     string   `json:"createdAt,omitempty"`
+	RevokedAt     string   `json:"revokedAt,omitempty"`
+}
+
+// CreateAPIKeyRequest is the body of POST /admin/api-keys
+type CreateAPIKeyRequest struct {
+	TenantID      string   `json:"tenantId"`
+	Name          string   `json:"name"`
+	InputBuckets  []string `json:"inputBuckets"`
+	OutputBuckets []string `json:"outputBuckets"`
+	CallbackHosts []string `json:"callbackHosts"`
+}
+
+// CreateAPIKeyResponse includes the plaintext key, which is only ever shown once
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+type apiKeyContextKey struct{}
+
+// hashAPIKey returns the hex SHA-256 of a key. Keys are 256 bits of random
+// data, so a fast unsalted hash is sufficient to protect them at rest.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey returns a new random plaintext API key
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + hex.EncodeToString(buf), nil
+}
+
+// Create a new API key, storing only its hash
+func CreateAPIKey(store APIKeyStore, req CreateAPIKeyRequest) (*CreateAPIKeyResponse, error) {
+	plaintext, err := generateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	key := APIKey{
+		ID:            uuid.New().String(),
+		TenantID:      req.TenantID,
+		Name:          req.Name,
+		InputBuckets:  nonNilStrings(req.InputBuckets),
+		OutputBuckets: nonNilStrings(req.OutputBuckets),
+		CallbackHosts: nonNilStrings(req.CallbackHosts),
+	}
+	if err := store.InsertAPIKey(key, hashAPIKey(plaintext)); err != nil {
+		return nil, err
+	}
+	return &CreateAPIKeyResponse{APIKey: key, Key: plaintext}, nil
+}
+
+// Store an API key under the hash of its plaintext
+func (s *sqlStore) InsertAPIKey(key APIKey, keyHash string) error {
+	inputBuckets, _ := json.Marshal(key.InputBuckets)
+	outputBuckets, _ := json.Marshal(key.OutputBuckets)
+	callbackHosts, _ := json.Marshal(key.CallbackHosts)
+	_, err := s.exec(`INSERT INTO api_keys (id, tenant_id, name, key_hash, input_buckets, output_buckets, callback_hosts) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		key.ID, key.TenantID, key.Name, keyHash, string(inputBuckets), string(outputBuckets), string(callbackHosts))
+	return err
+}
+
+const apiKeyColumns = `id, tenant_id, name, input_buckets, output_buckets, callback_hosts, created_at, revoked_at`
+
+func scanAPIKeys(rows *sql.Rows) ([]APIKey, error) {
+	var keys []APIKey
+	for rows.Next() {
+		var key APIKey
+		var inputBuckets, outputBuckets, callbackHosts string
+		var revokedAt sql.NullString
+		if err := rows.Scan(&key.ID, &key.TenantID, &key.Name, &inputBuckets, &outputBuckets, &callbackHosts, &key.CreatedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(inputBuckets), &key.InputBuckets); err != nil {
+			return nil, fmt.Errorf("corrupt input_buckets for API key %s: %w", key.ID, err)
+		}
+		if err := json.Unmarshal([]byte(outputBuckets), &key.OutputBuckets); err != nil {
+			return nil, fmt.Errorf("corrupt output_buckets for API key %s: %w", key.ID, err)
+		}
+		if err := json.Unmarshal([]byte(callbackHosts), &key.CallbackHosts); err != nil {
+			return nil, fmt.Errorf("corrupt callback_hosts for API key %s: %w", key.ID, err)
+		}
+		key.CreatedAt = apiTime(key.CreatedAt)
+		key.RevokedAt = apiTime(revokedAt.String)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Look up an active API key by its plaintext value, returning sql.ErrNoRows
+// if it is unknown or revoked
+func GetAPIKeyByPlaintext(store APIKeyStore, plaintext string) (*APIKey, error) {
+	return store.GetAPIKeyByHash(hashAPIKey(plaintext))
+}
+
+// Look up an active API key by the hash of its plaintext
+func (s *sqlStore) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	rows, err := s.query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL`, keyHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys, err := scanAPIKeys(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &keys[0], nil
+}
+
+// List all API keys, including revoked ones
+func (s *sqlStore) ListAPIKeys() ([]APIKey, error) {
+	rows, err := s.query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanAPIKeys(rows)
+}
+
+// Revoke an API key, returning sql.ErrNoRows if no active key has the ID
+func (s *sqlStore) RevokeAPIKey(id string) error {
+	res, err := s.exec(`UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func nonNilStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// apiKeyFromContext returns the API key that authenticated the request, or
+// nil if authentication is disabled.
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// tenantFromContext returns the tenant the request acts on behalf of
+func tenantFromContext(ctx context.Context) string {
+	if key := apiKeyFromContext(ctx); key != nil {
+		return key.TenantID
+	}
+	return DefaultTenantID
+}
+
+// requestCredential extracts the key from an Authorization: Bearer or
+// X-API-Key header
+func requestCredential(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(token)
+		}
+		return ""
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// RequireAPIKey authenticates the request with a tenant API key and stores
+// the key in the request context for scope checks by the handler.
+func RequireAPIKey(ctx *AppContext, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ctx.Config.AuthDisabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+		credential := requestCredential(r)
+		if credential == "" {
+			writeError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Missing API key", nil)
+			return
+		}
+		key, err := GetAPIKeyByPlaintext(ctx.Store, credential)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid API key", nil)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to verify API key: "+err.Error(), nil)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	})
+}
+
+// RequireAdmin authenticates the request with the configured admin key.
+// Admin endpoints are unavailable if no admin key is configured.
+func RequireAdmin(ctx *AppContext, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ctx.Config.AdminAPIKey == "" {
+			writeError(w, http.StatusForbidden, ErrCodeForbidden, "Admin API is disabled (ADMIN_API_KEY not set)", nil)
+			return
+		}
+		credential := requestCredential(r)
+		if subtle.ConstantTimeCompare([]byte(credential), []byte(ctx.Config.AdminAPIKey)) != 1 {
+			writeError(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid admin key", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Authorize checks that the key may use the buckets and callback host of a
+// request, returning a field error for each one outside its scope.
+func (k *APIKey) Authorize(reqPayload *RequestPayload) []FieldError {
+	var fields []FieldError
+	if !scopeAllows(k.InputBuckets, reqPayload.Input.Bucket) {
+		fields = append(fields, FieldError{Field: "input.bucket", Code: ErrCodeForbidden, Message: "API key may not read from this bucket"})
+	}
+	if !scopeAllows(k.OutputBuckets, reqPayload.Output.Bucket) {
+		fields = append(fields, FieldError{Field: "output.bucket", Code: ErrCodeForbidden, Message: "API key may not write to this bucket"})
+	}
+	if parsed, err := url.Parse(reqPayload.CallbackURL); err != nil || !callbackHostAllowed(k.CallbackHosts, parsed.Hostname()) {
+		fields = append(fields, FieldError{Field: "callbackUrl", Code: ErrCodeForbidden, Message: "API key may not send callbacks to this host"})
+	}
+	return fields
+}
+
+// CanAccessJob reports whether the key's tenant owns the job
+func (k *APIKey) CanAccessJob(job *Job) bool {
+	return k.TenantID == job.TenantID
+}
+
+func scopeAllows(allowed []string, value string) bool {
+	for _, a := range allowed {
+		if a == "*" || a == value {
+			return true
+		}
+	}
+	return false
+}
+
+func callbackHostAllowed(allowed []string, host string) bool {
+	host = strings.ToLower(host)
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == "*" || a == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(a, "*."); ok && strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPIKeyHandler creates a tenant API key and returns its plaintext once
+func CreateAPIKeyHandler(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CreateAPIKeyRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, ctx.Config.MaxRequestBodyBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid JSON: "+err.Error(), nil)
+			return
+		}
+		if req.TenantID == "" {
+			writeError(w, http.StatusBadRequest, ErrCodeValidationFailed, "Request validation failed",
+				[]FieldError{{Field: "tenantId", Code: FieldCodeRequired, Message: "is required"}})
+			return
+		}
+
+		created, err := CreateAPIKey(ctx.Store, req)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to create API key: "+err.Error(), nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+	}
+}
+
+// ListAPIKeysHandler lists all API keys without their secrets
+func ListAPIKeysHandler(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := ctx.Store.ListAPIKeys()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to list API keys: "+err.Error(), nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]APIKey{"apiKeys": nonNilAPIKeys(keys)})
+	}
+}
+
+// RevokeAPIKeyHandler revokes the API key named in the path
+func RevokeAPIKeyHandler(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := ctx.Store.RevokeAPIKey(r.PathValue("id"))
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, ErrCodeNotFound, "API key not found", nil)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to revoke API key: "+err.Error(), nil)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func nonNilAPIKeys(keys []APIKey) []APIKey {
+	if keys == nil {
+		return []APIKey{}
+	}
+	return keys
+}
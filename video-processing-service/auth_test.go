@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func createTestAPIKey(t *testing.T, router http.Handler, req CreateAPIKeyRequest) string {
+	t.Helper()
+	body, _ := json.Marshal(req)
+	httpReq := httptest.NewRequest(http.MethodPost, "/admin/api-keys", bytes.NewReader(body))
+	httpReq.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httpReq)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 creating API key, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created CreateAPIKeyResponse
+	json.NewDecoder(rec.Body).Decode(&created)
+	return created.Key
+}
+
+func TestAPIKeyAuthenticationAndScoping(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Config.AuthDisabled = false
+	ctx.Config.AdminAPIKey = "admin-secret"
+	router := NewRouter(ctx)
+
+	acmeKey := createTestAPIKey(t, router, CreateAPIKeyRequest{
+		TenantID:      "acme",
+		InputBuckets:  []string{"acme-uploads"},
+		OutputBuckets: []string{"acme-renditions"},
+		CallbackHosts: []string{"*.acme.example"},
+	})
+	otherKey := createTestAPIKey(t, router, CreateAPIKeyRequest{
+		TenantID:      "other",
+		InputBuckets:  []string{"*"},
+		OutputBuckets: []string{"*"},
+		CallbackHosts: []string{"*"},
+	})
+
+	payload := RequestPayload{
+		VideoId:     "vid123",
+		Input:       Input{Bucket: "acme-uploads", Key: "input.mp4"},
+		Output:      Output{Bucket: "acme-renditions", BasePath: "outputs/"},
+		Profiles:    []Profile{{Resolution: "720", Crf: 23}},
+		CallbackURL: "https://hooks.acme.example/done",
+	}
+
+	if rec := postProcessVideo(t, router, payload, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without API key, got %d", rec.Code)
+	}
+	if rec := postProcessVideo(t, router, payload, map[string]string{"X-API-Key": "vps_bogus"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with unknown API key, got %d", rec.Code)
+	}
+
+	rec := postProcessVideo(t, router, payload, map[string]string{"Authorization": "Bearer " + acmeKey})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 within scope, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp ResponsePayload
+	json.NewDecoder(rec.Body).Decode(&resp)
+
+	outOfScope := payload
+	outOfScope.Input.Bucket = "someone-elses-bucket"
+	outOfScope.CallbackURL = "https://evil.example/steal"
+	rec = postProcessVideo(t, router, outOfScope, map[string]string{"X-API-Key": acmeKey})
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 outside scope, got %d", rec.Code)
+	}
+	var errResp ErrorResponse
+	json.NewDecoder(rec.Body).Decode(&errResp)
+	if len(errResp.Fields) != 2 {
+		t.Errorf("Expected input bucket and callback host to be rejected, got %+v", errResp.Fields)
+	}
+
+	getJob := func(key string) int {
+		req := httptest.NewRequest(http.MethodGet, "/jobs/"+resp.Jobs[0].JobID, nil)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := getJob(acmeKey); code != http.StatusOK {
+		t.Errorf("Expected owner to read job, got %d", code)
+	}
+	if code := getJob(otherKey); code != http.StatusNotFound {
+		t.Errorf("Expected other tenant to get 404, got %d", code)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrJobCancelled is the cause of a worker's lease context being cancelled
+// when the job it is running was cancelled
+var ErrJobCancelled = errors.New("job was cancelled")
+
+// How long a worker may take to remove the output of a cancelled job
+const cancelCleanupTimeout = 30 * time.Second
+
+// RunningJobs lets a cancellation reach a job being encoded by this process
+// at once, rather than when its worker next renews the lease. A nil registry
+// tracks nothing.
+type RunningJobs struct {
+	mu   sync.Mutex
+	jobs map[string]map[*runningJob]bool
+}
+
+// runningJob is one attempt at a job, of which a process may briefly run
+// two if the first hung and lost its lease
+type runningJob struct {
+	cancel context.CancelCauseFunc
+}
+
+// NewRunningJobs creates an empty registry
+func NewRunningJobs() *RunningJobs {
+	return &RunningJobs{jobs: make(map[string]map[*runningJob]bool)}
+}
+
+func (r *RunningJobs) add(jobID string, cancel context.CancelCauseFunc) *runningJob {
+	running := &runningJob{cancel: cancel}
+	if r == nil {
+		return running
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.jobs[jobID] == nil {
+		r.jobs[jobID] = make(map[*runningJob]bool)
+	}
+	r.jobs[jobID][running] = true
+	return running
+}
+
+func (r *RunningJobs) remove(jobID string, running *runningJob) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.jobs[jobID], running)
+	if len(r.jobs[jobID]) == 0 {
+		delete(r.jobs, jobID)
+	}
+}
+
+// Cancel stops every attempt at the job running in this process
+func (r *RunningJobs) Cancel(jobID string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for running := range r.jobs[jobID] {
+		running.cancel(ErrJobCancelled)
+	}
+}
+
+// CancelJob cancels a job that has not finished encoding and queues its
+// cancellation callback. If this process is encoding the job, its ffmpeg and
+// S3 transfers are stopped at once; workers elsewhere notice when they next
+// renew the job's lease.
+func CancelJob(ctx *AppContext, jobID, detail string) (bool, error) {
+	cancelled, err := ctx.Store.CancelJob(jobID, detail)
+	if cancelled {
+		ctx.Running.Cancel(jobID)
+	}
+	return cancelled, err
+}
+
+// jobCancelled reports whether the job is now cancelled, for a worker that
+// lost the job's lease
+func jobCancelled(ctx *AppContext, jobID string) bool {
+	job, err := ctx.Store.GetJob(jobID)
+	return err == nil && job.Outcome == JobOutcomeCancelled
+}
+
+// abandonCancelledJob removes whatever a cancelled attempt may have uploaded
+func abandonCancelledJob(ctx *AppContext, job *Job, logger *slog.Logger) {
+	logger.Info("Job was cancelled, abandoning it")
+	if ctx.S3Client == nil {
+		return
+	}
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), cancelCleanupTimeout)
+	defer cancel()
+	if err := DeleteFile(cleanupCtx, ctx.S3Client, job.OutputBucket, OutputKey(job)); err != nil {
+		logger.Warn("Failed to remove output of cancelled job", "bucket", job.OutputBucket, "key", OutputKey(job), "error", err)
+	}
+}
+
+// requestActor describes who made a request, for the job's history
+func requestActor(r *http.Request) string {
+	if key := apiKeyFromContext(r.Context()); key != nil {
+		return "api key " + key.ID
+	}
+	return "api"
+}
+
+// CancelJobHandler cancels a job owned by the caller's tenant that has not
+// finished encoding. The cancellation callback is sent as for any other
+// outcome.
+func CancelJobHandler(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, err := ctx.Store.GetJob(r.PathValue("id"))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch job: "+err.Error(), nil)
+			return
+		}
+		if err != nil || job.TenantID != tenantFromContext(r.Context()) {
+			writeError(w, http.StatusNotFound, ErrCodeNotFound, "Job not found", nil)
+			return
+		}
+		cancelled, err := CancelJob(ctx, job.ID, requestActor(r))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to cancel job: "+err.Error(), nil)
+			return
+		}
+		if !cancelled {
+			writeError(w, http.StatusConflict, ErrCodeInvalidState, "Cannot cancel a job that is "+job.Status.String(), nil)
+			return
+		}
+		if job, err = ctx.Store.GetJob(job.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch job: "+err.Error(), nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(NewJobResponse(job))
+	}
+}
+
+// CancelVideoJobsHandler cancels every job of a video owned by the caller's
+// tenant that has not finished encoding, returning the jobs it cancelled
+func CancelVideoJobsHandler(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jobs, err := ctx.Store.ListJobs(JobFilter{TenantID: tenantFromContext(r.Context()), VideoID: r.PathValue("videoId")})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to list jobs: "+err.Error(), nil)
+			return
+		}
+		if len(jobs) == 0 {
+			writeError(w, http.StatusNotFound, ErrCodeNotFound, "Video has no jobs", nil)
+			return
+		}
+		cancelled := []JobResponse{}
+		for _, job := range jobs {
+			ok, err := CancelJob(ctx, job.ID, requestActor(r))
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to cancel job: "+err.Error(), nil)
+				return
+			}
+			if !ok {
+				continue
+			}
+			if updated, err := ctx.Store.GetJob(job.ID); err == nil {
+				job = *updated
+			}
+			cancelled = append(cancelled, NewJobResponse(&job))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]JobResponse{"jobs": cancelled})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCancelRunningJobStopsWorkerAndCallsBack(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Running = NewRunningJobs()
+	jobs := submitTestJobs(t, ctx, DefaultTenantID, 1)
+	job, err := ctx.Store.DequeueJob(testDequeueOptions(ctx), time.Now())
+	if err != nil || job == nil {
+		t.Fatalf("DequeueJob returned %v, %v", job, err)
+	}
+	leaseCtx, stop := StartHeartbeat(ctx, job, slog.Default())
+	defer stop()
+
+	req := httptest.NewRequest(http.MethodDelete, "/jobs/"+jobs[0].ID, nil)
+	rec := httptest.NewRecorder()
+	NewRouter(ctx).ServeHTTP(rec, req)
+	var resp JobResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || resp.Outcome != JobOutcomeCancelled {
+		t.Fatalf("Expected job to be cancelled, got %d %+v", rec.Code, resp)
+	}
+
+	// The worker in this process is stopped straight away
+	select {
+	case <-leaseCtx.Done():
+		if !errors.Is(context.Cause(leaseCtx), ErrJobCancelled) {
+			t.Errorf("Expected worker to be stopped by the cancellation, got %v", context.Cause(leaseCtx))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected worker to be stopped")
+	}
+
+	rec = httptest.NewRecorder()
+	NewRouter(ctx).ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/jobs/"+jobs[0].ID, nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected cancelling twice to conflict, got %d", rec.Code)
+	}
+
+	// The caller is told, after which the job is cancelled for good
+	var received CallbackPayload
+	callbacks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer callbacks.Close()
+	callback, err := ctx.Store.DequeueCallbackJob("callback-worker", 3, time.Now().Add(time.Minute))
+	if err != nil || callback == nil {
+		t.Fatalf("DequeueCallbackJob returned %v, %v", callback, err)
+	}
+	callback.CallbackURL = callbacks.URL
+	ProcessCallbackJob(ctx, callback)
+	if received.JobID != jobs[0].ID || received.Status != JobOutcomeCancelled || received.Output != nil {
+		t.Errorf("Unexpected cancellation callback %+v", received)
+	}
+	if job, _ := ctx.Store.GetJob(jobs[0].ID); job.Status != JobStatusCancelled {
+		t.Errorf("Expected job to be cancelled, got %v", job.Status)
+	}
+}
+
+func TestHeartbeatNoticesCancellationElsewhere(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Config.LeaseDuration = 30 * time.Millisecond
+	submitTestJobs(t, ctx, DefaultTenantID, 1)
+	job, err := ctx.Store.DequeueJob(testDequeueOptions(ctx), time.Now())
+	if err != nil || job == nil {
+		t.Fatalf("DequeueJob returned %v, %v", job, err)
+	}
+	leaseCtx, stop := StartHeartbeat(ctx, job, slog.Default())
+	defer stop()
+
+	// Cancelled by another process, which cannot reach this worker directly
+	if ok, err := ctx.Store.CancelJob(job.ID, "api"); err != nil || !ok {
+		t.Fatalf("CancelJob returned %v, %v", ok, err)
+	}
+	select {
+	case <-leaseCtx.Done():
+		if !errors.Is(context.Cause(leaseCtx), ErrJobCancelled) {
+			t.Errorf("Expected heartbeat to report the cancellation, got %v", context.Cause(leaseCtx))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected heartbeat to stop the worker")
+	}
+}
+
+func TestCancelVideoJobsOnlyTouchesCallersUnfinishedJobs(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	jobs := submitTestJobs(t, ctx, DefaultTenantID, 2)
+	submitTestJobs(t, ctx, "other", 1)
+	// One job has already been encoded and cannot be cancelled
+	if ok, err := ctx.Store.TransitionJob(jobs[1].ID, JobStatusCallbackSuccess); err != nil || !ok {
+		t.Fatalf("TransitionJob returned %v, %v", ok, err)
+	}
+
+	rec := httptest.NewRecorder()
+	NewRouter(ctx).ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/videos/"+DefaultTenantID+"-video/jobs", nil))
+	var resp struct {
+		Jobs []JobResponse `json:"jobs"`
+	}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if rec.Code != http.StatusOK || len(resp.Jobs) != 1 || resp.Jobs[0].JobID != jobs[0].ID {
+		t.Fatalf("Expected only the unfinished job to be cancelled, got %d %+v", rec.Code, resp)
+	}
+
+	rec = httptest.NewRecorder()
+	NewRouter(ctx).ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/videos/other-video/jobs", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected another tenant's video to be missing, got %d", rec.Code)
+	}
+}
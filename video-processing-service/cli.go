@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Command is an operator subcommand of the binary. Commands write their
+// results to out as indented JSON and read the same environment as the
+// server, working on its store directly.
+type Command struct {
+	Usage string
+	Run   func(args []string, out io.Writer) error
+}
+
+// Commands are the subcommands besides the run modes
+var Commands = map[string]Command{
+	"submit":       {"submit [-file request.json | flags...]: submit a video for encoding", runSubmitCommand},
+	"status":       {"status <job-id>: show a job and its history", runStatusCommand},
+	"list":         {"list [flags]: list jobs, filtered like GET /admin/jobs", runListCommand},
+	"retry":        {"retry [-reason text] <job-id>: retry a failed or cancelled job", jobOperationCommand(JobOperationRetry)},
+	"cancel":       {"cancel [-reason text] <job-id>: cancel a job", jobOperationCommand(JobOperationCancel)},
+	"migrate":      {"migrate [-dry-run]: apply pending schema migrations", runMigrateCommand},
+	"db":           {"db backup <file>: copy the SQLite database to a new file", runDBCommand},
+	"encode-local": {"encode-local -input <file> -output <file> [-profile 720:23] [-audio json] [-audio-only]: encode a local file without the queue", runEncodeLocalCommand},
+}
+
+// commandUsage lists every command, for errors about the command line
+func commandUsage() string {
+	names := make([]string, 0, len(Commands))
+	for name := range Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{
+		RunModeAll + ", " + RunModeServe + ", " + RunModeEncodeWorker + ", " + RunModeCallbackWorker + ": run the service",
+	}
+	for _, name := range names {
+		lines = append(lines, Commands[name].Usage)
+	}
+	return strings.Join(lines, "\n  ")
+}
+
+// openCommandContext opens the configured store for a command. The schema
+// is left alone; the server or the migrate command brings it up to date.
+func openCommandContext() (*AppContext, error) {
+	cfg := LoadConfig()
+	store, err := OpenStore(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	return &AppContext{Config: cfg, Store: store, InstanceID: NewInstanceID()}, nil
+}
+
+func printJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// getCommandJob fetches the job named by the single argument of a command
+func getCommandJob(ctx *AppContext, flags *flag.FlagSet) (*Job, error) {
+	if flags.NArg() != 1 {
+		return nil, fmt.Errorf("%s expects a single job ID", flags.Name())
+	}
+	job, err := ctx.Store.GetJob(flags.Arg(0))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("job %s not found", flags.Arg(0))
+	}
+	return job, err
+}
+
+// profileFlag collects repeated -profile flags of the form resolution[:crf]
+type profileFlag []Profile
+
+func (p *profileFlag) String() string {
+	var profiles []string
+	for _, profile := range *p {
+		profiles = append(profiles, fmt.Sprintf("%s:%d", profile.Resolution, profile.Crf))
+	}
+	return strings.Join(profiles, ",")
+}
+
+func (p *profileFlag) Set(v string) error {
+	resolution, crf, found := strings.Cut(v, ":")
+	profile := Profile{Resolution: resolution, Crf: defaultCrf}
+	if found {
+		n, err := strconv.Atoi(crf)
+		if err != nil {
+			return fmt.Errorf("invalid CRF %q", crf)
+		}
+		profile.Crf = n
+	}
+	*p = append(*p, profile)
+	return nil
+}
+
+// CRF of profiles given without one, x264's default
+const defaultCrf = 23
+
+func runSubmitCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("submit", flag.ExitOnError)
+	file := flags.String("file", "", "read the request from a JSON file, - for stdin; other flags override its fields")
+	tenant := flags.String("tenant", DefaultTenantID, "tenant to submit the jobs for")
+	videoID := flags.String("video", "", "video ID")
+	inputBucket := flags.String("input-bucket", "", "bucket of the source video")
+	inputKey := flags.String("input-key", "", "key of the source video")
+	outputBucket := flags.String("output-bucket", "", "bucket to write renditions to")
+	outputPath := flags.String("output-path", "", "key prefix of the renditions")
+	callbackURL := flags.String("callback", "", "URL to notify once the jobs finish")
+	idempotencyKey := flags.String("idempotency-key", "", "key making resubmission safe")
+	priority := flags.Int("priority", 0, "job priority")
+	deadline := flags.String("deadline", "", "RFC 3339 time the jobs should finish by")
+	var profiles profileFlag
+	flags.Var(&profiles, "profile", "rendition as resolution[:crf], repeatable")
+	flags.Parse(args)
+
+	payload := &RequestPayload{}
+	if *file != "" {
+		var r io.Reader = os.Stdin
+		if *file != "-" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		var err error
+		if payload, err = DecodeRequestPayload(r, 1<<20); err != nil {
+			return err
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "video":
+			payload.VideoId = *videoID
+		case "input-bucket":
+			payload.Input.Bucket = *inputBucket
+		case "input-key":
+			payload.Input.Key = *inputKey
+		case "output-bucket":
+			payload.Output.Bucket = *outputBucket
+		case "output-path":
+			payload.Output.BasePath = *outputPath
+		case "callback":
+			payload.CallbackURL = *callbackURL
+		case "idempotency-key":
+			payload.IdempotencyKey = *idempotencyKey
+		case "priority":
+			payload.Priority = priority
+		case "deadline":
+			payload.Deadline = *deadline
+		case "profile":
+			payload.Profiles = profiles
+		}
+	})
+
+	ctx, err := openCommandContext()
+	if err != nil {
+		return err
+	}
+	defer ctx.Store.Close()
+	jobs, replayed, err := SubmitJobs(context.Background(), ctx, *tenant, payload)
+	if err != nil {
+		return err
+	}
+	resp := ResponsePayload{Status: "accepted"}
+	if replayed {
+		resp.Status = "replayed"
+	}
+	for _, job := range jobs {
+		resp.Jobs = append(resp.Jobs, JobResult{JobID: job.ID, Resolution: job.Resolution, Status: job.Status.String()})
+	}
+	return printJSON(out, resp)
+}
+
+// JobStatusOutput is the output of the status command
+type JobStatusOutput struct {
+	JobResponse
+	Events []JobEventResponse `json:"events"`
+}
+
+func runStatusCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	flags.Parse(args)
+
+	ctx, err := openCommandContext()
+	if err != nil {
+		return err
+	}
+	defer ctx.Store.Close()
+	job, err := getCommandJob(ctx, flags)
+	if err != nil {
+		return err
+	}
+	events, err := ctx.Store.ListJobEvents(job.ID)
+	if err != nil {
+		return err
+	}
+	return printJSON(out, JobStatusOutput{JobResponse: NewJobResponse(job), Events: NewJobEventResponses(events)})
+}
+
+func runListCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	// Each flag is the query parameter of GET /admin/jobs of the same name
+	params := []string{"status", "videoId", "tenantId", "resolution", "minFailedCount", "minCallbackFailures",
+		"createdAfter", "createdBefore", "updatedAfter", "updatedBefore", "sort", "limit", "cursor"}
+	values := make(map[string]*string, len(params))
+	for _, param := range params {
+		values[param] = flags.String(param, "", "filter as the "+param+" query parameter of GET /admin/jobs")
+	}
+	flags.Parse(args)
+
+	query := url.Values{}
+	flags.Visit(func(f *flag.Flag) { query.Set(f.Name, *values[f.Name]) })
+	filter, fields := ParseJobListQuery(query, true)
+	if len(fields) > 0 {
+		return &ValidationError{Code: ErrCodeValidationFailed, Message: "Invalid filter", Fields: fields}
+	}
+
+	ctx, err := openCommandContext()
+	if err != nil {
+		return err
+	}
+	defer ctx.Store.Close()
+	resp, err := ListJobPage(ctx.Store, filter)
+	if err != nil {
+		return err
+	}
+	return printJSON(out, resp)
+}
+
+// jobOperationCommand returns a command applying an administrative
+// operation to a job, as the admin API does
+func jobOperationCommand(operation string) func(args []string, out io.Writer) error {
+	return func(args []string, out io.Writer) error {
+		flags := flag.NewFlagSet(operation, flag.ExitOnError)
+		reason := flags.String("reason", "", "reason recorded in the job's history")
+		flags.Parse(args)
+
+		ctx, err := openCommandContext()
+		if err != nil {
+			return err
+		}
+		defer ctx.Store.Close()
+		job, err := getCommandJob(ctx, flags)
+		if err != nil {
+			return err
+		}
+		ok, err := ApplyJobOperation(ctx, job, operation, JobOperationRequest{Reason: *reason})
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("cannot %s a job that is %s", operation, job.Status)
+		}
+		if job, err = ctx.Store.GetJob(job.ID); err != nil {
+			return err
+		}
+		return printJSON(out, NewJobResponse(job))
+	}
+}
+
+func runDBCommand(args []string, out io.Writer) error {
+	if len(args) != 2 || args[0] != "backup" {
+		return errors.New("usage: db backup <file>")
+	}
+	ctx, err := openCommandContext()
+	if err != nil {
+		return err
+	}
+	defer ctx.Store.Close()
+	store, ok := ctx.Store.(*SQLiteStore)
+	if !ok {
+		return errors.New("db backup only supports SQLite, back up PostgreSQL with pg_dump")
+	}
+	if err := store.Backup(args[1]); err != nil {
+		return err
+	}
+	return printJSON(out, map[string]string{"backup": args[1]})
+}
+
+func runEncodeLocalCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("encode-local", flag.ExitOnError)
+	input := flags.String("input", "", "video file to encode")
+	output := flags.String("output", "", "file to write, which must not exist")
+	var profiles profileFlag
+	flags.Var(&profiles, "profile", "rendition as resolution[:crf]")
+	audio := flags.String("audio", "", `audio settings as JSON, such as {"codec":"opus","normalize":{}}`)
+	audioOnly := flags.Bool("audio-only", false, "encode only the audio, ignoring -profile")
+	stallTimeout := flags.Duration("stall-timeout", 0, "kill ffmpeg if it reports no progress for this long, 0 to wait forever")
+	flags.Parse(args)
+
+	if *input == "" || *output == "" {
+		return errors.New("encode-local requires -input and -output")
+	}
+	var audioProfile *AudioProfile
+	if *audio != "" {
+		decoder := json.NewDecoder(strings.NewReader(*audio))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&audioProfile); err != nil {
+			return fmt.Errorf("invalid -audio: %w", err)
+		}
+	}
+	switch {
+	case *audioOnly:
+		profiles = profileFlag{{AudioOnly: true, Audio: audioProfile}}
+	case len(profiles) == 0:
+		profiles = profileFlag{{Resolution: "720", Crf: defaultCrf}}
+	}
+	for i := range profiles {
+		profiles[i].Audio = audioProfile
+	}
+	parsed, err := ParseProfiles(profiles)
+	if err != nil {
+		return err
+	}
+	if len(parsed) != 1 {
+		return errors.New("encode-local encodes a single profile")
+	}
+	if err := ConvertVideo(context.Background(), slog.Default(), *input, *output, parsed[0], *stallTimeout); err != nil {
+		return err
+	}
+	if parsed[0].AudioOnly {
+		return printJSON(out, map[string]interface{}{"output": *output, "audio": parsed[0].Audio})
+	}
+	return printJSON(out, map[string]interface{}{"output": *output, "resolution": parsed[0].Resolution, "crf": parsed[0].Crf, "audio": parsed[0].Audio})
+}
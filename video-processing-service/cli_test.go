@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// runTestCommand runs a command, decoding the JSON it prints into v
+func runTestCommand(t *testing.T, v interface{}, name string, args ...string) error {
+	t.Helper()
+	var out bytes.Buffer
+	if err := Commands[name].Run(args, &out); err != nil {
+		return err
+	}
+	if v != nil {
+		if err := json.Unmarshal(out.Bytes(), v); err != nil {
+			t.Fatalf("%s printed invalid JSON %q: %v", name, out.String(), err)
+		}
+	}
+	return nil
+}
+
+func TestCommandsManageJobsInTheStore(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DB_PATH", filepath.Join(dir, "jobs.db"))
+	var dryRun, migrated, upToDate MigrateOutput
+	if err := runTestCommand(t, &dryRun, "migrate", "-dry-run"); err != nil || dryRun.Version != 0 || len(dryRun.Pending) == 0 || dryRun.Pending[0] != "0001_create_jobs" {
+		t.Fatalf("migrate -dry-run returned %+v, %v", dryRun, err)
+	}
+	if err := runTestCommand(t, &migrated, "migrate"); err != nil || !reflect.DeepEqual(migrated.Applied, dryRun.Pending) {
+		t.Fatalf("migrate returned %+v, %v", migrated, err)
+	}
+	if err := runTestCommand(t, &upToDate, "migrate"); err != nil || upToDate.Version != len(dryRun.Pending) || len(upToDate.Applied) != 0 {
+		t.Errorf("Expected nothing left to migrate, got %+v, %v", upToDate, err)
+	}
+
+	var submitted ResponsePayload
+	err := runTestCommand(t, &submitted, "submit", "-tenant", "acme", "-video", "cli-video",
+		"-input-bucket", "input-bucket", "-input-key", "in.mp4", "-output-bucket", "output-bucket", "-output-path", "out/",
+		"-callback", "http://callback.example.com/done", "-profile", "480", "-profile", "720:20")
+	if err != nil || len(submitted.Jobs) != 2 {
+		t.Fatalf("submit returned %+v, %v", submitted, err)
+	}
+	jobID := submitted.Jobs[1].JobID
+
+	var status JobStatusOutput
+	if err := runTestCommand(t, &status, "status", jobID); err != nil || status.Crf != 20 || status.TenantID != "acme" || len(status.Events) == 0 {
+		t.Errorf("status returned %+v, %v", status, err)
+	}
+
+	var cancelled JobResponse
+	if err := runTestCommand(t, &cancelled, "cancel", "-reason", "duplicate", jobID); err != nil || cancelled.Outcome != JobOutcomeCancelled {
+		t.Errorf("cancel returned %+v, %v", cancelled, err)
+	}
+	if err := runTestCommand(t, nil, "cancel", jobID); err == nil {
+		t.Error("Expected cancelling twice to fail")
+	}
+	var retried JobResponse
+	if err := runTestCommand(t, &retried, "retry", jobID); err != nil || retried.Status != "encoding_pending" {
+		t.Errorf("retry returned %+v, %v", retried, err)
+	}
+
+	var listed JobListResponse
+	if err := runTestCommand(t, &listed, "list", "-tenantId", "acme", "-resolution", "720"); err != nil || len(listed.Jobs) != 1 || listed.Jobs[0].JobID != jobID {
+		t.Errorf("list returned %+v, %v", listed, err)
+	}
+	if err := runTestCommand(t, nil, "list", "-sort", "size"); err == nil {
+		t.Error("Expected an invalid sort to be rejected")
+	}
+	if err := runTestCommand(t, nil, "status", "missing"); err == nil {
+		t.Error("Expected status of a missing job to fail")
+	}
+
+	backup := filepath.Join(dir, "backup.db")
+	if err := runTestCommand(t, nil, "db", "backup", backup); err != nil {
+		t.Fatalf("db backup failed: %v", err)
+	}
+	if _, err := os.Stat(backup); err != nil {
+		t.Errorf("Expected a backup file: %v", err)
+	}
+}
+
+func TestSubmitCommandFlagsOverrideFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DB_PATH", filepath.Join(dir, "jobs.db"))
+	runTestCommand(t, nil, "migrate")
+	file := filepath.Join(dir, "request.json")
+	os.WriteFile(file, []byte(`{"videoId": "file-video", "input": {"bucket": "input-bucket", "key": "in.mp4"},
+		"output": {"bucket": "output-bucket", "basePath": "out/"}, "profiles": [{"resolution": "360", "crf": 23}],
+		"callbackUrl": "http://callback.example.com/done"}`), 0644)
+
+	var submitted ResponsePayload
+	if err := runTestCommand(t, &submitted, "submit", "-file", file, "-profile", "1080"); err != nil || len(submitted.Jobs) != 1 || submitted.Jobs[0].Resolution != 1080 {
+		t.Errorf("submit returned %+v, %v", submitted, err)
+	}
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries the signature of a callback when the service is
+// configured with a signing secret
+const SignatureHeader = "X-Callback-Signature"
+
+// DefaultSignatureTolerance is how old a callback may be before it is
+// rejected as a possible replay
+const DefaultSignatureTolerance = 5 * time.Minute
+
+// Errors of callback verification
+var (
+	ErrMissingSignature = errors.New("callback is not signed")
+	ErrInvalidSignature = errors.New("callback signature is invalid")
+	ErrExpiredSignature = errors.New("callback signature has expired")
+)
+
+// Callback is posted to the callback URL of a job once it has finished
+type Callback struct {
+	JobID      string `json:"jobId"`
+	VideoID    string `json:"videoId"`
+	Resolution int    `json:"resolution"`
+	// Status is succeeded, failed or cancelled
+	Status string `json:"status"`
+	// Output is the rendition, for jobs that succeeded
+	Output         *Location `json:"output,omitempty"`
+	EncodedSeconds float64   `json:"encodedSeconds,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	// Attempts are the failed encoding attempts, for jobs that failed
+	Attempts []JobEvent `json:"attempts,omitempty"`
+}
+
+// JobEvent is an entry of the history of a job
+type JobEvent struct {
+	Event      string `json:"event"`
+	Status     string `json:"status"`
+	WorkerID   string `json:"workerId,omitempty"`
+	Attempt    int    `json:"attempt"`
+	Error      string `json:"error,omitempty"`
+	ExitCode   *int   `json:"exitCode,omitempty"`
+	StderrTail string `json:"stderrTail,omitempty"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+// VerifyCallbackSignature checks the signature header of a callback body
+// against the signing secret, rejecting signatures made more than tolerance
+// before now
+func VerifyCallbackSignature(secret, header string, body []byte, now time.Time, tolerance time.Duration) error {
+	if header == "" {
+		return ErrMissingSignature
+	}
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+	for _, signature := range signatures {
+		given, err := hex.DecodeString(signature)
+		if err == nil && hmac.Equal(given, expected) {
+			if age := now.Sub(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+				return ErrExpiredSignature
+			}
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// ParseCallback reads a callback request, verifying its signature with the
+// signing secret unless the secret is empty
+func ParseCallback(r *http.Request, secret string) (*Callback, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if secret != "" {
+		if err := VerifyCallbackSignature(secret, r.Header.Get(SignatureHeader), body, time.Now(), DefaultSignatureTolerance); err != nil {
+			return nil, err
+		}
+	}
+	var callback Callback
+	if err := json.Unmarshal(body, &callback); err != nil {
+		return nil, err
+	}
+	return &callback, nil
+}
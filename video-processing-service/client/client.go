@@ -0,0 +1,299 @@
+// Package client talks to the video processing service, so that services
+// submitting videos need not re-implement its request and response types.
+// The types mirror the service's OpenAPI document, served at /openapi.json,
+// and are checked against the real handlers by the service's contract tests.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Profile is a rendition to encode
+type Profile struct {
+	// Resolution is the height of the rendition in pixels, such as "720".
+	// Audio-only profiles have none.
+	Resolution string        `json:"resolution,omitempty"`
+	Crf        int           `json:"crf"`
+	Audio      *AudioProfile `json:"audio,omitempty"`
+	// AudioOnly encodes just the audio, to an .m4a file for HLS audio groups
+	AudioOnly bool `json:"audioOnly,omitempty"`
+}
+
+// AudioProfile configures the audio of a rendition. Profiles without one
+// encode the source's default audio track with ffmpeg's defaults.
+type AudioProfile struct {
+	// Codec is aac, opus, copy or none, aac if empty. Audio-only renditions
+	// must use aac or opus.
+	Codec string `json:"codec,omitempty"`
+	// Bitrate in kbit/s, 128 for AAC and 96 for Opus if zero
+	Bitrate int `json:"bitrate,omitempty"`
+	// Channels and SampleRate are those of the source if zero
+	Channels   int `json:"channels,omitempty"`
+	SampleRate int `json:"sampleRate,omitempty"`
+	// Normalize adjusts the loudness to an EBU R128 target in two passes
+	Normalize *LoudnessTarget `json:"normalize,omitempty"`
+	// Track selects an audio stream of the source by its index among the
+	// audio streams, and Language by its ISO 639-2 tag. At most one is set.
+	Track    *int   `json:"track,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// LoudnessTarget is an EBU R128 loudness target. Nil fields take the
+// defaults of the recommendation: -23 LUFS, -1 dBTP and 7 LU.
+type LoudnessTarget struct {
+	Integrated *float64 `json:"integrated,omitempty"`
+	TruePeak   *float64 `json:"truePeak,omitempty"`
+	Range      *float64 `json:"range,omitempty"`
+}
+
+// Location is an object in S3
+type Location struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// OutputLocation is where the renditions of a video are written
+type OutputLocation struct {
+	Bucket   string `json:"bucket"`
+	BasePath string `json:"basePath"`
+}
+
+// SubmitRequest asks for a video to be encoded into one rendition per
+// profile, each reported to CallbackURL once finished
+type SubmitRequest struct {
+	VideoID        string         `json:"videoId,omitempty"`
+	Input          Location       `json:"input"`
+	Output         OutputLocation `json:"output"`
+	Profiles       []Profile      `json:"profiles"`
+	CallbackURL    string         `json:"callbackUrl"`
+	IdempotencyKey string         `json:"idempotencyKey,omitempty"`
+	Priority       *int           `json:"priority,omitempty"`
+	Deadline       string         `json:"deadline,omitempty"`
+}
+
+// SubmittedJob is a job created for a profile of a submission
+type SubmittedJob struct {
+	JobID      string `json:"jobId"`
+	Resolution int    `json:"resolution"`
+	Status     string `json:"status"`
+}
+
+type SubmitResponse struct {
+	Status string         `json:"status"`
+	Jobs   []SubmittedJob `json:"jobs"`
+	// Replayed is set if the idempotency key was seen before, in which case
+	// Jobs are those of the original submission
+	Replayed bool `json:"-"`
+}
+
+// Job is the state of an encoding job
+type Job struct {
+	JobID      string `json:"jobId"`
+	VideoID    string `json:"videoId"`
+	TenantID   string `json:"tenantId"`
+	Resolution int    `json:"resolution"`
+	Crf        int    `json:"crf"`
+	// Audio has the defaults of its codec filled in, and is nil if the job
+	// leaves audio to ffmpeg
+	Audio            *AudioProfile `json:"audio,omitempty"`
+	AudioOnly        bool          `json:"audioOnly,omitempty"`
+	Status           string        `json:"status"`
+	Priority         int           `json:"priority"`
+	Deadline         string        `json:"deadline,omitempty"`
+	FailedCount      int           `json:"failedCount"`
+	CallbackFailures int           `json:"callbackFailures"`
+	// Outcome is succeeded, failed or cancelled once encoding has finished
+	Outcome   string `json:"outcome,omitempty"`
+	CreatedAt string `json:"createdAt"`
+	UpdatedAt string `json:"updatedAt"`
+}
+
+// ListOptions filter and page a job listing. Zero fields are not sent.
+type ListOptions struct {
+	Statuses            []string
+	VideoID             string
+	Resolution          int
+	MinFailedCount      int
+	MinCallbackFailures int
+	CreatedAfter        time.Time
+	CreatedBefore       time.Time
+	UpdatedAfter        time.Time
+	UpdatedBefore       time.Time
+	// Sort names a field, prefixed with "-" to sort descending
+	Sort   string
+	Limit  int
+	Cursor string
+}
+
+type JobList struct {
+	Jobs []Job `json:"jobs"`
+	// NextCursor fetches the next page with ListOptions.Cursor, and is
+	// empty on the last page
+	NextCursor string `json:"nextCursor"`
+	// Counts are the number of jobs in each status matching every option
+	// but Statuses
+	Counts map[string]int `json:"counts"`
+}
+
+// FieldError describes an invalid field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error is an error response of the service
+type Error struct {
+	StatusCode int          `json:"-"`
+	Code       string       `json:"code"`
+	Message    string       `json:"error"`
+	Fields     []FieldError `json:"fields,omitempty"`
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("video processing service: HTTP %d %s: %s", e.StatusCode, e.Code, e.Message)
+	for _, f := range e.Fields {
+		msg += fmt.Sprintf("; %s: %s", f.Field, f.Message)
+	}
+	return msg
+}
+
+// Client calls the service with a tenant API key
+type Client struct {
+	BaseURL    string
+	APIKey     string
+	HTTPClient *http.Client
+}
+
+// New returns a client of the service at baseURL, such as
+// http://video-processing:3000
+func New(baseURL, apiKey string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), APIKey: apiKey, HTTPClient: http.DefaultClient}
+}
+
+// Submit submits a video for encoding
+func (c *Client) Submit(ctx context.Context, req SubmitRequest) (*SubmitResponse, error) {
+	var resp SubmitResponse
+	header, err := c.do(ctx, http.MethodPost, "/process-video", req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	resp.Replayed = header.Get("Idempotent-Replayed") == "true"
+	return &resp, nil
+}
+
+// GetJob returns a job of the caller's tenant
+func (c *Client) GetJob(ctx context.Context, jobID string) (*Job, error) {
+	var job Job
+	if _, err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(jobID), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ListJobs returns a page of the caller's jobs
+func (c *Client) ListJobs(ctx context.Context, opts ListOptions) (*JobList, error) {
+	query := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	setInt := func(name string, n int) {
+		if n != 0 {
+			query.Set(name, strconv.Itoa(n))
+		}
+	}
+	setTime := func(name string, t time.Time) {
+		if !t.IsZero() {
+			query.Set(name, t.UTC().Format(time.RFC3339))
+		}
+	}
+	set("status", strings.Join(opts.Statuses, ","))
+	set("videoId", opts.VideoID)
+	setInt("resolution", opts.Resolution)
+	setInt("minFailedCount", opts.MinFailedCount)
+	setInt("minCallbackFailures", opts.MinCallbackFailures)
+	setTime("createdAfter", opts.CreatedAfter)
+	setTime("createdBefore", opts.CreatedBefore)
+	setTime("updatedAfter", opts.UpdatedAfter)
+	setTime("updatedBefore", opts.UpdatedBefore)
+	set("sort", opts.Sort)
+	setInt("limit", opts.Limit)
+	set("cursor", opts.Cursor)
+
+	path := "/jobs"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var list JobList
+	if _, err := c.do(ctx, http.MethodGet, path, nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// CancelJob cancels a job, stopping it if it is running. Its callback
+// reports it as cancelled.
+func (c *Client) CancelJob(ctx context.Context, jobID string) (*Job, error) {
+	var job Job
+	if _, err := c.do(ctx, http.MethodDelete, "/jobs/"+url.PathEscape(jobID), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// do sends a request with an optional JSON body, decoding a successful JSON
+// response into out and returning any other response as an *Error
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) (http.Header, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return nil, apiErr
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return resp.Header, nil
+}
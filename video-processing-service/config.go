@@ -1,10 +1,10 @@
 package main
 
 import (
-	"log"
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 )
 
 type S3Config struct {
@@ -14,14 +14,69 @@ type S3Config struct {
 	SecretAccessKey string
 }
 
+type NATSConfig struct {
+	URL        string
+	Stream     string
+	Subject    string
+	Durable    string
+	MaxDeliver int
+	RetryDelay time.Duration
+	TenantID   string
+}
+
+// SQLiteConfig tunes the SQLite store and its maintenance. Backups are only
+// taken when a backup path or bucket is set, and zero intervals disable the
+// corresponding task.
+type SQLiteConfig struct {
+	BusyTimeout            time.Duration
+	ReadConnections        int
+	IntegrityCheckInterval time.Duration
+	BackupInterval         time.Duration
+	BackupPath             string
+	BackupBucket           string
+	BackupPrefix           string
+	BackupKeep             int
+	VacuumInterval         time.Duration
+}
+
+// RetentionConfig sets how long jobs are kept once they finish with each
+// outcome; zero keeps them forever. Expired jobs are archived to the archive
+// bucket, if set, before being deleted.
+type RetentionConfig struct {
+	Succeeded     time.Duration
+	Failed        time.Duration
+	Cancelled     time.Duration
+	Interval      time.Duration
+	BatchSize     int
+	ArchiveBucket string
+	ArchivePrefix string
+}
+
 type Config struct {
 	DBFilePath              string
+	DatabaseURL             string
+	SQLite                  SQLiteConfig
 	S3                      S3Config
 	LocalRawVideoPath       string
 	LocalProcessedVideoPath string
 	EncoderWorkerCount      int
 	MaxEncodingFailures     int
 	MaxCallbackFailures     int
+	MaxRequestBodyBytes     int64
+	AdminAPIKey             string
+	AuthDisabled            bool
+	TenantDefaults          TenantLimits
+	PriorityAgingInterval   time.Duration
+	EncodeRetryBackoff      time.Duration
+	LeaseDuration           time.Duration
+	EncodeStallTimeout      time.Duration
+	CallbackTimeout         time.Duration
+	CallbackSigningSecret   string
+	MetricsAddr             string
+	MinFreeScratchBytes     int64
+	TracesExporter          string
+	Retention               RetentionConfig
+	NATS                    NATSConfig
 }
 
 func LoadConfig() Config {
@@ -32,9 +87,11 @@ func LoadConfig() Config {
 		}
 	}
 
+	// A PostgreSQL URL takes precedence over the SQLite file
+	databaseURL := os.Getenv("DATABASE_URL")
 	dbFilePath := os.Getenv("DB_PATH")
-	if dbFilePath == "" {
-		log.Fatal("DB_PATH environment variable must be set")
+	if dbFilePath == "" && databaseURL == "" {
+		fatal("DB_PATH or DATABASE_URL environment variable must be set")
 	}
 
 	maxCallbackFailures := 3 // default
@@ -51,8 +108,51 @@ func LoadConfig() Config {
 		}
 	}
 
+	maxRequestBodyBytes := int64(1 << 20) // default 1 MiB
+	if v := os.Getenv("MAX_REQUEST_BODY_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			maxRequestBodyBytes = n
+		}
+	}
+
+	priorityAgingInterval := 10 * time.Minute // default
+	if v := os.Getenv("PRIORITY_AGING_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			priorityAgingInterval = d
+		}
+	}
+
+	encodeRetryBackoff := 30 * time.Second // default
+	if v := os.Getenv("ENCODE_RETRY_BACKOFF"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			encodeRetryBackoff = d
+		}
+	}
+
+	natsMaxDeliver := 5 // default
+	if v := os.Getenv("NATS_MAX_DELIVER"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			natsMaxDeliver = n
+		}
+	}
+
+	// Cancelled jobs are kept as long as failed ones unless set separately
+	failedRetention := envDuration("JOB_RETENTION_FAILED", 0)
+
 	return Config{
-		DBFilePath: dbFilePath,
+		DBFilePath:  dbFilePath,
+		DatabaseURL: databaseURL,
+		SQLite: SQLiteConfig{
+			BusyTimeout:            envDuration("SQLITE_BUSY_TIMEOUT", 5*time.Second),
+			ReadConnections:        envNonNegativeInt("SQLITE_READ_CONNECTIONS", 4),
+			IntegrityCheckInterval: envDuration("SQLITE_INTEGRITY_CHECK_INTERVAL", 24*time.Hour),
+			BackupInterval:         envDuration("SQLITE_BACKUP_INTERVAL", 24*time.Hour),
+			BackupPath:             os.Getenv("SQLITE_BACKUP_PATH"),
+			BackupBucket:           os.Getenv("SQLITE_BACKUP_BUCKET"),
+			BackupPrefix:           envOrDefault("SQLITE_BACKUP_PREFIX", "sqlite-backups/"),
+			BackupKeep:             envNonNegativeInt("SQLITE_BACKUP_KEEP", 7),
+			VacuumInterval:         envDuration("SQLITE_VACUUM_INTERVAL", 7*24*time.Hour),
+		},
 		S3: S3Config{
 			Endpoint:        os.Getenv("S3_ENDPOINT"),
 			Region:          os.Getenv("S3_REGION"),
@@ -64,5 +164,71 @@ func LoadConfig() Config {
 		EncoderWorkerCount:      encoderWorkerCount,
 		MaxCallbackFailures:     maxCallbackFailures,
 		MaxEncodingFailures:     maxEncodingFailures,
+		MaxRequestBodyBytes:     maxRequestBodyBytes,
+		AdminAPIKey:             os.Getenv("ADMIN_API_KEY"),
+		AuthDisabled:            os.Getenv("AUTH_DISABLED") == "true",
+		PriorityAgingInterval:   priorityAgingInterval,
+		EncodeRetryBackoff:      encodeRetryBackoff,
+		LeaseDuration:           envDuration("LEASE_DURATION", time.Minute),
+		EncodeStallTimeout:      envDuration("ENCODE_STALL_TIMEOUT", 5*time.Minute),
+		CallbackTimeout:         envDuration("CALLBACK_TIMEOUT", 30*time.Second),
+		CallbackSigningSecret:   os.Getenv("CALLBACK_SIGNING_SECRET"),
+		MetricsAddr:             os.Getenv("METRICS_ADDR"),
+		MinFreeScratchBytes:     int64(envNonNegativeInt("SCRATCH_MIN_FREE_BYTES", 1<<30)),
+		TracesExporter:          envOrDefault("OTEL_TRACES_EXPORTER", "none"),
+		Retention: RetentionConfig{
+			Succeeded:     envDuration("JOB_RETENTION_SUCCEEDED", 0),
+			Failed:        failedRetention,
+			Cancelled:     envDuration("JOB_RETENTION_CANCELLED", failedRetention),
+			Interval:      envDuration("RETENTION_INTERVAL", time.Hour),
+			BatchSize:     envNonNegativeInt("RETENTION_BATCH_SIZE", 500),
+			ArchiveBucket: os.Getenv("RETENTION_ARCHIVE_BUCKET"),
+			ArchivePrefix: envOrDefault("RETENTION_ARCHIVE_PREFIX", "job-archive/"),
+		},
+		TenantDefaults: TenantLimits{
+			Weight:                 envNonNegativeInt("TENANT_DEFAULT_WEIGHT", 1),
+			MaxConcurrentEncodes:   envNonNegativeInt("TENANT_MAX_CONCURRENT_ENCODES", 0),
+			MaxQueuedJobs:          envNonNegativeInt("TENANT_MAX_QUEUED_JOBS", 0),
+			MaxDailyEncodedMinutes: envNonNegativeInt("TENANT_MAX_DAILY_ENCODED_MINUTES", 0),
+		},
+		NATS: NATSConfig{
+			URL:        os.Getenv("NATS_URL"),
+			Stream:     envOrDefault("NATS_STREAM", "VIDEO_JOBS"),
+			Subject:    envOrDefault("NATS_SUBJECT", "video.process"),
+			Durable:    envOrDefault("NATS_DURABLE", "video-processing-service"),
+			MaxDeliver: natsMaxDeliver,
+			RetryDelay: 5 * time.Second,
+			TenantID:   envOrDefault("NATS_TENANT", DefaultTenantID),
+		},
+	}
+}
+
+// envOrDefault returns the environment variable or def if it is unset
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envNonNegativeInt parses an integer environment variable, returning def if
+// it is unset or invalid. Zero is allowed and usually means unlimited.
+func envNonNegativeInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			return n
+		}
+	}
+	return def
+}
+
+// envDuration parses a positive duration environment variable such as "90s",
+// returning def if it is unset or invalid
+func envDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
 	}
+	return def
 }
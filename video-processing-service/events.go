@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Job event types, recorded in the job's history as it moves through the
+// pipeline
+const (
+	JobEventCreated              = "created"
+	JobEventClaimed              = "claimed"
+	JobEventEncoded              = "encoded"
+	JobEventEncodeFailed         = "encode_failed"
+	JobEventEncodeLeaseExpired   = "encode_lease_expired"
+	JobEventCallbackClaimed      = "callback_claimed"
+	JobEventCallbackSucceeded    = "callback_succeeded"
+	JobEventCallbackFailed       = "callback_failed"
+	JobEventCallbackLeaseExpired = "callback_lease_expired"
+	JobEventTransitioned         = "transitioned"
+	JobEventCancelled            = "cancelled"
+	JobEventRetried              = "retried"
+	JobEventCallbackRequeued     = "callback_requeued"
+	JobEventPriorityChanged      = "priority_changed"
+)
+
+// Outcomes of the encoding stage, reported in the job's callback
+const (
+	JobOutcomeSucceeded = "succeeded"
+	JobOutcomeFailed    = "failed"
+	JobOutcomeCancelled = "cancelled"
+)
+
+// Attempt describes how an encoding or callback attempt went. An empty Error
+// means it succeeded.
+type Attempt struct {
+	Error      string
+	ExitCode   *int
+	StderrTail string
+	Duration   time.Duration
+}
+
+// JobEvent is one entry of a job's history. Status is the job's status after
+// the event and Attempt the number of the encoding or callback attempt it
+// belongs to, counting from 1. Detail describes administrative operations,
+// such as why a job was cancelled.
+type JobEvent struct {
+	ID         int64
+	JobID      string
+	Type       string
+	Status     JobStatus
+	WorkerID   string
+	Attempt    int
+	Error      string
+	ExitCode   *int
+	StderrTail string
+	Duration   time.Duration
+	Detail     string
+	CreatedAt  string
+}
+
+// newAttemptEvent builds the event recording the end of an attempt
+func newAttemptEvent(jobID, eventType string, status JobStatus, workerID string, number int, attempt Attempt) JobEvent {
+	return JobEvent{
+		JobID:      jobID,
+		Type:       eventType,
+		Status:     status,
+		WorkerID:   workerID,
+		Attempt:    number,
+		Error:      attempt.Error,
+		ExitCode:   attempt.ExitCode,
+		StderrTail: attempt.StderrTail,
+		Duration:   attempt.Duration,
+	}
+}
+
+// insertJobEvent records an event in the transaction that caused it, so the
+// history never disagrees with the job
+func (s *sqlStore) insertJobEvent(tx *sql.Tx, event JobEvent) error {
+	var durationMs interface{}
+	if event.Duration > 0 {
+		durationMs = event.Duration.Milliseconds()
+	}
+	_, err := tx.Exec(s.rebind(`INSERT INTO job_events (job_id, event, status, worker_id, attempt, error, exit_code, stderr_tail, duration_ms, detail, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`),
+		event.JobID, event.Type, int(event.Status), nullIfEmpty(event.WorkerID), event.Attempt,
+		nullIfEmpty(event.Error), event.ExitCode, nullIfEmpty(event.StderrTail), durationMs, nullIfEmpty(event.Detail))
+	return err
+}
+
+// List the history of a job, oldest first
+func (s *sqlStore) ListJobEvents(jobID string) ([]JobEvent, error) {
+	rows, err := s.query(`SELECT id, job_id, event, status, worker_id, attempt, error, exit_code, stderr_tail, duration_ms, detail, created_at
+		FROM job_events WHERE job_id = ? ORDER BY id`, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []JobEvent
+	for rows.Next() {
+		var event JobEvent
+		var status int
+		var workerID, errorMessage, stderrTail, detail sql.NullString
+		var exitCode, durationMs sql.NullInt64
+		if err := rows.Scan(&event.ID, &event.JobID, &event.Type, &status, &workerID, &event.Attempt,
+			&errorMessage, &exitCode, &stderrTail, &durationMs, &detail, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		event.Status = JobStatus(status)
+		event.WorkerID = workerID.String
+		event.Error = errorMessage.String
+		event.StderrTail = stderrTail.String
+		event.Detail = detail.String
+		event.Duration = time.Duration(durationMs.Int64) * time.Millisecond
+		event.CreatedAt = apiTime(event.CreatedAt)
+		if exitCode.Valid {
+			code := int(exitCode.Int64)
+			event.ExitCode = &code
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+type JobEventResponse struct {
+	Event      string `json:"event"`
+	Status     string `json:"status"`
+	WorkerID   string `json:"workerId,omitempty"`
+	Attempt    int    `json:"attempt"`
+	Error      string `json:"error,omitempty"`
+	ExitCode   *int   `json:"exitCode,omitempty"`
+	StderrTail string `json:"stderrTail,omitempty"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+	CreatedAt  string `json:"createdAt"`
+}
+
+// NewJobEventResponses converts a job's history to its API representation
+func NewJobEventResponses(events []JobEvent) []JobEventResponse {
+	responses := []JobEventResponse{}
+	for _, event := range events {
+		responses = append(responses, JobEventResponse{
+			Event:      event.Type,
+			Status:     event.Status.String(),
+			WorkerID:   event.WorkerID,
+			Attempt:    event.Attempt,
+			Error:      event.Error,
+			ExitCode:   event.ExitCode,
+			StderrTail: event.StderrTail,
+			DurationMs: event.Duration.Milliseconds(),
+			Detail:     event.Detail,
+			CreatedAt:  event.CreatedAt,
+		})
+	}
+	return responses
+}
+
+// GetJobEventsHandler returns the history of a job owned by the caller's tenant
+func GetJobEventsHandler(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, err := ctx.Store.GetJob(r.PathValue("id"))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch job: "+err.Error(), nil)
+			return
+		}
+		if err != nil || job.TenantID != tenantFromContext(r.Context()) {
+			writeError(w, http.StatusNotFound, ErrCodeNotFound, "Job not found", nil)
+			return
+		}
+		events, err := ctx.Store.ListJobEvents(job.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch job events: "+err.Error(), nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]JobEventResponse{"events": NewJobEventResponses(events)})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFailedJobHistoryIsServedAndCalledBack(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Config.MaxEncodingFailures = 2
+	opts := testDequeueOptions(ctx)
+
+	var received CallbackPayload
+	callbacks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer callbacks.Close()
+	jobs := submitTestJobs(t, ctx, DefaultTenantID, 1)
+
+	// Both attempts fail, the second for good
+	exitCode := 1
+	for i := 0; i < 2; i++ {
+		job, err := ctx.Store.DequeueJob(opts, time.Now().Add(time.Duration(i)*time.Hour))
+		if err != nil || job == nil {
+			t.Fatalf("Attempt %d: DequeueJob returned %v, %v", i+1, job, err)
+		}
+		attempt := Attempt{Error: "ffmpeg exited with code 1", ExitCode: &exitCode, StderrTail: "Invalid data found when processing input", Duration: time.Second}
+		if err := ctx.Store.MarkJobFailed(job.ID, opts.WorkerID, time.Now(), ctx.Config.MaxEncodingFailures, attempt); err != nil {
+			t.Fatalf("Attempt %d: MarkJobFailed failed: %v", i+1, err)
+		}
+	}
+	job, _ := ctx.Store.GetJob(jobs[0].ID)
+	if job.Status != JobStatusCallbackPending || job.Outcome != JobOutcomeFailed {
+		t.Fatalf("Expected failed job to await its callback, got %+v", job)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID+"/events", nil)
+	rec := httptest.NewRecorder()
+	NewRouter(ctx).ServeHTTP(rec, req)
+	var history struct {
+		Events []JobEventResponse `json:"events"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&history); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Expected job events, got %d: %v", rec.Code, err)
+	}
+	var types []string
+	for _, event := range history.Events {
+		types = append(types, event.Event)
+	}
+	want := []string{JobEventCreated, JobEventClaimed, JobEventEncodeFailed, JobEventClaimed, JobEventEncodeFailed}
+	if len(types) != len(want) {
+		t.Fatalf("Expected events %v, got %v", want, types)
+	}
+	last := history.Events[4]
+	if last.Attempt != 2 || last.WorkerID != opts.WorkerID || last.ExitCode == nil || *last.ExitCode != 1 || last.DurationMs != 1000 || last.Status != "callback_pending" {
+		t.Errorf("Unexpected final attempt %+v", last)
+	}
+
+	// The failure callback carries the attempts
+	callback, err := ctx.Store.DequeueCallbackJob("callback-worker", 3, time.Now().Add(time.Minute))
+	if err != nil || callback == nil {
+		t.Fatalf("DequeueCallbackJob returned %v, %v", callback, err)
+	}
+	callback.CallbackURL = callbacks.URL
+	ProcessCallbackJob(ctx, callback)
+	if received.Status != JobOutcomeFailed || len(received.Attempts) != 2 || received.Attempts[1].StderrTail == "" || received.Error == "" {
+		t.Errorf("Unexpected failure callback %+v", received)
+	}
+	job, _ = ctx.Store.GetJob(jobs[0].ID)
+	if job.Status != JobStatusCallbackSuccess {
+		t.Errorf("Expected delivered callback to succeed, got %v", job.Status)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// How long a single readiness check may take before it counts as failed
+const readinessCheckTimeout = 5 * time.Second
+
+// Encoders ffmpeg must provide: the video codec and the audio codecs
+// profiles may ask for
+var requiredEncoders = []string{videoCodec, audioEncoders[AudioCodecAAC], audioEncoders[AudioCodecOpus]}
+
+// HealthCheck is one dependency the service needs in order to do its work
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// ReadinessChecks returns the checks that must pass before the process can
+// take traffic or work. Only processes running encoders need ffmpeg and
+// scratch disk.
+func ReadinessChecks(ctx *AppContext) []HealthCheck {
+	checks := []HealthCheck{{Name: "database", Check: ctx.Store.Ping}}
+	if ctx.S3Client != nil {
+		checks = append(checks, HealthCheck{Name: "s3", Check: func(c context.Context) error {
+			return checkS3(c, ctx.S3Client)
+		}})
+	}
+	if ctx.Mode != RunModeServe && ctx.Mode != RunModeCallbackWorker {
+		checks = append(checks,
+			HealthCheck{Name: "ffmpeg", Check: checkFFmpeg},
+			HealthCheck{Name: "scratch_disk", Check: func(context.Context) error {
+				return checkScratchDisk(ctx.Config.MinFreeScratchBytes, ctx.Config.LocalRawVideoPath, ctx.Config.LocalProcessedVideoPath)
+			}},
+		)
+	}
+	return checks
+}
+
+// checkS3 checks that the S3 endpoint answers. An error response such as
+// access denied still proves it reachable; only failing to get any response
+// does not.
+func checkS3(ctx context.Context, client *s3.Client) error {
+	_, err := client.ListBuckets(ctx, &s3.ListBucketsInput{})
+	var apiErr smithy.APIError
+	if err != nil && !errors.As(err, &apiErr) {
+		return err
+	}
+	return nil
+}
+
+// checkFFmpeg checks that ffmpeg is installed with every required encoder
+func checkFFmpeg(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list ffmpeg encoders: %w", err)
+	}
+	for _, encoder := range requiredEncoders {
+		if !bytes.Contains(out, []byte(" "+encoder+" ")) {
+			return fmt.Errorf("ffmpeg lacks the %s encoder", encoder)
+		}
+	}
+	return nil
+}
+
+// checkScratchDisk checks that each directory can be written to and that
+// the disks they are on have at least minFree bytes available
+func checkScratchDisk(minFree int64, dirs ...string) error {
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		f, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return fmt.Errorf("%s is not writable: %w", dir, err)
+		}
+		f.Close()
+		os.Remove(f.Name())
+
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(dir, &stat); err != nil {
+			return fmt.Errorf("failed to stat filesystem of %s: %w", dir, err)
+		}
+		if free := int64(stat.Bavail) * int64(stat.Bsize); free < minFree {
+			return fmt.Errorf("%s has %d bytes free, need %d", dir, free, minFree)
+		}
+	}
+	return nil
+}
+
+// CheckResult is the outcome of one readiness check
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ReadinessResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// RunReadinessChecks runs the checks concurrently, reporting whether all of
+// them passed
+func RunReadinessChecks(ctx context.Context, checks []HealthCheck) (ReadinessResponse, bool) {
+	resp := ReadinessResponse{Status: "ready", Checks: make(map[string]CheckResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check HealthCheck) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+			defer cancel()
+			result := CheckResult{Status: "ok"}
+			if err := check.Check(checkCtx); err != nil {
+				result = CheckResult{Status: "failed", Error: err.Error()}
+			}
+			mu.Lock()
+			resp.Checks[check.Name] = result
+			mu.Unlock()
+		}(check)
+	}
+	wg.Wait()
+
+	for _, result := range resp.Checks {
+		if result.Status != "ok" {
+			resp.Status = "not_ready"
+			return resp, false
+		}
+	}
+	return resp, true
+}
+
+// HealthzHandler reports that the process is alive, without checking any of
+// its dependencies
+func HealthzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}
+}
+
+// ReadyzHandler reports whether every dependency of the process is usable,
+// answering 503 if any is not
+func ReadyzHandler(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, ready := RunReadinessChecks(r.Context(), ReadinessChecks(ctx))
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// WorkerState is what a worker is currently doing
+type WorkerState struct {
+	ID       string `json:"id"`
+	Pool     string `json:"pool"`
+	State    string `json:"state"`
+	Since    string `json:"since"`
+	JobID    string `json:"jobId,omitempty"`
+	VideoID  string `json:"videoId,omitempty"`
+	TenantID string `json:"tenantId,omitempty"`
+	Attempt  int    `json:"attempt,omitempty"`
+}
+
+// Worker states reported on the status page
+const (
+	WorkerStateIdle = "idle"
+	WorkerStateBusy = "busy"
+)
+
+// WorkerRegistry tracks the workers of this process for the status page. A
+// nil registry tracks nothing.
+type WorkerRegistry struct {
+	mu      sync.Mutex
+	workers map[string]WorkerState
+}
+
+// NewWorkerRegistry creates an empty registry
+func NewWorkerRegistry() *WorkerRegistry {
+	return &WorkerRegistry{workers: make(map[string]WorkerState)}
+}
+
+// Register adds an idle worker of the pool
+func (r *WorkerRegistry) Register(workerID, pool string) {
+	r.set(workerID, WorkerState{Pool: pool, State: WorkerStateIdle})
+}
+
+// Busy records that the worker is making an attempt at the job
+func (r *WorkerRegistry) Busy(workerID, pool string, job *Job, attempt int) {
+	r.set(workerID, WorkerState{Pool: pool, State: WorkerStateBusy,
+		JobID: job.ID, VideoID: job.VideoID, TenantID: job.TenantID, Attempt: attempt})
+}
+
+// Idle records that the worker has finished its job
+func (r *WorkerRegistry) Idle(workerID, pool string) {
+	r.set(workerID, WorkerState{Pool: pool, State: WorkerStateIdle})
+}
+
+func (r *WorkerRegistry) set(workerID string, state WorkerState) {
+	if r == nil {
+		return
+	}
+	state.ID = workerID
+	state.Since = time.Now().UTC().Format(time.RFC3339)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.workers[workerID] = state
+}
+
+// Snapshot returns the state of every worker, ordered by ID
+func (r *WorkerRegistry) Snapshot() []WorkerState {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	states := make([]WorkerState, 0, len(r.workers))
+	for _, state := range r.workers {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].ID < states[j].ID })
+	return states
+}
+
+// BuildInfo identifies the binary that is running
+type BuildInfo struct {
+	GoVersion    string `json:"goVersion"`
+	Version      string `json:"version,omitempty"`
+	Revision     string `json:"revision,omitempty"`
+	RevisionTime string `json:"revisionTime,omitempty"`
+	Modified     bool   `json:"modified,omitempty"`
+}
+
+// ReadBuildInfo returns the version control details embedded by go build
+func ReadBuildInfo() BuildInfo {
+	build := BuildInfo{GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return build
+	}
+	build.Version = info.Main.Version
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			build.Revision = setting.Value
+		case "vcs.time":
+			build.RevisionTime = setting.Value
+		case "vcs.modified":
+			build.Modified = setting.Value == "true"
+		}
+	}
+	return build
+}
+
+type StatusResponse struct {
+	InstanceID    string         `json:"instanceId"`
+	Mode          string         `json:"mode"`
+	StartedAt     string         `json:"startedAt"`
+	UptimeSeconds int64          `json:"uptimeSeconds"`
+	Build         BuildInfo      `json:"build"`
+	Workers       []WorkerState  `json:"workers"`
+	Jobs          map[string]int `json:"jobs,omitempty"`
+	JobsError     string         `json:"jobsError,omitempty"`
+}
+
+// DebugStatusHandler reports the build, workers and current jobs of this
+// process, and the number of jobs in each status across the deployment
+func DebugStatusHandler(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := StatusResponse{
+			InstanceID:    ctx.InstanceID,
+			Mode:          ctx.Mode,
+			StartedAt:     ctx.StartedAt.UTC().Format(time.RFC3339),
+			UptimeSeconds: int64(time.Since(ctx.StartedAt) / time.Second),
+			Build:         ReadBuildInfo(),
+			Workers:       ctx.Workers.Snapshot(),
+		}
+		if counts, err := ctx.Store.CountJobsByStatus(JobFilter{}); err != nil {
+			resp.JobsError = err.Error()
+		} else {
+			resp.Jobs = make(map[string]int, len(counts))
+			for status, n := range counts {
+				resp.Jobs[status.String()] = n
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadinessReportsEachDependency(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Mode = RunModeServe
+	router := NewRouter(ctx)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected /healthz to answer 200, got %d", rec.Code)
+	}
+
+	// The API only needs its database
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var ready ReadinessResponse
+	json.NewDecoder(rec.Body).Decode(&ready)
+	if rec.Code != http.StatusOK || ready.Status != "ready" || ready.Checks["database"].Status != "ok" {
+		t.Fatalf("Expected API to be ready, got %d %+v", rec.Code, ready)
+	}
+
+	// Encoders also need scratch space
+	ctx.Mode = RunModeEncodeWorker
+	dir := t.TempDir()
+	ctx.Config.LocalRawVideoPath = filepath.Join(dir, "raw")
+	ctx.Config.LocalProcessedVideoPath = filepath.Join(dir, "processed")
+	ctx.Config.MinFreeScratchBytes = 1 << 62
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	ready = ReadinessResponse{}
+	json.NewDecoder(rec.Body).Decode(&ready)
+	if rec.Code != http.StatusServiceUnavailable || ready.Status != "not_ready" || ready.Checks["scratch_disk"].Status != "failed" {
+		t.Fatalf("Expected encoder without scratch space to be unready, got %d %+v", rec.Code, ready)
+	}
+	if _, ok := ready.Checks["ffmpeg"]; !ok {
+		t.Errorf("Expected encoder readiness to check ffmpeg, got %+v", ready.Checks)
+	}
+}
+
+func TestDebugStatusShowsWorkersAndTheirJobs(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Config.AdminAPIKey = "admin-secret"
+	ctx.InstanceID = "test-instance"
+	ctx.StartedAt = time.Now().Add(-time.Minute)
+	ctx.Workers = NewWorkerRegistry()
+	jobs := submitTestJobs(t, ctx, DefaultTenantID, 1)
+	ctx.Workers.Register("test-instance/encode-1", encodePool)
+	ctx.Workers.Register("test-instance/encode-2", encodePool)
+	ctx.Workers.Busy("test-instance/encode-2", encodePool, &jobs[0], 1)
+
+	req := httptest.NewRequest(http.MethodGet, "/debug/status", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	NewRouter(ctx).ServeHTTP(rec, req)
+	var status StatusResponse
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Expected status page, got %d: %v", rec.Code, err)
+	}
+	if status.InstanceID != "test-instance" || status.UptimeSeconds < 60 || status.Build.GoVersion == "" {
+		t.Errorf("Unexpected process details %+v", status)
+	}
+	if len(status.Workers) != 2 || status.Workers[0].State != WorkerStateIdle ||
+		status.Workers[1].State != WorkerStateBusy || status.Workers[1].JobID != jobs[0].ID {
+		t.Errorf("Unexpected workers %+v", status.Workers)
+	}
+	if status.Jobs["encoding_pending"] != 1 {
+		t.Errorf("Expected one pending job, got %v", status.Jobs)
+	}
+}
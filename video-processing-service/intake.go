@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+)
+
+// ErrIdempotencyKeyReused is returned when an idempotency key is submitted
+// again with a request for a different video, input, output or callback.
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used for a different request")
+
+// JobIntake is a source of encoding requests other than the HTTP API.
+// Every intake hands decoded payloads to SubmitJobs so that they go through
+// the same validation and CreateJobsInDB path as ProcessVideoHandler.
+type JobIntake interface {
+	// Start begins consuming requests in the background.
+	Start(ctx *AppContext) error
+	// Close stops consuming and releases the underlying connection.
+	Close() error
+}
+
+// SubmitJobs validates a request payload and stores its jobs. Once it returns
+// a nil error the jobs are durably stored and the request may be acknowledged.
+// If the payload carries an idempotency key that was seen before, the jobs
+// created for the original request are returned instead and replayed is true.
+// New jobs join the trace of reqCtx.
+func SubmitJobs(reqCtx context.Context, ctx *AppContext, tenantID string, reqPayload *RequestPayload) (jobs []Job, replayed bool, err error) {
+	if err := ValidateRequestPayload(reqPayload); err != nil {
+		return nil, false, err
+	}
+	return SubmitValidatedJobs(reqCtx, ctx, tenantID, reqPayload)
+}
+
+// SubmitValidatedJobs is SubmitJobs for a payload that has already passed
+// ValidateRequestPayload, such as one ProcessVideoHandler has checked
+// against the caller's API key.
+func SubmitValidatedJobs(reqCtx context.Context, ctx *AppContext, tenantID string, reqPayload *RequestPayload) (jobs []Job, replayed bool, err error) {
+	if reqPayload.IdempotencyKey != "" {
+		existing, err := findIdempotentJobs(ctx, tenantID, reqPayload)
+		if err != nil || len(existing) > 0 {
+			return existing, err == nil, err
+		}
+	}
+
+	settings, err := ctx.Store.GetTenantSettings(tenantID)
+	if err != nil {
+		return nil, false, err
+	}
+	limits := settings.Apply(ctx.Config.TenantDefaults)
+
+	jobs, err = CreateJobsInDB(reqCtx, ctx.Store, tenantID, reqPayload, limits)
+	if err != nil {
+		// A concurrent retry may have inserted the same key first
+		if reqPayload.IdempotencyKey != "" && ctx.Store.IsUniqueViolation(err) {
+			existing, findErr := findIdempotentJobs(ctx, tenantID, reqPayload)
+			if findErr == nil && len(existing) > 0 {
+				return existing, true, nil
+			}
+		}
+		return nil, false, err
+	}
+	ctx.Notifier.Notify()
+	return jobs, false, nil
+}
+
+// findIdempotentJobs returns the jobs the tenant stored under the request's
+// idempotency key, checking that they were created for the same video, input,
+// output location, callback and set of output files.
+func findIdempotentJobs(ctx *AppContext, tenantID string, reqPayload *RequestPayload) ([]Job, error) {
+	existing, err := ctx.Store.GetJobsByIdempotencyKey(tenantID, reqPayload.IdempotencyKey)
+	if err != nil || len(existing) == 0 {
+		return nil, err
+	}
+	profiles, err := ParseProfiles(reqPayload.Profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored, requested []string
+	for _, job := range existing {
+		if job.VideoID != reqPayload.VideoId || job.InputBucket != reqPayload.Input.Bucket || job.InputKey != reqPayload.Input.Key ||
+			job.OutputBucket != reqPayload.Output.Bucket || job.OutputPath != reqPayload.Output.BasePath || job.CallbackURL != reqPayload.CallbackURL {
+			return nil, ErrIdempotencyKeyReused
+		}
+		stored = append(stored, OutputFileName(&job))
+	}
+	for _, profile := range profiles {
+		requested = append(requested, OutputFileName(&Job{Resolution: profile.Resolution, Audio: profile.Audio, AudioOnly: profile.AudioOnly}))
+	}
+	sort.Strings(stored)
+	sort.Strings(requested)
+	if !slices.Equal(stored, requested) {
+		return nil, ErrIdempotencyKeyReused
+	}
+	return existing, nil
+}
+
+// ConfiguredIntakes returns the job intakes enabled by the config
+func ConfiguredIntakes(cfg Config) []JobIntake {
+	var intakes []JobIntake
+	if cfg.NATS.URL != "" {
+		intakes = append(intakes, NewNATSIntake(cfg.NATS))
+	}
+	return intakes
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes of job listings
+const (
+	defaultJobListLimit = 50
+	maxJobListLimit     = 500
+)
+
+// API names of the columns jobs can be sorted by
+var jobSortParams = map[string]string{
+	"createdAt":   "created_at",
+	"updatedAt":   "updated_at",
+	"priority":    "priority",
+	"failedCount": "failed_count",
+}
+
+type JobListResponse struct {
+	Jobs []JobResponse `json:"jobs"`
+	// NextCursor fetches the following page, and is omitted on the last
+	NextCursor string `json:"nextCursor,omitempty"`
+	// Counts are the number of jobs in each status matching every filter
+	// but status, across all pages
+	Counts map[string]int `json:"counts"`
+}
+
+// listCursor is the opaque cursor handed to clients. It records the sort it
+// was made for, so that it cannot be used with another.
+type listCursor struct {
+	Sort       string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	Value      string `json:"v"`
+	ID         string `json:"id"`
+}
+
+func encodeListCursor(order JobSort, cursor JobCursor) string {
+	data, _ := json.Marshal(listCursor{Sort: order.Column, Descending: order.Descending, Value: cursor.Value, ID: cursor.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(s string, order JobSort) (*JobCursor, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, false
+	}
+	var c listCursor
+	if json.Unmarshal(data, &c) != nil || c.ID == "" || c.Sort != order.Column || c.Descending != order.Descending {
+		return nil, false
+	}
+	return &JobCursor{Value: c.Value, ID: c.ID}, true
+}
+
+// ParseJobListQuery converts the query parameters of a job listing to a
+// filter. Statuses may be repeated or comma separated, times are RFC 3339,
+// and sort names a field, prefixed with "-" to sort descending. tenantId is
+// only accepted if allowTenant is set.
+func ParseJobListQuery(query map[string][]string, allowTenant bool) (JobFilter, []FieldError) {
+	filter := JobFilter{Sort: JobSort{Column: "created_at"}, Limit: defaultJobListLimit}
+	var fields []FieldError
+	add := func(field, code, message string) {
+		fields = append(fields, FieldError{Field: field, Code: code, Message: message})
+	}
+	positive := func(name, v string) int {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			add(name, FieldCodeInvalidFormat, "must be a positive integer")
+		}
+		return n
+	}
+	timestamp := func(name, v string) time.Time {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			add(name, FieldCodeInvalidFormat, "must be an RFC 3339 timestamp")
+		}
+		return t
+	}
+
+	// The cursor depends on the sort, so it is decoded last
+	var cursor string
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		v := values[len(values)-1]
+		switch name {
+		case "status":
+			for _, value := range values {
+				for _, s := range strings.Split(value, ",") {
+					status, ok := ParseJobStatus(strings.TrimSpace(s))
+					if !ok {
+						add(name, FieldCodeInvalidFormat, fmt.Sprintf("unknown job status %q", s))
+					}
+					filter.Statuses = append(filter.Statuses, status)
+				}
+			}
+		case "videoId":
+			filter.VideoID = v
+		case "tenantId":
+			if !allowTenant {
+				add(name, FieldCodeUnknown, "jobs are listed for the tenant of the API key")
+			}
+			filter.TenantID = v
+		case "resolution":
+			filter.Resolution = positive(name, v)
+		case "minFailedCount":
+			filter.MinFailedCount = positive(name, v)
+		case "minCallbackFailures":
+			filter.MinCallbackFailures = positive(name, v)
+		case "createdAfter":
+			filter.CreatedAfter = timestamp(name, v)
+		case "createdBefore":
+			filter.CreatedBefore = timestamp(name, v)
+		case "updatedAfter":
+			filter.UpdatedAfter = timestamp(name, v)
+		case "updatedBefore":
+			filter.UpdatedBefore = timestamp(name, v)
+		case "sort":
+			column, ok := jobSortParams[strings.TrimPrefix(v, "-")]
+			if !ok {
+				add(name, FieldCodeInvalidFormat, "must be createdAt, updatedAt, priority or failedCount, optionally prefixed with -")
+			}
+			filter.Sort = JobSort{Column: column, Descending: strings.HasPrefix(v, "-")}
+		case "limit":
+			if filter.Limit = positive(name, v); filter.Limit > maxJobListLimit {
+				add(name, FieldCodeOutOfRange, fmt.Sprintf("must be at most %d", maxJobListLimit))
+			}
+		case "cursor":
+			cursor = v
+		default:
+			add(name, FieldCodeUnknown, "unknown query parameter")
+		}
+	}
+	if cursor != "" {
+		after, ok := decodeListCursor(cursor, filter.Sort)
+		if !ok {
+			add("cursor", FieldCodeInvalidFormat, "is not a cursor of this listing and sort")
+		}
+		filter.After = after
+	}
+	return filter, fields
+}
+
+// ListJobsHandler lists jobs a page at a time, oldest first unless sorted
+// otherwise, with the number of matching jobs in each status. API keys
+// list the jobs of their tenant; admins list every tenant's.
+func ListJobsHandler(ctx *AppContext, admin bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, fields := ParseJobListQuery(r.URL.Query(), admin)
+		if len(fields) > 0 {
+			writeError(w, http.StatusBadRequest, ErrCodeValidationFailed, "Request validation failed", fields)
+			return
+		}
+		if !admin {
+			filter.TenantID = tenantFromContext(r.Context())
+		}
+
+		resp, err := ListJobPage(ctx.Store, filter)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to list jobs: "+err.Error(), nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// ListJobPage lists a page of the jobs matching the filter, with a cursor to
+// the next page if there is one and the counts of matching jobs by status
+func ListJobPage(store JobStore, filter JobFilter) (JobListResponse, error) {
+	// One extra job tells whether there is another page
+	limit := filter.Limit
+	filter.Limit++
+	jobs, err := store.ListJobs(filter)
+	if err != nil {
+		return JobListResponse{}, err
+	}
+	countFilter := filter
+	countFilter.Statuses = nil
+	counts, err := store.CountJobsByStatus(countFilter)
+	if err != nil {
+		return JobListResponse{}, fmt.Errorf("failed to count jobs: %w", err)
+	}
+
+	resp := JobListResponse{Jobs: []JobResponse{}, Counts: make(map[string]int, len(counts))}
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+		resp.NextCursor = encodeListCursor(filter.Sort, JobCursorFor(&jobs[limit-1], filter.Sort))
+	}
+	for i := range jobs {
+		resp.Jobs = append(resp.Jobs, NewJobResponse(&jobs[i]))
+	}
+	for status, n := range counts {
+		resp.Counts[status.String()] = n
+	}
+	return resp, nil
+}
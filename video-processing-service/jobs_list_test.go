@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func listJobs(t *testing.T, ctx *AppContext, path string, query url.Values) (int, JobListResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, path+"?"+query.Encode(), nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rec := httptest.NewRecorder()
+	NewRouter(ctx).ServeHTTP(rec, req)
+	var resp JobListResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	return rec.Code, resp
+}
+
+func TestListJobsPagesThroughFilteredJobs(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	jobs := submitTestJobs(t, ctx, DefaultTenantID, 5)
+	submitTestJobs(t, ctx, "other", 2)
+	if ok, err := ctx.Store.TransitionJob(jobs[0].ID, JobStatusCallbackFailed); err != nil || !ok {
+		t.Fatalf("TransitionJob returned %v, %v", ok, err)
+	}
+
+	// Jobs created in the same second are paged through by ID, with none
+	// skipped or repeated
+	seen := map[string]bool{}
+	query := url.Values{"status": {"encoding_pending"}, "limit": {"2"}, "sort": {"-createdAt"}}
+	for page := 0; ; page++ {
+		code, resp := listJobs(t, ctx, "/jobs", query)
+		if code != http.StatusOK {
+			t.Fatalf("Expected jobs to be listed, got %d", code)
+		}
+		if resp.Counts["encoding_pending"] != 4 || resp.Counts["callback_failed"] != 1 {
+			t.Errorf("Unexpected counts %v", resp.Counts)
+		}
+		for _, job := range resp.Jobs {
+			if seen[job.JobID] || job.TenantID != DefaultTenantID || job.Status != "encoding_pending" {
+				t.Errorf("Unexpected job %+v on page %d", job, page)
+			}
+			seen[job.JobID] = true
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		query.Set("cursor", resp.NextCursor)
+	}
+	if len(seen) != 4 {
+		t.Errorf("Expected 4 pending jobs, got %d", len(seen))
+	}
+
+	// A cursor only continues the sort it was made for
+	query.Set("sort", "createdAt")
+	if code, _ := listJobs(t, ctx, "/jobs", query); code != http.StatusBadRequest {
+		t.Errorf("Expected cursor of another sort to be rejected, got %d", code)
+	}
+}
+
+func TestListJobsFiltersAndScopesByTenant(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Config.AdminAPIKey = "admin-secret"
+	jobs := submitTestJobs(t, ctx, "acme", 2)
+	submitTestJobs(t, ctx, DefaultTenantID, 1)
+	if err := ctx.Store.(testStore).incrementFailedCount(jobs[1].ID); err != nil {
+		t.Fatalf("incrementFailedCount failed: %v", err)
+	}
+
+	_, resp := listJobs(t, ctx, "/admin/jobs", url.Values{"tenantId": {"acme"}, "minFailedCount": {"1"}})
+	if len(resp.Jobs) != 1 || resp.Jobs[0].JobID != jobs[1].ID {
+		t.Errorf("Expected only the failed job, got %+v", resp.Jobs)
+	}
+	_, resp = listJobs(t, ctx, "/admin/jobs", url.Values{"resolution": {"240"}, "createdAfter": {"2000-01-01T00:00:00Z"}})
+	if len(resp.Jobs) != 2 || resp.Counts["encoding_pending"] != 2 {
+		t.Errorf("Expected the 240p job of each tenant, got %+v", resp)
+	}
+	if _, resp = listJobs(t, ctx, "/admin/jobs", url.Values{"createdBefore": {"2000-01-01T00:00:00Z"}}); len(resp.Jobs) != 0 {
+		t.Errorf("Expected no jobs created before 2000, got %+v", resp.Jobs)
+	}
+
+	// API keys only ever see their own tenant
+	if _, resp = listJobs(t, ctx, "/jobs", nil); len(resp.Jobs) != 1 || resp.Jobs[0].TenantID != DefaultTenantID {
+		t.Errorf("Expected only the caller's job, got %+v", resp.Jobs)
+	}
+	for _, query := range []url.Values{
+		{"tenantId": {"acme"}},
+		{"status": {"stuck"}},
+		{"limit": {"1000"}},
+		{"sort": {"videoId"}},
+		{"updatedAfter": {"yesterday"}},
+		{"colour": {"blue"}},
+	} {
+		if code, _ := listJobs(t, ctx, "/jobs", query); code != http.StatusBadRequest {
+			t.Errorf("Expected %v to be rejected, got %d", query, code)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrLeaseLost is returned when a worker tries to update a job whose lease
+// has expired and been taken over by the reaper or another worker.
+var ErrLeaseLost = errors.New("job lease lost to another worker")
+
+// NewInstanceID returns an identifier for this process, used as the prefix of
+// its worker IDs so that leases can be traced back to a host.
+func NewInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), uuid.New().String()[:8])
+}
+
+// Extend the lease on a job the worker still owns
+func (s *sqlStore) RenewLease(jobID, workerID string, expiresAt time.Time) error {
+	res, err := s.exec(`UPDATE jobs SET lease_expires_at = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND worker_id = ? AND status IN (?, ?)`,
+		sqlTime(expiresAt), jobID, workerID, int(JobStatusEncodingRunning), int(JobStatusCallbackInProgress))
+	if err != nil {
+		return err
+	}
+	return requireAffected(res)
+}
+
+// requireAffected maps an update that matched no rows to ErrLeaseLost
+func requireAffected(res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// scanLeased scans the row returned by an update of a leased job, mapping no
+// row to ErrLeaseLost
+func scanLeased(row *sql.Row, dest ...interface{}) error {
+	err := row.Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+// ReapExpiredLeases returns jobs whose lease has expired to the queue,
+// counting the abandoned attempt. Encoding jobs become failed and are retried
+// immediately, unless that was their last attempt and their failure callback
+// is queued instead; callback jobs go back to pending, or to failed once they
+// have used up their callback attempts.
+func (s *sqlStore) ReapExpiredLeases(maxEncodingFailures, maxCallbackFailures int, now time.Time) (int64, error) {
+	var reaped int64
+	err := s.inTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(s.rebind(`SELECT id, status, worker_id FROM jobs WHERE status IN (?, ?) AND lease_expires_at < ?`+s.dialect.lockClause("jobs")),
+			int(JobStatusEncodingRunning), int(JobStatusCallbackInProgress), sqlTime(now))
+		if err != nil {
+			return err
+		}
+		var expired []JobEvent
+		for rows.Next() {
+			var event JobEvent
+			var status int
+			var workerID sql.NullString
+			if err := rows.Scan(&event.JobID, &status, &workerID); err != nil {
+				rows.Close()
+				return err
+			}
+			event.Status = JobStatus(status)
+			event.WorkerID = workerID.String
+			expired = append(expired, event)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		encodeAssignments, encodeArgs := failedEncodeAssignments(maxEncodingFailures)
+		for _, event := range expired {
+			var status int
+			if event.Status == JobStatusEncodingRunning {
+				event.Type = JobEventEncodeLeaseExpired
+				args := append(append([]interface{}{}, encodeArgs...), sqlTime(now), event.JobID)
+				err = tx.QueryRow(s.rebind(`UPDATE jobs SET `+encodeAssignments+`, worker_id = NULL, lease_expires_at = NULL,
+						next_attempt_at = ?, updated_at = CURRENT_TIMESTAMP
+					WHERE id = ?
+					RETURNING status, failed_count`), args...).Scan(&status, &event.Attempt)
+			} else {
+				event.Type = JobEventCallbackLeaseExpired
+				err = tx.QueryRow(s.rebind(`UPDATE jobs
+					SET status = CASE WHEN callback_failures + 1 >= ? THEN CAST(? AS INTEGER) ELSE CAST(? AS INTEGER) END,
+					    callback_failures = callback_failures + 1, worker_id = NULL, lease_expires_at = NULL,
+					    updated_at = CURRENT_TIMESTAMP
+					WHERE id = ?
+					RETURNING status, callback_failures`),
+					maxCallbackFailures, int(JobStatusCallbackFailed), int(JobStatusCallbackPending), event.JobID).Scan(&status, &event.Attempt)
+			}
+			if err != nil {
+				return err
+			}
+			event.Status = JobStatus(status)
+			event.Error = "worker stopped renewing its lease"
+			if err := s.insertJobEvent(tx, event); err != nil {
+				return err
+			}
+			reaped++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return reaped, nil
+}
+
+// StartLeaseReaper periodically requeues jobs whose workers stopped sending
+// heartbeats, such as after a crash or a hung ffmpeg. The first pass runs
+// immediately so jobs orphaned by a restart are recovered at startup.
+func StartLeaseReaper(ctx *AppContext) {
+	go func() {
+		for {
+			reaped, err := ctx.Store.ReapExpiredLeases(ctx.Config.MaxEncodingFailures, ctx.Config.MaxCallbackFailures, time.Now())
+			if err != nil {
+				slog.Error("Lease reaper failed to reap expired leases", "error", err)
+			} else if reaped > 0 {
+				slog.Warn("Lease reaper requeued jobs with expired leases", "jobs", reaped)
+				ctx.Notifier.Notify()
+			}
+			time.Sleep(ctx.Config.LeaseDuration / 2)
+		}
+	}()
+}
+
+// StartHeartbeat renews the job's lease until stop is called. The returned
+// context is cancelled if the lease is lost, so that in-flight work for a job
+// that now belongs to someone else is abandoned. Its cause is ErrJobCancelled
+// if the lease was lost because the job was cancelled.
+func StartHeartbeat(ctx *AppContext, job *Job, logger *slog.Logger) (leaseCtx context.Context, stop func()) {
+	leaseCtx, cancel := context.WithCancelCause(context.Background())
+	running := ctx.Running.add(job.ID, cancel)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(ctx.Config.LeaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := ctx.Store.RenewLease(job.ID, job.WorkerID, time.Now().Add(ctx.Config.LeaseDuration))
+				if errors.Is(err, ErrLeaseLost) {
+					if jobCancelled(ctx, job.ID) {
+						cancel(ErrJobCancelled)
+						return
+					}
+					logger.Warn("Lost lease on job, abandoning it")
+					cancel(ErrLeaseLost)
+					return
+				}
+				if err != nil {
+					// Keep going; the lease only lapses if renewals fail for a whole lease duration
+					logger.Error("Failed to renew lease", "error", err)
+				}
+			}
+		}
+	}()
+	return leaseCtx, func() {
+		close(done)
+		ctx.Running.remove(job.ID, running)
+		cancel(nil)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReapExpiredLeasesRequeuesAbandonedJobs(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	jobs := submitTestJobs(t, ctx, "acme", 2)
+
+	opts := testDequeueOptions(ctx)
+	job, err := ctx.Store.DequeueJob(opts, time.Now())
+	if err != nil || job == nil {
+		t.Fatalf("DequeueJob returned %v, %v", job, err)
+	}
+	if job.WorkerID != opts.WorkerID || job.LeaseExpiresAt == "" {
+		t.Fatalf("Expected job leased to %s, got %+v", opts.WorkerID, job)
+	}
+
+	// Nothing is reaped while the lease is live, and the owner can renew it
+	if reaped, err := ctx.Store.ReapExpiredLeases(3, 3, time.Now()); err != nil || reaped != 0 {
+		t.Fatalf("Expected no reaped jobs, got %d, %v", reaped, err)
+	}
+	if err := ctx.Store.RenewLease(job.ID, opts.WorkerID, time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("RenewLease failed: %v", err)
+	}
+
+	// Once the lease expires the job is requeued with the attempt counted
+	if reaped, err := ctx.Store.ReapExpiredLeases(3, 3, time.Now().Add(2*time.Minute)); err != nil || reaped != 1 {
+		t.Fatalf("Expected 1 reaped job, got %d, %v", reaped, err)
+	}
+	reaped, err := ctx.Store.GetJob(job.ID)
+	if err != nil || reaped.Status != JobStatusEncodingFailed || reaped.FailedCount != 1 || reaped.WorkerID != "" {
+		t.Fatalf("Expected reaped job to be failed and unleased, got %+v, %v", reaped, err)
+	}
+
+	// The original worker is fenced off from the job
+	if err := ctx.Store.MarkJobEncoded(job.ID, opts.WorkerID, 10, Attempt{}); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Expected ErrLeaseLost from stale worker, got %v", err)
+	}
+	if err := ctx.Store.RenewLease(job.ID, opts.WorkerID, time.Now().Add(time.Minute)); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Expected ErrLeaseLost renewing reaped job, got %v", err)
+	}
+
+	// Abandoned callbacks go back to pending
+	if ok, err := ctx.Store.TransitionJob(jobs[1].ID, JobStatusCallbackPending); err != nil || !ok {
+		t.Fatalf("TransitionJob failed: %v", err)
+	}
+	callback, err := ctx.Store.DequeueCallbackJob("callback-worker", 3, time.Now().Add(time.Minute))
+	if err != nil || callback == nil || callback.ID != jobs[1].ID {
+		t.Fatalf("DequeueCallbackJob returned %v, %v", callback, err)
+	}
+	if _, err := ctx.Store.ReapExpiredLeases(3, 3, time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatalf("ReapExpiredLeases failed: %v", err)
+	}
+	callback, _ = ctx.Store.GetJob(jobs[1].ID)
+	if callback.Status != JobStatusCallbackPending || callback.CallbackFailures != 1 {
+		t.Errorf("Expected reaped callback to be pending with 1 failure, got %+v", callback)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// NewLogger creates the service's logger. format is "json" (the default) or
+// "text", and level one of debug, info (the default), warn or error.
+func NewLogger(w io.Writer, level, format string) *slog.Logger {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		lvl = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	if strings.EqualFold(format, "text") {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// ConfigureLogging installs the logger configured by LOG_LEVEL and LOG_FORMAT
+// as the default, which also routes the standard log package through it
+func ConfigureLogging() {
+	slog.SetDefault(NewLogger(os.Stderr, os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT")))
+}
+
+// JobLogger returns a logger whose lines carry the job and the attempt being
+// made at it
+func JobLogger(job *Job, attempt int) *slog.Logger {
+	return slog.With(
+		"job_id", job.ID,
+		"video_id", job.VideoID,
+		"tenant_id", job.TenantID,
+		"worker_id", job.WorkerID,
+		"attempt", attempt,
+	)
+}
+
+// fatal logs an error and exits, for failures the service cannot start with
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
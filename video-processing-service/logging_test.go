@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFFmpegOutputIsLoggedLineByLineWithJobContext(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, "debug", "json").With("job_id", "job-1", "attempt", 2)
+
+	stderr := "Input #0, mov,mp4\nframe=  10 speed=1.5x\rframe=  20 speed=2x\r[h264] error while decoding\n"
+	tail := logFFmpegOutput(logger, strings.NewReader(stderr), func() {})
+
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Expected JSON log lines, got %q", line)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Expected one entry per ffmpeg line, got %d: %s", len(entries), buf.String())
+	}
+	if entries[1]["level"] != "DEBUG" || entries[3]["line"] != "[h264] error while decoding" || entries[3]["job_id"] != "job-1" {
+		t.Errorf("Unexpected log entries %v", entries)
+	}
+	if got := stderrTail(tail); !strings.HasSuffix(got, "frame=  20 speed=2x\n[h264] error while decoding") {
+		t.Errorf("Unexpected stderr tail %q", got)
+	}
+
+	// Lines below the configured level are dropped
+	buf.Reset()
+	NewLogger(&buf, "warn", "json").Info("ignored")
+	if buf.Len() != 0 {
+		t.Errorf("Expected info to be filtered at warn level, got %s", buf.String())
+	}
+}
@@ -1,20 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 type Profile struct {
-	Resolution string `json:"resolution"`
-	Crf        int    `json:"crf"`
+	Resolution string        `json:"resolution"`
+	Crf        int           `json:"crf"`
+	Audio      *AudioProfile `json:"audio,omitempty"`
+	// AudioOnly renditions drop the video, for HLS audio groups. They have
+	// no resolution or CRF.
+	AudioOnly bool `json:"audioOnly,omitempty"`
 }
 
 type Input struct {
@@ -28,11 +42,14 @@ type Output struct {
 }
 
 type RequestPayload struct {
-	VideoId     string    `json:"videoId"`
-	Input       Input     `json:"input"`
-	Output      Output    `json:"output"`
-	Profiles    []Profile `json:"profiles"`
-	CallbackURL string    `json:"callbackUrl"`
+	VideoId        string    `json:"videoId"`
+	Input          Input     `json:"input"`
+	Output         Output    `json:"output"`
+	Profiles       []Profile `json:"profiles"`
+	CallbackURL    string    `json:"callbackUrl"`
+	IdempotencyKey string    `json:"idempotencyKey,omitempty"`
+	Priority       *int      `json:"priority,omitempty"`
+	Deadline       string    `json:"deadline,omitempty"`
 }
 
 type OutputResult struct {
@@ -42,216 +59,519 @@ type OutputResult struct {
 	Error      string `json:"error,omitempty"`
 }
 
+type JobResult struct {
+	JobID      string `json:"jobId"`
+	Resolution int    `json:"resolution"`
+	Status     string `json:"status"`
+}
+
 type ResponsePayload struct {
 	Status  string         `json:"status"`
 	Outputs []OutputResult `json:"outputs"`
+	Jobs    []JobResult    `json:"jobs,omitempty"`
 }
 
 type AppContext struct {
-	Config   Config
-	DB       *sql.DB
-	S3Client *s3.Client
+	Config     Config
+	Store      Store
+	S3Client   *s3.Client
+	Notifier   *JobNotifier
+	InstanceID string
+	Mode       string
+	StartedAt  time.Time
+	Workers    *WorkerRegistry
+	Running    *RunningJobs
 }
 
 func ensureDirectoryExistence(dirPath string) {
 	if _, err := os.Stat(dirPath); os.IsNotExist(err) {
 		os.MkdirAll(dirPath, 0755)
-		log.Printf("Directory created at %s\n", dirPath)
+		slog.Info("Created directory", "path", dirPath)
 	}
 }
 
 func ProcessVideoHandler(ctx *AppContext) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var reqPayload RequestPayload
 		var respPayload ResponsePayload
-		respPayload.Status = "error"
-
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&reqPayload); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			respPayload.Status = "error"
-			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON: " + err.Error()})
+
+		r.Body = http.MaxBytesReader(w, r.Body, ctx.Config.MaxRequestBodyBytes)
+		reqPayload, err := DecodeRequestPayload(r.Body, ctx.Config.MaxRequestBodyBytes)
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			writeValidationError(w, validationErr)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, err.Error(), nil)
 			return
 		}
 
-		// Validate required fields
-		if reqPayload.Input.Bucket == "" || reqPayload.Input.Key == "" ||
-			reqPayload.Output.Bucket == "" || reqPayload.Output.BasePath == "" ||
-			len(reqPayload.Profiles) == 0 || reqPayload.CallbackURL == "" {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			respPayload.Status = "error"
-			json.NewEncoder(w).Encode(map[string]string{"error": "Missing required fields (including callbackUrl)"})
-			return
+		// The header takes precedence over a key supplied in the body
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			reqPayload.IdempotencyKey = key
 		}
 
-		// Validate callbackUrl format
-		parsedUrl, err := url.ParseRequestURI(reqPayload.CallbackURL)
-		if err != nil || parsedUrl.Scheme == "" || parsedUrl.Host == "" {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			respPayload.Status = "error"
-			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid callbackUrl format"})
+		// Check the buckets and callback host against the API key's scope
+		if err := ValidateRequestPayload(reqPayload); errors.As(err, &validationErr) {
+			writeValidationError(w, validationErr)
 			return
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, ErrCodeValidationFailed, err.Error(), nil)
+			return
+		}
+		if key := apiKeyFromContext(r.Context()); key != nil {
+			if fields := key.Authorize(reqPayload); len(fields) > 0 {
+				writeError(w, http.StatusForbidden, ErrCodeForbidden, "Request is outside the API key's scope", fields)
+				return
+			}
 		}
 
-		// Create the job(s) in SQLite, passing callback URL
-		if err := CreateJobsInDB(ctx.DB, &reqPayload); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			respPayload.Status = "error"
-			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create job: " + err.Error()})
+		// The payload is validated, so create the job(s) straight away
+		jobs, replayed, err := SubmitValidatedJobs(r.Context(), ctx, tenantFromContext(r.Context()), reqPayload)
+		if err != nil {
+			if errors.As(err, &validationErr) {
+				writeValidationError(w, validationErr)
+				return
+			}
+			if errors.Is(err, ErrIdempotencyKeyReused) {
+				writeError(w, http.StatusConflict, ErrCodeIdempotencyConflict, err.Error(), nil)
+				return
+			}
+			var quotaErr *QuotaError
+			if errors.As(err, &quotaErr) {
+				writeError(w, http.StatusTooManyRequests, ErrCodeQuotaExceeded, quotaErr.Message, nil)
+				return
+			}
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to create job: "+err.Error(), nil)
 			return
 		}
 
-		// Return success indicating job accepted (no jobId)
+		// Return success indicating job accepted, with the job IDs so that
+		// retries can be matched to the original submission
 		respPayload.Status = "accepted"
+		for _, job := range jobs {
+			respPayload.Jobs = append(respPayload.Jobs, JobResult{
+				JobID:      job.ID,
+				Resolution: job.Resolution,
+				Status:     job.Status.String(),
+			})
+		}
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(respPayload)
 	}
 }
 
+type JobResponse struct {
+	JobID            string        `json:"jobId"`
+	VideoID          string        `json:"videoId"`
+	TenantID         string        `json:"tenantId"`
+	Resolution       int           `json:"resolution"`
+	Crf              int           `json:"crf"`
+	Audio            *AudioProfile `json:"audio,omitempty"`
+	AudioOnly        bool          `json:"audioOnly,omitempty"`
+	Status           string        `json:"status"`
+	Priority         int           `json:"priority"`
+	Deadline         string        `json:"deadline,omitempty"`
+	FailedCount      int           `json:"failedCount"`
+	CallbackFailures int           `json:"callbackFailures"`
+	Outcome          string        `json:"outcome,omitempty"`
+	CreatedAt        string        `json:"createdAt"`
+	UpdatedAt        string        `json:"updatedAt"`
+}
+
+// NewJobResponse converts a job to its API representation
+func NewJobResponse(job *Job) JobResponse {
+	return JobResponse{
+		JobID:            job.ID,
+		VideoID:          job.VideoID,
+		TenantID:         job.TenantID,
+		Resolution:       job.Resolution,
+		Crf:              job.Crf,
+		Audio:            job.Audio,
+		AudioOnly:        job.AudioOnly,
+		Status:           job.Status.String(),
+		Priority:         job.Priority,
+		Deadline:         job.Deadline,
+		FailedCount:      job.FailedCount,
+		CallbackFailures: job.CallbackFailures,
+		Outcome:          job.Outcome,
+		CreatedAt:        job.CreatedAt,
+		UpdatedAt:        job.UpdatedAt,
+	}
+}
+
+// GetJobHandler returns a single job owned by the caller's tenant
+func GetJobHandler(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, err := ctx.Store.GetJob(r.PathValue("id"))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to fetch job: "+err.Error(), nil)
+			return
+		}
+		// Jobs of other tenants are reported as missing rather than forbidden
+		// so that job IDs cannot be probed across tenants
+		if err != nil || job.TenantID != tenantFromContext(r.Context()) {
+			writeError(w, http.StatusNotFound, ErrCodeNotFound, "Job not found", nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(NewJobResponse(job))
+	}
+}
+
 func StartWorkerPool(ctx *AppContext) {
+	ensureDirectoryExistence(ctx.Config.LocalRawVideoPath)
+	ensureDirectoryExistence(ctx.Config.LocalProcessedVideoPath)
+
+	opts := DequeueOptions{
+		TenantDefaults: ctx.Config.TenantDefaults,
+		AgingInterval:  ctx.Config.PriorityAgingInterval,
+		MaxFailures:    ctx.Config.MaxEncodingFailures,
+		LeaseDuration:  ctx.Config.LeaseDuration,
+	}
 	for i := 0; i < ctx.Config.EncoderWorkerCount; i++ {
-		go func(workerID int) {
-			log.Printf("Worker %d started", workerID)
+		go func(workerID string) {
+			slog.Info("Encode worker started", "worker_id", workerID)
+			workers.WithLabelValues(encodePool).Inc()
+			ctx.Workers.Register(workerID, encodePool)
+			opts := opts
+			opts.WorkerID = workerID
 			for {
-				jobs, err := GetPendingOrFailedJobs(ctx.DB)
+				// Subscribe before dequeuing so a job inserted in between still wakes us
+				wake := ctx.Notifier.Wait()
+				job, err := ctx.Store.DequeueJob(opts, time.Now())
 				if err != nil {
-					log.Printf("Worker %d: error fetching jobs: %v", workerID, err)
-					continue
+					slog.Error("Failed to dequeue job", "worker_id", workerID, "error", err)
 				}
-				claimed := false
-				for _, job := range jobs {
-					ok, err := ClaimJob(ctx.DB, job.ID)
-					if err != nil {
-						log.Printf("Worker %d: error claiming job %s: %v", workerID, job.ID, err)
-						continue
+				if job == nil {
+					// No jobs claimed, wait for new work or the next poll
+					select {
+					case <-wake:
+					case <-time.After(workerPollInterval):
 					}
-					if ok {
-						log.Printf("Worker %d: claimed job %s", workerID, job.ID)
-						ProcessVideoJob(ctx, &job)
-						claimed = true
-						break // Only process one job per loop per worker
-					}
-				}
-				if !claimed {
-					// No jobs claimed, sleep before next poll
-					time.Sleep(2 * time.Second)
+					continue
 				}
+				JobLogger(job, job.FailedCount+1).Info("Claimed job")
+				observeClaim(job, time.Now())
+				traceQueueWait(job, time.Now())
+				busyWorkers.WithLabelValues(encodePool).Inc()
+				ctx.Workers.Busy(workerID, encodePool, job, job.FailedCount+1)
+				ProcessVideoJob(ctx, job)
+				ctx.Workers.Idle(workerID, encodePool)
+				busyWorkers.WithLabelValues(encodePool).Dec()
 			}
-		}(i + 1)
+		}(fmt.Sprintf("%s/encode-%d", ctx.InstanceID, i+1))
 	}
 }
 
 // StartCallbackWorkerPool starts workers for callback jobs
 func StartCallbackWorkerPool(ctx *AppContext) {
 	for i := 0; i < 1; i++ { // one callback worker should be more than enough, add more if needed
-		go func(workerID int) {
-			log.Printf("Callback Worker %d started", workerID)
+		go func(workerID string) {
+			slog.Info("Callback worker started", "worker_id", workerID)
+			workers.WithLabelValues(callbackPool).Inc()
+			ctx.Workers.Register(workerID, callbackPool)
 			for {
-				jobs, err := GetCallbackPendingJobs(ctx.DB)
+				// Callbacks are bounded by the HTTP timeout, so a lease of twice
+				// that needs no heartbeat
+				leaseExpiresAt := time.Now().Add(2 * ctx.Config.CallbackTimeout)
+				job, err := ctx.Store.DequeueCallbackJob(workerID, ctx.Config.MaxCallbackFailures, leaseExpiresAt)
 				if err != nil {
-					log.Printf("Callback Worker %d: error fetching jobs: %v", workerID, err)
-					continue
-				}
-				claimed := false
-				for _, job := range jobs {
-					if job.CallbackFailures >= ctx.Config.MaxCallbackFailures {
-						UpdateJobStatus(ctx.DB, job.ID, JobStatusCallbackFailed)
-						continue
-					}
-					ok, err := ClaimCallbackJob(ctx.DB, job.ID)
-					if err != nil {
-						log.Printf("Callback Worker %d: error claiming job %s: %v", workerID, job.ID, err)
-						continue
-					}
-					if ok {
-						log.Printf("Callback Worker %d: claimed callback job %s", workerID, job.ID)
-						ProcessCallbackJob(ctx, &job)
-						claimed = true
-						break // Only process one job per loop per worker
-					}
+					slog.Error("Failed to dequeue callback", "worker_id", workerID, "error", err)
 				}
-				if !claimed {
+				if job == nil {
 					// No jobs claimed, sleep before next poll
-					time.Sleep(2 * time.Second)
+					time.Sleep(workerPollInterval)
+					continue
 				}
+				busyWorkers.WithLabelValues(callbackPool).Inc()
+				ctx.Workers.Busy(workerID, callbackPool, job, job.CallbackFailures+1)
+				ProcessCallbackJob(ctx, job)
+				ctx.Workers.Idle(workerID, callbackPool)
+				busyWorkers.WithLabelValues(callbackPool).Dec()
 			}
-		}(i + 1)
+		}(fmt.Sprintf("%s/callback-%d", ctx.InstanceID, i+1))
 	}
 }
 
-// ClaimCallbackJob atomically claims a callback job
-func ClaimCallbackJob(db *sql.DB, jobID string) (bool, error) {
-	res, err := db.Exec(`UPDATE jobs SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = ?`, int(JobStatusCallbackInProgress), jobID, int(JobStatusCallbackPending))
-	if err != nil {
-		return false, err
+// CallbackPayload is posted to a job's callback URL once encoding has
+// finished or the job was cancelled. Failed jobs include their encoding
+// attempts, so the caller can tell why the job failed without access to the
+// service's logs.
+type CallbackPayload struct {
+	JobID          string             `json:"jobId"`
+	VideoID        string             `json:"videoId"`
+	Resolution     int                `json:"resolution"`
+	Status         string             `json:"status"`
+	Output         *Input             `json:"output,omitempty"`
+	EncodedSeconds float64            `json:"encodedSeconds,omitempty"`
+	Error          string             `json:"error,omitempty"`
+	Attempts       []JobEventResponse `json:"attempts,omitempty"`
+}
+
+// CallbackSignatureHeader carries the signature of a callback, made with
+// the configured signing secret so that receivers can tell it came from us
+const CallbackSignatureHeader = "X-Callback-Signature"
+
+// SignCallback returns the signature of a callback body sent at the given
+// time: "t=<unix time>,v1=<hex HMAC-SHA256 of the time, a dot and the body>".
+// Signing the time lets receivers reject replayed callbacks.
+func SignCallback(secret string, at time.Time, body []byte) string {
+	t := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewCallbackPayload builds the callback of a job from the job and its history
+func NewCallbackPayload(job *Job, events []JobEvent) CallbackPayload {
+	payload := CallbackPayload{
+		JobID:      job.ID,
+		VideoID:    job.VideoID,
+		Resolution: job.Resolution,
+		Status:     JobOutcomeSucceeded,
 	}
-	affected, err := res.RowsAffected()
-	if err != nil {
-		return false, err
+	if job.Outcome == JobOutcomeCancelled {
+		payload.Status = JobOutcomeCancelled
+		return payload
+	}
+	// Jobs queued for a callback before outcomes were recorded had all succeeded
+	if job.Outcome != JobOutcomeFailed {
+		payload.Output = &Input{Bucket: job.OutputBucket, Key: OutputKey(job)}
+		payload.EncodedSeconds = job.EncodedSeconds
+		return payload
+	}
+
+	payload.Status = JobOutcomeFailed
+	var attempts []JobEvent
+	for _, event := range events {
+		if event.Type == JobEventEncodeFailed || event.Type == JobEventEncodeLeaseExpired {
+			attempts = append(attempts, event)
+			payload.Error = event.Error
+		}
 	}
-	return affected > 0, nil
+	payload.Attempts = NewJobEventResponses(attempts)
+	return payload
 }
 
 // ProcessCallbackJob attempts the callback and updates job state
 func ProcessCallbackJob(ctx *AppContext, job *Job) {
-	// Example: POST to callback URL (add real payload as needed)
-	resp, err := http.Post(job.CallbackURL, "application/json", nil)
-	if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		UpdateJobStatus(ctx.DB, job.ID, JobStatusCallbackSuccess)
-		return
-	}
-	IncrementCallbackFailures(ctx.DB, job.ID)
-	if job.CallbackFailures+1 >= ctx.Config.MaxCallbackFailures {
-		UpdateJobStatus(ctx.DB, job.ID, JobStatusCallbackFailed)
+	logger := JobLogger(job, job.CallbackFailures+1)
+	logger.Info("Claimed callback", "callback_url", job.CallbackURL)
+	spanCtx, span := startJobSpan(job, "deliver callback", job.CallbackFailures+1)
+	defer span.End()
+	startedAt := time.Now()
+	err := sendCallback(spanCtx, ctx, job)
+	attempt := Attempt{Duration: time.Since(startedAt)}
+	observeCallback(attempt.Duration, err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		logger.Warn("Callback failed", "error", err, "duration", attempt.Duration)
+		attempt.Error = err.Error()
 	} else {
-		UpdateJobStatus(ctx.DB, job.ID, JobStatusCallbackPending)
+		logger.Info("Callback delivered", "duration", attempt.Duration)
 	}
+	logLeaseError(logger, ctx.Store.CompleteCallback(job.ID, job.WorkerID, attempt, ctx.Config.MaxCallbackFailures))
 }
 
-func StartServer(ctx *AppContext) {
-	ensureDirectoryExistence(ctx.Config.LocalRawVideoPath)
-	ensureDirectoryExistence(ctx.Config.LocalProcessedVideoPath)
+// sendCallback posts the job's callback payload, treating any response
+// other than 2xx as a failure. The request carries the trace context of
+// spanCtx in a traceparent header.
+func sendCallback(spanCtx context.Context, ctx *AppContext, job *Job) error {
+	events, err := ctx.Store.ListJobEvents(job.ID)
+	if err != nil {
+		return fmt.Errorf("failed to fetch job events: %w", err)
+	}
+	body, err := json.Marshal(NewCallbackPayload(job, events))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(spanCtx, http.MethodPost, job.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ctx.Config.CallbackSigningSecret != "" {
+		req.Header.Set(CallbackSignatureHeader, SignCallback(ctx.Config.CallbackSigningSecret, time.Now(), body))
+	}
+	otel.GetTextMapPropagator().Inject(spanCtx, propagation.HeaderCarrier(req.Header))
+	client := &http.Client{Timeout: ctx.Config.CallbackTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
 
-	http.HandleFunc("/process-video", ProcessVideoHandler(ctx))
+func StartServer(ctx *AppContext) {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3000"
 	}
-	log.Printf("Server running at http://localhost:%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	slog.Info("Server running", "url", "http://localhost:"+port)
+	fatal("Server stopped", "error", http.ListenAndServe(":"+port, NewRouter(ctx)))
+}
+
+// Route is an HTTP endpoint of the service. Auth, if set, guards it.
+type Route struct {
+	Pattern string
+	Auth    func(ctx *AppContext, next http.Handler) http.Handler
+	Handler http.Handler
+}
+
+// Routes lists every HTTP endpoint of the service, each of which is
+// described in the OpenAPI document
+func Routes(ctx *AppContext) []Route {
+	return []Route{
+		{"GET /metrics", nil, MetricsHandler(ctx)},
+		{"GET /healthz", nil, HealthzHandler()},
+		{"GET /readyz", nil, ReadyzHandler(ctx)},
+		{"GET /openapi.json", nil, OpenAPIHandler()},
+		{"GET /debug/status", RequireAdmin, DebugStatusHandler(ctx)},
+		{"/process-video", RequireAPIKey, ProcessVideoHandler(ctx)},
+		{"GET /jobs", RequireAPIKey, ListJobsHandler(ctx, false)},
+		{"GET /jobs/{id}", RequireAPIKey, GetJobHandler(ctx)},
+		{"GET /jobs/{id}/events", RequireAPIKey, GetJobEventsHandler(ctx)},
+		{"DELETE /jobs/{id}", RequireAPIKey, CancelJobHandler(ctx)},
+		{"DELETE /videos/{videoId}/jobs", RequireAPIKey, CancelVideoJobsHandler(ctx)},
+
+		{"POST /admin/api-keys", RequireAdmin, CreateAPIKeyHandler(ctx)},
+		{"GET /admin/api-keys", RequireAdmin, ListAPIKeysHandler(ctx)},
+		{"DELETE /admin/api-keys/{id}", RequireAdmin, RevokeAPIKeyHandler(ctx)},
+		{"GET /admin/tenants", RequireAdmin, ListTenantsHandler(ctx)},
+		{"PUT /admin/tenants/{id}", RequireAdmin, PutTenantHandler(ctx)},
+		{"GET /admin/jobs", RequireAdmin, ListJobsHandler(ctx, true)},
+		{"POST /admin/jobs/{id}/{operation}", RequireAdmin, JobOperationHandler(ctx)},
+		{"POST /admin/jobs/bulk", RequireAdmin, BulkJobOperationHandler(ctx)},
+	}
+}
+
+// NewRouter registers every HTTP endpoint of the service. Requests are
+// authenticated first and then validated against the OpenAPI document.
+func NewRouter(ctx *AppContext) http.Handler {
+	mux := http.NewServeMux()
+	for _, route := range Routes(ctx) {
+		handler := ValidateAgainstSpec(ctx, openAPISpec, route.Pattern, route.Handler)
+		if route.Auth != nil {
+			handler = route.Auth(ctx, handler)
+		}
+		mux.Handle(route.Pattern, handler)
+	}
+	return TraceRequests(mux)
+}
+
+// Run modes select which parts of the service a process runs. Splitting
+// them lets the API and the encoders scale independently on separate hosts
+// sharing a PostgreSQL store; with no mode everything runs in one process.
+const (
+	RunModeAll            = "all"
+	RunModeServe          = "serve"
+	RunModeEncodeWorker   = "encode-worker"
+	RunModeCallbackWorker = "callback-worker"
+)
+
+// parseRunMode returns the run mode named by the command line arguments
+func parseRunMode(args []string) (string, error) {
+	if len(args) == 0 {
+		return RunModeAll, nil
+	}
+	switch args[0] {
+	case RunModeAll, RunModeServe, RunModeEncodeWorker, RunModeCallbackWorker:
+		return args[0], nil
+	}
+	return "", fmt.Errorf("unknown command %q, expected one of:\n  %s", args[0], commandUsage())
 }
 
 func main() {
+	ConfigureLogging()
+	if len(os.Args) > 1 {
+		if command, ok := Commands[os.Args[1]]; ok {
+			if err := command.Run(os.Args[2:], os.Stdout); err != nil {
+				fatal("Command failed", "command", os.Args[1], "error", err)
+			}
+			return
+		}
+	}
+
+	mode, err := parseRunMode(os.Args[1:])
+	if err != nil {
+		fatal("Invalid command line", "error", err)
+	}
 	cfg := LoadConfig()
 
-	// Start the database
-	db := InitDB(cfg.DBFilePath)
-	defer db.Close()
+	shutdownTracing, err := ConfigureTracing(context.Background(), cfg.TracesExporter)
+	if err != nil {
+		fatal("Failed to configure tracing", "error", err)
+	}
+	defer shutdownTracing(context.Background())
 
-	// Reset jobs stuck in 'in_progress' state
-	err := ResetInProgressJobs(db)
+	// Open the job store, refusing to start against a schema from a newer
+	// version of the service
+	store, err := OpenStore(cfg, true)
 	if err != nil {
-		log.Fatalf("Failed to reset in-progress jobs: %v", err)
+		fatal("Failed to open job store", "error", err)
 	}
+	defer store.Close()
 
 	// Initialize S3 client
 	s3Client, err := NewS3Client(cfg.S3)
 	if err != nil {
-		log.Fatalf("Failed to initialize S3 client: %v", err)
+		fatal("Failed to initialize S3 client", "error", err)
 	}
 
 	// Create app context
 	ctx := &AppContext{
-		Config:   cfg,
-		DB:       db,
-		S3Client: s3Client,
+		Config:     cfg,
+		Store:      store,
+		S3Client:   s3Client,
+		Notifier:   NewJobNotifier(),
+		InstanceID: NewInstanceID(),
+		Mode:       mode,
+		StartedAt:  time.Now(),
+		Workers:    NewWorkerRegistry(),
+		Running:    NewRunningJobs(),
+	}
+	slog.Info("Starting", "instance_id", ctx.InstanceID, "mode", mode)
+
+	// Requeue jobs whose workers died, including any left running by a
+	// previous run of this process. Every process reaps, so recovery does
+	// not depend on any one of them staying up.
+	StartLeaseReaper(ctx)
+	StartMetricsServer(ctx)
+
+	// Workers in other processes are not woken by the notifier and find new
+	// jobs by polling instead
+	if mode == RunModeAll || mode == RunModeEncodeWorker {
+		StartWorkerPool(ctx)
+	}
+	if mode == RunModeAll || mode == RunModeCallbackWorker {
+		StartCallbackWorkerPool(ctx)
 	}
-	StartWorkerPool(ctx)
-	StartCallbackWorkerPool(ctx)
+	if mode != RunModeAll && mode != RunModeServe {
+		select {}
+	}
+
+	// Only the API process looks after the store, so that workers do not back
+	// up a SQLite file or purge expired jobs several times over
+	StartSQLiteMaintenance(ctx)
+	StartJanitor(ctx)
+
+	// Start any configured job intakes besides the HTTP API
+	for _, intake := range ConfiguredIntakes(cfg) {
+		if err := intake.Start(ctx); err != nil {
+			fatal("Failed to start job intake", "error", err)
+		}
+		defer intake.Close()
+	}
+
 	StartServer(ctx)
 }
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func postProcessVideo(t *testing.T, handler http.Handler, body interface{}, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("failed to marshal body: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/process-video", bytes.NewReader(data))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestProcessVideoHandlerIdempotencyKey(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	handler := ProcessVideoHandler(ctx)
+
+	payload := RequestPayload{
+		VideoId:     "vid123",
+		Input:       Input{Bucket: "input-bucket", Key: "input.mp4"},
+		Output:      Output{Bucket: "output-bucket", BasePath: "outputs/"},
+		Profiles:    []Profile{{Resolution: "720", Crf: 23}, {Resolution: "1080", Crf: 20}},
+		CallbackURL: "http://callback.example.com/done",
+	}
+	headers := map[string]string{"Idempotency-Key": "upload-42"}
+
+	first := postProcessVideo(t, handler, payload, headers)
+	if first.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", first.Code, first.Body.String())
+	}
+	var firstResp ResponsePayload
+	json.NewDecoder(first.Body).Decode(&firstResp)
+	if len(firstResp.Jobs) != 2 {
+		t.Fatalf("Expected 2 jobs in response, got %d", len(firstResp.Jobs))
+	}
+
+	retry := postProcessVideo(t, handler, payload, headers)
+	if retry.Code != http.StatusOK {
+		t.Fatalf("Expected 200 on retry, got %d: %s", retry.Code, retry.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected retry to be marked as replayed")
+	}
+	var retryResp ResponsePayload
+	json.NewDecoder(retry.Body).Decode(&retryResp)
+	ids := map[string]bool{}
+	for _, job := range firstResp.Jobs {
+		ids[job.JobID] = true
+	}
+	for _, job := range retryResp.Jobs {
+		if !ids[job.JobID] {
+			t.Errorf("Retry returned unknown job ID %s", job.JobID)
+		}
+	}
+
+	jobs, err := ctx.Store.ListJobs(JobFilter{Statuses: []JobStatus{JobStatusEncodingPending}})
+	if err != nil {
+		t.Fatalf("ListJobs failed: %v", err)
+	}
+	if len(jobs) != 2 {
+		t.Errorf("Expected 2 jobs after retry, got %d", len(jobs))
+	}
+
+	// Profiles in another order ask for the same outputs
+	reordered := payload
+	reordered.Profiles = []Profile{payload.Profiles[1], payload.Profiles[0]}
+	if rec := postProcessVideo(t, handler, reordered, headers); rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected reordered profiles to replay, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for name, change := range map[string]func(p *RequestPayload){
+		"video":    func(p *RequestPayload) { p.VideoId = "other-video" },
+		"bucket":   func(p *RequestPayload) { p.Output.Bucket = "other-bucket" },
+		"basePath": func(p *RequestPayload) { p.Output.BasePath = "elsewhere/" },
+		"callback": func(p *RequestPayload) { p.CallbackURL = "http://callback.example.com/other" },
+		"profiles": func(p *RequestPayload) {
+			p.Profiles = []Profile{{Resolution: "720", Crf: 23}, {Resolution: "480", Crf: 23}}
+		},
+	} {
+		reused := payload
+		change(&reused)
+		if conflict := postProcessVideo(t, handler, reused, headers); conflict.Code != http.StatusConflict {
+			t.Errorf("Expected 409 for key reused with another %s, got %d", name, conflict.Code)
+		}
+	}
+}
+
+func TestProcessVideoHandlerValidationErrors(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Config.MaxRequestBodyBytes = 512
+	handler := ProcessVideoHandler(ctx)
+
+	rec := postProcessVideo(t, handler, RequestPayload{
+		Input:       Input{Bucket: "Bad_Bucket", Key: "/abs.mp4"},
+		Output:      Output{Bucket: "output-bucket", BasePath: "outputs/../escape"},
+		Profiles:    []Profile{{Resolution: "720", Crf: 23}, {Resolution: "720", Crf: 60}, {Resolution: "abc"}},
+		CallbackURL: "ftp://callback.example.com",
+	}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", rec.Code)
+	}
+	var errResp ErrorResponse
+	json.NewDecoder(rec.Body).Decode(&errResp)
+	if errResp.Code != ErrCodeValidationFailed {
+		t.Errorf("Expected code %s, got %s", ErrCodeValidationFailed, errResp.Code)
+	}
+	got := map[string]string{}
+	for _, f := range errResp.Fields {
+		got[f.Field] = f.Code
+	}
+	want := map[string]string{
+		"input.bucket":           FieldCodeInvalidBucket,
+		"input.key":              FieldCodeInvalidKey,
+		"output.basePath":        FieldCodeInvalidKey,
+		"callbackUrl":            FieldCodeInvalidFormat,
+		"profiles[1].resolution": FieldCodeDuplicate,
+		"profiles[1].crf":        FieldCodeOutOfRange,
+		"profiles[2].resolution": FieldCodeInvalidFormat,
+	}
+	for field, code := range want {
+		if got[field] != code {
+			t.Errorf("Expected %s to fail with %s, got %q", field, code, got[field])
+		}
+	}
+
+	rec = postProcessVideo(t, handler, map[string]interface{}{"videoId": "vid", "unexpected": true}, nil)
+	json.NewDecoder(rec.Body).Decode(&errResp)
+	if rec.Code != http.StatusBadRequest || len(errResp.Fields) != 1 || errResp.Fields[0].Code != FieldCodeUnknown {
+		t.Errorf("Expected unknown field to be rejected, got %d %+v", rec.Code, errResp)
+	}
+
+	rec = postProcessVideo(t, handler, map[string]string{"videoId": string(bytes.Repeat([]byte("x"), 1024))}, nil)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for oversized body, got %d", rec.Code)
+	}
+}
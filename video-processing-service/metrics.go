@@ -0,0 +1,178 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics of this process. Queue depths are read from the store when
+// scraped, so any process reports them for the whole deployment.
+var (
+	claimLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "video_processing_claim_latency_seconds",
+		Help:    "Time from submission until a worker first claims a job.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 16),
+	})
+	encodeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "video_processing_encode_duration_seconds",
+		Help:    "Duration of ffmpeg encodes.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"resolution", "codec", "result"})
+	encodeSpeed = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "video_processing_ffmpeg_speed_ratio",
+		Help:    "Speed of successful ffmpeg encodes as a multiple of realtime.",
+		Buckets: []float64{0.25, 0.5, 0.75, 1, 1.5, 2, 3, 5, 10, 20},
+	}, []string{"resolution", "codec"})
+	s3TransferBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "video_processing_s3_transfer_bytes_total",
+		Help: "Bytes transferred to and from S3.",
+	}, []string{"direction"})
+	s3TransferDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "video_processing_s3_transfer_duration_seconds",
+		Help:    "Duration of S3 downloads and uploads.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 14),
+	}, []string{"direction", "result"})
+	callbacksTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "video_processing_callbacks_total",
+		Help: "Callback attempts by result.",
+	}, []string{"result"})
+	callbackDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "video_processing_callback_duration_seconds",
+		Help:    "Duration of callback attempts.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+	workers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "video_processing_workers",
+		Help: "Workers started in this process, by pool.",
+	}, []string{"pool"})
+	busyWorkers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "video_processing_busy_workers",
+		Help: "Workers currently processing a job, by pool. Divide by video_processing_workers for utilization.",
+	}, []string{"pool"})
+	jobsPurged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "video_processing_jobs_purged_total",
+		Help: "Jobs deleted after outliving their retention, by outcome.",
+	}, []string{"outcome"})
+	jobsArchived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "video_processing_jobs_archived_total",
+		Help: "Jobs archived to the archive bucket before being purged.",
+	})
+	sqliteVacuumDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "video_processing_sqlite_vacuum_duration_seconds",
+		Help:    "Duration of SQLite VACUUM runs.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"result"})
+)
+
+// Worker pools, as labelled in the worker metrics
+const (
+	encodePool   = "encode"
+	callbackPool = "callback"
+)
+
+// resultLabel is the result label of an operation that returned err
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// observeEncode records a finished ffmpeg run of a rendition, labelled by
+// its resolution or as audio. speed is zero if ffmpeg did not report it.
+func observeEncode(label string, codec string, duration time.Duration, speed float64, err error) {
+	encodeDuration.WithLabelValues(label, codec, resultLabel(err)).Observe(duration.Seconds())
+	if err == nil && speed > 0 {
+		encodeSpeed.WithLabelValues(label, codec).Observe(speed)
+	}
+}
+
+// observeS3Transfer records a download or upload of n bytes
+func observeS3Transfer(direction string, n int64, duration time.Duration, err error) {
+	s3TransferBytes.WithLabelValues(direction).Add(float64(n))
+	s3TransferDuration.WithLabelValues(direction, resultLabel(err)).Observe(duration.Seconds())
+}
+
+// observeCallback records a callback attempt
+func observeCallback(duration time.Duration, err error) {
+	callbacksTotal.WithLabelValues(resultLabel(err)).Inc()
+	callbackDuration.WithLabelValues(resultLabel(err)).Observe(duration.Seconds())
+}
+
+// observeClaim records how long a job waited for its first claim
+func observeClaim(job *Job, now time.Time) {
+	if job.FailedCount > 0 {
+		return
+	}
+	if created, err := time.Parse(time.RFC3339Nano, job.CreatedAt); err == nil {
+		claimLatency.Observe(now.Sub(created).Seconds())
+	}
+}
+
+// queueCollector reports the number of jobs in every status
+type queueCollector struct {
+	store JobStore
+	desc  *prometheus.Desc
+}
+
+func newQueueCollector(store JobStore) *queueCollector {
+	return &queueCollector{
+		store: store,
+		desc:  prometheus.NewDesc("video_processing_jobs", "Jobs in the store by status.", []string{"status"}, nil),
+	}
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := c.store.CountJobsByStatus(JobFilter{})
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	for status := JobStatusEncodingPending; status <= JobStatusCancelled; status++ {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(counts[status]), status.String())
+	}
+}
+
+// MetricsHandler serves the metrics of this process and the job queue in
+// the Prometheus text format
+func MetricsHandler(ctx *AppContext) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		newQueueCollector(ctx.Store),
+		claimLatency, encodeDuration, encodeSpeed,
+		s3TransferBytes, s3TransferDuration,
+		callbacksTotal, callbackDuration,
+		workers, busyWorkers,
+		jobsPurged, jobsArchived, sqliteVacuumDuration,
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// StartMetricsServer serves /metrics and the health endpoints on their own
+// address, for processes that do not run the API, such as workers. The
+// address is meant to be internal, so the status page needs no admin key.
+func StartMetricsServer(ctx *AppContext) {
+	if ctx.Config.MetricsAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", MetricsHandler(ctx))
+	mux.Handle("GET /healthz", HealthzHandler())
+	mux.Handle("GET /readyz", ReadyzHandler(ctx))
+	mux.Handle("GET /debug/status", DebugStatusHandler(ctx))
+	go func() {
+		slog.Info("Metrics server running", "url", "http://"+ctx.Config.MetricsAddr+"/metrics")
+		fatal("Metrics server stopped", "error", http.ListenAndServe(ctx.Config.MetricsAddr, mux))
+	}()
+}
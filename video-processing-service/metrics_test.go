@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsEndpointReportsQueueDepth(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	submitTestJobs(t, ctx, DefaultTenantID, 2)
+
+	rec := httptest.NewRecorder()
+	NewRouter(ctx).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`video_processing_jobs{status="encoding_pending"} 2`,
+		`video_processing_jobs{status="callback_success"} 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+}
+
+func TestFFmpegSpeedUsesLastProgressLine(t *testing.T) {
+	stderr := []byte("frame=  100 fps= 50 speed=1.25x\rframe=  200 fps= 60 speed= 2.5x\nvideo:1024kB")
+	if speed := ffmpegSpeed(stderr); speed != 2.5 {
+		t.Errorf("Expected speed 2.5, got %v", speed)
+	}
+	if speed := ffmpegSpeed([]byte("no progress")); speed != 0 {
+		t.Errorf("Expected no speed, got %v", speed)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations live in migrations/<dialect>/NNNN_name.sql and are applied in
+// version order. Both dialects share version numbers, so a given version
+// means the same schema on either database.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is one versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// SchemaTooNewError is returned when the database has migrations this
+// binary does not know about, meaning a newer version of the service has
+// already upgraded it
+type SchemaTooNewError struct {
+	Current int
+	Latest  int
+}
+
+func (e *SchemaTooNewError) Error() string {
+	return fmt.Sprintf("database schema version %d is newer than the latest version %d known to this binary", e.Current, e.Latest)
+}
+
+// loadMigrations returns the embedded migrations of a dialect in version order
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".sql")
+		if !ok {
+			continue
+		}
+		number, label, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(number)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: file name must start with a version number", entry.Name())
+		}
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: label, SQL: string(body)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("%s migrations must be numbered 1, 2, 3, ... without gaps, found version %d at position %d", dialect, m.Version, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// InitDB created the schema of this migration directly before migrations
+// existed, and the builds leading up to it created some of its columns
+const legacyMigration = 2
+
+var (
+	addColumnPattern = regexp.MustCompile(`^ALTER TABLE (\w+) ADD COLUMN (\w+)`)
+	createPattern    = regexp.MustCompile(`^CREATE (TABLE|INDEX|UNIQUE INDEX) `)
+)
+
+// migrationStatements splits a migration into its statements, dropping
+// comments
+func migrationStatements(migration string) []string {
+	var lines []string
+	for _, line := range strings.Split(migration, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	var statements []string
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+// legacyColumns counts the columns added by the legacy migration that a
+// database created by InitDB already has, and those it lacks
+func (s *sqlStore) legacyColumns(db queryRower) (have, missing int, err error) {
+	migrations, err := loadMigrations(s.dialect.name)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, statement := range migrationStatements(migrations[legacyMigration-1].SQL) {
+		if m := addColumnPattern.FindStringSubmatch(statement); m != nil {
+			exists, err := s.columnExists(db, m[1], m[2])
+			if err != nil {
+				return 0, 0, err
+			}
+			if exists {
+				have++
+			} else {
+				missing++
+			}
+		}
+	}
+	return have, missing, nil
+}
+
+// SchemaVersion returns the version of the newest migration applied to the
+// database. Databases created by InitDB before migrations existed have a
+// jobs table but no schema_version table, and are reported as the legacy
+// migration if they have all of its columns and as version 1 otherwise.
+func (s *sqlStore) SchemaVersion() (int, error) {
+	versioned, err := s.tableExists("schema_version")
+	if err != nil {
+		return 0, err
+	}
+	if !versioned {
+		legacy, err := s.tableExists("jobs")
+		if err != nil || !legacy {
+			return 0, err
+		}
+		have, missing, err := s.legacyColumns(s.reader())
+		if err != nil || missing > 0 {
+			return 1, err
+		}
+		if have > 0 {
+			return legacyMigration, nil
+		}
+		return 1, nil
+	}
+	var version int
+	err = s.queryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&version)
+	return version, err
+}
+
+// PendingMigrations returns the migrations Migrate would apply, or a
+// SchemaTooNewError if the database is ahead of this binary
+func (s *sqlStore) PendingMigrations() ([]Migration, error) {
+	migrations, err := loadMigrations(s.dialect.name)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if current > len(migrations) {
+		return nil, &SchemaTooNewError{Current: current, Latest: len(migrations)}
+	}
+	return migrations[current:], nil
+}
+
+// Migrate applies every pending migration, each in its own transaction, and
+// returns the ones it applied
+func (s *sqlStore) Migrate() ([]Migration, error) {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	if err := s.initSchemaVersion(); err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, m := range pending {
+		ok, err := s.applyMigration(m)
+		if err != nil {
+			return applied, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		if ok {
+			applied = append(applied, m)
+		}
+	}
+	return applied, nil
+}
+
+// initSchemaVersion creates the schema_version table, recording a database
+// created before migrations existed as being at version 1, or at the legacy
+// migration once InitDB's changes have been completed
+func (s *sqlStore) initSchemaVersion() error {
+	versioned, err := s.tableExists("schema_version")
+	if err != nil || versioned {
+		return err
+	}
+	legacy, err := s.tableExists("jobs")
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := s.lockMigrations(tx); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`); err != nil {
+		return err
+	}
+	if legacy {
+		// The oldest databases predate the callback_failures column
+		hasCallbackFailures, err := s.columnExists(tx, "jobs", "callback_failures")
+		if err != nil {
+			return err
+		}
+		if !hasCallbackFailures {
+			if _, err := tx.Exec(`ALTER TABLE jobs ADD COLUMN callback_failures INTEGER DEFAULT 0`); err != nil {
+				return err
+			}
+		}
+		stamped := []Migration{{Version: 1, Name: "create_jobs"}}
+		migrations, err := loadMigrations(s.dialect.name)
+		if err != nil {
+			return err
+		}
+		completed, err := s.completeLegacyMigration(tx, migrations[legacyMigration-1])
+		if err != nil {
+			return err
+		}
+		if completed {
+			stamped = append(stamped, migrations[legacyMigration-1])
+		}
+		for _, m := range stamped {
+			if _, err := tx.Exec(s.rebind(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+				ON CONFLICT (version) DO NOTHING`), m.Version, m.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// completeLegacyMigration applies whatever InitDB left out of the legacy
+// migration, if it created any of its columns: columns that exist are not
+// added again, tables and indexes are only created if missing, and data
+// fixes run only if a column was added. It reports whether it ran, leaving
+// databases with none of the columns to the migration itself.
+func (s *sqlStore) completeLegacyMigration(tx *sql.Tx, m Migration) (bool, error) {
+	have, _, err := s.legacyColumns(tx)
+	if err != nil || have == 0 {
+		return false, err
+	}
+	added := false
+	for _, statement := range migrationStatements(m.SQL) {
+		if column := addColumnPattern.FindStringSubmatch(statement); column != nil {
+			exists, err := s.columnExists(tx, column[1], column[2])
+			if err != nil {
+				return false, err
+			}
+			if exists {
+				continue
+			}
+			added = true
+		} else if create := createPattern.FindStringSubmatch(statement); create != nil {
+			statement = create[0] + "IF NOT EXISTS " + statement[len(create[0]):]
+		} else if !added {
+			continue
+		}
+		if _, err := tx.Exec(statement); err != nil {
+			return false, fmt.Errorf("completing migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+	return true, nil
+}
+
+// applyMigration runs a migration unless another process applied it first,
+// reporting whether it ran
+func (s *sqlStore) applyMigration(m Migration) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Serialize concurrent migrators, then check nobody beat us to it
+	if err := s.lockMigrations(tx); err != nil {
+		return false, err
+	}
+	var current int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_version`).Scan(&current); err != nil {
+		return false, err
+	}
+	if current >= m.Version {
+		return false, nil
+	}
+
+	if _, err := tx.Exec(m.SQL); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(s.rebind(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, CURRENT_TIMESTAMP)`), m.Version, m.Name); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// lockMigrations holds off other processes migrating the same database
+// until tx ends, where the database supports it
+func (s *sqlStore) lockMigrations(tx *sql.Tx) error {
+	if s.dialect.migrationLock == "" {
+		return nil
+	}
+	_, err := tx.Exec(s.dialect.migrationLock)
+	return err
+}
+
+func (s *sqlStore) tableExists(table string) (bool, error) {
+	var count int
+	err := s.queryRow(s.dialect.tableExistsQuery, table).Scan(&count)
+	return count > 0, err
+}
+
+func (s *sqlStore) columnExists(db queryRower, table, column string) (bool, error) {
+	var count int
+	err := db.QueryRow(s.rebind(s.dialect.columnExistsQuery), table, column).Scan(&count)
+	return count > 0, err
+}
+
+// MigrateOutput is the output of the migrate command
+type MigrateOutput struct {
+	// Version is the schema version before the command ran
+	Version int `json:"version"`
+	// Pending are the migrations a dry run would apply
+	Pending []string `json:"pending,omitempty"`
+	// Applied are the migrations applied, even if a later one failed
+	Applied []string `json:"applied,omitempty"`
+}
+
+// runMigrateCommand implements the migrate subcommand, which applies pending
+// migrations or with -dry-run only lists them
+func runMigrateCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list pending migrations without applying them")
+	flags.Parse(args)
+
+	store, err := OpenStore(LoadConfig(), false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var output MigrateOutput
+	if output.Version, err = store.SchemaVersion(); err != nil {
+		return err
+	}
+	if *dryRun {
+		pending, err := store.PendingMigrations()
+		if err != nil {
+			return err
+		}
+		for _, m := range pending {
+			output.Pending = append(output.Pending, fmt.Sprintf("%04d_%s", m.Version, m.Name))
+		}
+		return printJSON(out, output)
+	}
+
+	applied, err := store.Migrate()
+	for _, m := range applied {
+		output.Applied = append(output.Applied, fmt.Sprintf("%04d_%s", m.Version, m.Name))
+	}
+	if printErr := printJSON(out, output); err == nil {
+		err = printErr
+	}
+	return err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrationsMatchAcrossDialects(t *testing.T) {
+	sqlite, err := loadMigrations("sqlite")
+	if err != nil {
+		t.Fatalf("loadMigrations(sqlite) failed: %v", err)
+	}
+	postgres, err := loadMigrations("postgres")
+	if err != nil {
+		t.Fatalf("loadMigrations(postgres) failed: %v", err)
+	}
+	if len(sqlite) != len(postgres) {
+		t.Fatalf("Expected the same number of migrations, got %d and %d", len(sqlite), len(postgres))
+	}
+	for i := range sqlite {
+		if sqlite[i].Version != postgres[i].Version || sqlite[i].Name != postgres[i].Name {
+			t.Errorf("Migration %d differs: %04d_%s and %04d_%s", i, sqlite[i].Version, sqlite[i].Name, postgres[i].Version, postgres[i].Name)
+		}
+	}
+}
+
+func TestMigrateUpgradesLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.db")
+
+	// A database created by the oldest InitDB, with a job left running
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("sql.Open failed: %v", err)
+	}
+	_, err = db.Exec(`
+	CREATE TABLE jobs (
+		id TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		input_key TEXT NOT NULL,
+		input_bucket TEXT NOT NULL,
+		output_path TEXT NOT NULL,
+		output_bucket TEXT NOT NULL,
+		resolution INTEGER,
+		crf INTEGER,
+		callback_url TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		failed_count INTEGER DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO jobs (id, video_id, input_key, input_bucket, output_path, output_bucket, resolution, crf, callback_url, status)
+	VALUES ('legacy-job', 'vid', 'in.mp4', 'in', 'out/', 'out', 720, 23, 'http://example.com/cb', 1);`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("Failed to create legacy database: %v", err)
+	}
+
+	store, err := openSQLiteStore(path, SQLiteConfig{})
+	if err != nil {
+		t.Fatalf("openSQLiteStore failed: %v", err)
+	}
+	defer store.Close()
+	if version, err := store.SchemaVersion(); err != nil || version != 1 {
+		t.Fatalf("Expected legacy database at version 1, got %d, %v", version, err)
+	}
+	pending, err := store.PendingMigrations()
+	if err != nil || len(pending) == 0 || pending[0].Version != 2 {
+		t.Fatalf("Expected migrations from version 2 to be pending, got %+v, %v", pending, err)
+	}
+
+	if _, err := store.Migrate(); err != nil {
+		t.Fatalf("Migrate failed: %v", err)
+	}
+	if pending, err := store.PendingMigrations(); err != nil || len(pending) != 0 {
+		t.Errorf("Expected no pending migrations, got %+v, %v", pending, err)
+	}
+
+	// The stranded job is recovered by the lease reaper like any other
+	if reaped, err := store.ReapExpiredLeases(3, 3, time.Now()); err != nil || reaped != 1 {
+		t.Fatalf("Expected the legacy running job to be reaped, got %d, %v", reaped, err)
+	}
+	job, err := store.GetJob("legacy-job")
+	if err != nil || job.Status != JobStatusEncodingFailed || job.TenantID != DefaultTenantID || job.Priority != DefaultPriority || job.CallbackFailures != 0 {
+		t.Errorf("Unexpected migrated job %+v, %v", job, err)
+	}
+}
+
+func TestMigrateUpgradesDatabasesCreatedByLaterInitDB(t *testing.T) {
+	const columns = `id TEXT PRIMARY KEY, video_id TEXT NOT NULL, input_key TEXT NOT NULL, input_bucket TEXT NOT NULL,
+		output_path TEXT NOT NULL, output_bucket TEXT NOT NULL, resolution INTEGER, crf INTEGER,
+		callback_url TEXT NOT NULL, status INTEGER NOT NULL, failed_count INTEGER DEFAULT 0,
+		callback_failures INTEGER DEFAULT 0, idempotency_key TEXT, tenant_id TEXT NOT NULL DEFAULT 'default',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP`
+	cases := []struct {
+		name    string
+		schema  string
+		version int
+	}{
+		// InitDB just before migrations, with every column of migration 2
+		{"complete", `CREATE TABLE jobs (` + columns + `, encoded_seconds REAL NOT NULL DEFAULT 0,
+			started_at TIMESTAMP, finished_at TIMESTAMP, priority INTEGER NOT NULL DEFAULT 5, deadline TIMESTAMP,
+			next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, worker_id TEXT, lease_expires_at TIMESTAMP);
+			CREATE UNIQUE INDEX idx_jobs_idempotency ON jobs (tenant_id, idempotency_key, resolution, crf) WHERE idempotency_key IS NOT NULL;
+			CREATE TABLE tenants (id TEXT PRIMARY KEY, weight INTEGER, max_concurrent_encodes INTEGER,
+				max_queued_jobs INTEGER, max_daily_encoded_minutes INTEGER, last_dispatched_at TIMESTAMP);`, legacyMigration},
+		// An earlier InitDB with tenants and idempotency keys but no leases
+		{"partial", `CREATE TABLE jobs (` + columns + `);`, 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "jobs.db")
+			db, err := sql.Open("sqlite3", path)
+			if err != nil {
+				t.Fatalf("sql.Open failed: %v", err)
+			}
+			_, err = db.Exec(tc.schema + `
+			INSERT INTO jobs (id, video_id, input_key, input_bucket, output_path, output_bucket, resolution, crf, callback_url, status, idempotency_key, tenant_id)
+			VALUES ('legacy-job', 'vid', 'in.mp4', 'in', 'out/', 'out', 720, 23, 'http://example.com/cb', 0, 'key', 'acme');`)
+			db.Close()
+			if err != nil {
+				t.Fatalf("Failed to create legacy database: %v", err)
+			}
+
+			store, err := openSQLiteStore(path, SQLiteConfig{})
+			if err != nil {
+				t.Fatalf("openSQLiteStore failed: %v", err)
+			}
+			defer store.Close()
+			if version, err := store.SchemaVersion(); err != nil || version != tc.version {
+				t.Fatalf("Expected legacy database at version %d, got %d, %v", tc.version, version, err)
+			}
+			if _, err := store.Migrate(); err != nil {
+				t.Fatalf("Migrate failed: %v", err)
+			}
+			if pending, err := store.PendingMigrations(); err != nil || len(pending) != 0 {
+				t.Errorf("Expected no pending migrations, got %+v, %v", pending, err)
+			}
+			job, err := store.GetJob("legacy-job")
+			if err != nil || job.TenantID != "acme" || job.IdempotencyKey != "key" || job.Priority != DefaultPriority {
+				t.Errorf("Unexpected migrated job %+v, %v", job, err)
+			}
+		})
+	}
+}
+
+func TestOpenStoreRefusesNewerSchema(t *testing.T) {
+	cfg := Config{DBFilePath: filepath.Join(t.TempDir(), "jobs.db")}
+	store, err := OpenStore(cfg, true)
+	if err != nil {
+		t.Fatalf("OpenStore failed: %v", err)
+	}
+	if _, err := store.(*SQLiteStore).db.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES (999, 'from_the_future', CURRENT_TIMESTAMP)`); err != nil {
+		t.Fatalf("Failed to record future migration: %v", err)
+	}
+	store.Close()
+
+	var tooNew *SchemaTooNewError
+	if _, err := OpenStore(cfg, true); !errors.As(err, &tooNew) || tooNew.Current != 999 {
+		t.Errorf("Expected SchemaTooNewError, got %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+-- Timestamps are stored as UTC text in the same format as SQLite's
+-- CURRENT_TIMESTAMP, so that both stores compare and return them identically
+CREATE TABLE IF NOT EXISTS jobs (
+	id TEXT PRIMARY KEY,
+	video_id TEXT NOT NULL,
+	input_key TEXT NOT NULL,
+	input_bucket TEXT NOT NULL,
+	output_path TEXT NOT NULL,
+	output_bucket TEXT NOT NULL,
+	resolution INTEGER,
+	crf INTEGER,
+	callback_url TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	failed_count INTEGER DEFAULT 0,
+	callback_failures INTEGER DEFAULT 0,
+	created_at TEXT DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+	updated_at TEXT DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')
+);
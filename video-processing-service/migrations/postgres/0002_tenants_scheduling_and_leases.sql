@@ -0,0 +1,39 @@
+-- Idempotency, tenants, API keys, priorities, retries and worker leases
+ALTER TABLE jobs ADD COLUMN idempotency_key TEXT;
+ALTER TABLE jobs ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE jobs ADD COLUMN encoded_seconds DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN started_at TEXT;
+ALTER TABLE jobs ADD COLUMN finished_at TEXT;
+ALTER TABLE jobs ADD COLUMN priority INTEGER NOT NULL DEFAULT 5;
+ALTER TABLE jobs ADD COLUMN deadline TEXT;
+ALTER TABLE jobs ADD COLUMN next_attempt_at TEXT NOT NULL DEFAULT '1970-01-01 00:00:00';
+ALTER TABLE jobs ADD COLUMN worker_id TEXT;
+ALTER TABLE jobs ADD COLUMN lease_expires_at TEXT;
+
+CREATE INDEX idx_jobs_tenant_status ON jobs (tenant_id, status);
+CREATE INDEX idx_jobs_dequeue ON jobs (status, next_attempt_at, priority);
+CREATE INDEX idx_jobs_lease ON jobs (status, lease_expires_at);
+CREATE UNIQUE INDEX idx_jobs_idempotency
+	ON jobs (tenant_id, idempotency_key, resolution, crf)
+	WHERE idempotency_key IS NOT NULL;
+
+CREATE TABLE api_keys (
+	id TEXT PRIMARY KEY,
+	tenant_id TEXT NOT NULL,
+	name TEXT NOT NULL DEFAULT '',
+	key_hash TEXT NOT NULL UNIQUE,
+	input_buckets TEXT NOT NULL DEFAULT '[]',
+	output_buckets TEXT NOT NULL DEFAULT '[]',
+	callback_hosts TEXT NOT NULL DEFAULT '[]',
+	created_at TEXT DEFAULT to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS'),
+	revoked_at TEXT
+);
+
+CREATE TABLE tenants (
+	id TEXT PRIMARY KEY,
+	weight INTEGER,
+	max_concurrent_encodes INTEGER,
+	max_queued_jobs INTEGER,
+	max_daily_encoded_minutes INTEGER,
+	last_dispatched_at TEXT
+);
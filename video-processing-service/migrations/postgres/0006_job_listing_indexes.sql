@@ -0,0 +1,8 @@
+-- Indexes for listing jobs, by creation or update time with the ID breaking
+-- ties for cursor pagination, within a tenant or status, and by video
+CREATE INDEX idx_jobs_created ON jobs (created_at, id);
+CREATE INDEX idx_jobs_updated ON jobs (updated_at, id);
+CREATE INDEX idx_jobs_tenant_created ON jobs (tenant_id, created_at, id);
+CREATE INDEX idx_jobs_tenant_updated ON jobs (tenant_id, updated_at, id);
+CREATE INDEX idx_jobs_status_updated ON jobs (status, updated_at, id);
+CREATE INDEX idx_jobs_video ON jobs (video_id, tenant_id);
@@ -0,0 +1,4 @@
+-- Audio settings of each job's rendition as JSON, NULL to keep ffmpeg's
+-- defaults, and whether the rendition is audio only
+ALTER TABLE jobs ADD COLUMN audio TEXT;
+ALTER TABLE jobs ADD COLUMN audio_only BOOLEAN NOT NULL DEFAULT FALSE;
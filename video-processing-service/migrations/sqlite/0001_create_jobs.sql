@@ -0,0 +1,17 @@
+-- The schema created by InitDB before migrations were introduced
+CREATE TABLE IF NOT EXISTS jobs (
+	id TEXT PRIMARY KEY,
+	video_id TEXT NOT NULL,
+	input_key TEXT NOT NULL,
+	input_bucket TEXT NOT NULL,
+	output_path TEXT NOT NULL,
+	output_bucket TEXT NOT NULL,
+	resolution INTEGER,
+	crf INTEGER,
+	callback_url TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	failed_count INTEGER DEFAULT 0,
+	callback_failures INTEGER DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
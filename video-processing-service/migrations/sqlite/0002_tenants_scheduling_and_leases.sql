@@ -0,0 +1,44 @@
+-- Idempotency, tenants, API keys, priorities, retries and worker leases
+ALTER TABLE jobs ADD COLUMN idempotency_key TEXT;
+ALTER TABLE jobs ADD COLUMN tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE jobs ADD COLUMN encoded_seconds REAL NOT NULL DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN started_at TIMESTAMP;
+ALTER TABLE jobs ADD COLUMN finished_at TIMESTAMP;
+ALTER TABLE jobs ADD COLUMN priority INTEGER NOT NULL DEFAULT 5;
+ALTER TABLE jobs ADD COLUMN deadline TIMESTAMP;
+-- Added columns need a constant default; the epoch means "attempt now"
+ALTER TABLE jobs ADD COLUMN next_attempt_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00';
+ALTER TABLE jobs ADD COLUMN worker_id TEXT;
+ALTER TABLE jobs ADD COLUMN lease_expires_at TIMESTAMP;
+
+-- Jobs left running by a version without leases would never be reaped, so
+-- give them an expired lease
+UPDATE jobs SET lease_expires_at = '1970-01-01 00:00:00' WHERE status IN (1, 5);
+
+CREATE INDEX idx_jobs_tenant_status ON jobs (tenant_id, status);
+CREATE INDEX idx_jobs_dequeue ON jobs (status, next_attempt_at, priority);
+CREATE INDEX idx_jobs_lease ON jobs (status, lease_expires_at);
+CREATE UNIQUE INDEX idx_jobs_idempotency
+	ON jobs (tenant_id, idempotency_key, resolution, crf)
+	WHERE idempotency_key IS NOT NULL;
+
+CREATE TABLE api_keys (
+	id TEXT PRIMARY KEY,
+	tenant_id TEXT NOT NULL,
+	name TEXT NOT NULL DEFAULT '',
+	key_hash TEXT NOT NULL UNIQUE,
+	input_buckets TEXT NOT NULL DEFAULT '[]',
+	output_buckets TEXT NOT NULL DEFAULT '[]',
+	callback_hosts TEXT NOT NULL DEFAULT '[]',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	revoked_at TIMESTAMP
+);
+
+CREATE TABLE tenants (
+	id TEXT PRIMARY KEY,
+	weight INTEGER,
+	max_concurrent_encodes INTEGER,
+	max_queued_jobs INTEGER,
+	max_daily_encoded_minutes INTEGER,
+	last_dispatched_at TIMESTAMP
+);
@@ -0,0 +1,18 @@
+-- History of every job: claims, transitions and the outcome of each attempt
+ALTER TABLE jobs ADD COLUMN outcome TEXT;
+
+CREATE TABLE job_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	job_id TEXT NOT NULL,
+	event TEXT NOT NULL,
+	status INTEGER NOT NULL,
+	worker_id TEXT,
+	attempt INTEGER NOT NULL DEFAULT 0,
+	error TEXT,
+	exit_code INTEGER,
+	stderr_tail TEXT,
+	duration_ms INTEGER,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_job_events_job ON job_events (job_id, id);
@@ -0,0 +1,3 @@
+-- W3C trace context of the request that submitted each job, so that worker
+-- spans join the submitter's trace
+ALTER TABLE jobs ADD COLUMN trace_parent TEXT;
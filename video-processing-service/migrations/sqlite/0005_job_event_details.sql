@@ -0,0 +1,3 @@
+-- Details of administrative operations on jobs, such as who cancelled a job
+-- and why
+ALTER TABLE job_events ADD COLUMN detail TEXT;
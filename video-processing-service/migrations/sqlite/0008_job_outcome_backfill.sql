@@ -0,0 +1,4 @@
+-- Retention goes by outcome, so give one to jobs encoded before outcomes
+-- were recorded. Back then only successful encodes reached the callback
+-- statuses (3 to 7); failed ones stayed encoding_failed.
+UPDATE jobs SET outcome = 'succeeded' WHERE outcome IS NULL AND status IN (3, 4, 5, 6, 7);
@@ -0,0 +1,12 @@
+-- Renditions submitted under one idempotency key are told apart by the file
+-- they write. Audio-only renditions all have a zero resolution and CRF, so
+-- the key can no longer include those instead.
+ALTER TABLE jobs ADD COLUMN output_name TEXT;
+-- Audio-only jobs from before, at most one per key, keep a NULL name, which
+-- never conflicts
+UPDATE jobs SET output_name = CAST(resolution AS TEXT) || 'p.mp4' WHERE NOT audio_only;
+
+DROP INDEX idx_jobs_idempotency;
+CREATE UNIQUE INDEX idx_jobs_idempotency
+	ON jobs (tenant_id, idempotency_key, output_name)
+	WHERE idempotency_key IS NOT NULL;
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NATSIntake consumes RequestPayload messages from a NATS JetStream stream.
+// Messages are acked only once their jobs are stored, so a crash between
+// delivery and insert results in redelivery rather than a lost request.
+type NATSIntake struct {
+	cfg     NATSConfig
+	conn    *nats.Conn
+	consume jetstream.ConsumeContext
+}
+
+// NewNATSIntake creates a NATS intake for the given config
+func NewNATSIntake(cfg NATSConfig) *NATSIntake {
+	return &NATSIntake{cfg: cfg}
+}
+
+// Start connects to NATS, ensures the stream and durable consumer exist and
+// begins consuming messages.
+func (n *NATSIntake) Start(ctx *AppContext) error {
+	conn, err := nats.Connect(n.cfg.URL, nats.Name("video-processing-service"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS at %s: %w", n.cfg.URL, err)
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	setupCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := js.CreateOrUpdateStream(setupCtx, jetstream.StreamConfig{
+		Name:     n.cfg.Stream,
+		Subjects: []string{n.cfg.Subject},
+	})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create stream %s: %w", n.cfg.Stream, err)
+	}
+
+	consumer, err := stream.CreateOrUpdateConsumer(setupCtx, jetstream.ConsumerConfig{
+		Durable:       n.cfg.Durable,
+		FilterSubject: n.cfg.Subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		MaxDeliver:    n.cfg.MaxDeliver,
+	})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to create consumer %s: %w", n.cfg.Durable, err)
+	}
+
+	consume, err := consumer.Consume(func(msg jetstream.Msg) {
+		n.handleMessage(ctx, msg)
+	})
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to start consuming: %w", err)
+	}
+
+	n.conn = conn
+	n.consume = consume
+	slog.Info("NATS intake consuming", "subject", n.cfg.Subject, "stream", n.cfg.Stream)
+	return nil
+}
+
+// handleMessage decodes a single message and acks, naks or terminates it
+// depending on whether its jobs could be stored.
+func (n *NATSIntake) handleMessage(ctx *AppContext, msg jetstream.Msg) {
+	reqPayload, err := DecodeRequestPayload(bytes.NewReader(msg.Data()), ctx.Config.MaxRequestBodyBytes)
+	if err != nil {
+		slog.Warn("NATS intake dropping undecodable message", "error", err)
+		msg.Term()
+		return
+	}
+
+	// Publishers may pass their trace context in the message headers
+	traceCtx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(msg.Headers()))
+	traceCtx, span := startSpan(traceCtx, "nats intake", trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+
+	if _, _, err := SubmitJobs(traceCtx, ctx, n.cfg.TenantID, reqPayload); err != nil {
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) || errors.Is(err, ErrIdempotencyKeyReused) {
+			// Redelivering an invalid request can never succeed
+			slog.Warn("NATS intake dropping invalid request", "video_id", reqPayload.VideoId, "error", err)
+			msg.Term()
+			return
+		}
+		slog.Error("NATS intake failed to create jobs", "video_id", reqPayload.VideoId, "error", err)
+		msg.NakWithDelay(n.cfg.RetryDelay)
+		return
+	}
+
+	if err := msg.Ack(); err != nil {
+		slog.Error("NATS intake failed to ack message", "video_id", reqPayload.VideoId, "error", err)
+	}
+}
+
+// Close stops consuming and drains the NATS connection
+func (n *NATSIntake) Close() error {
+	if n.consume != nil {
+		n.consume.Stop()
+	}
+	if n.conn != nil {
+		return n.conn.Drain()
+	}
+	return nil
+}
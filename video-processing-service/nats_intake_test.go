@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func startTestNATSServer(t *testing.T) *server.Server {
+	t.Helper()
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server not ready")
+	}
+	t.Cleanup(srv.Shutdown)
+	return srv
+}
+
+func TestNATSIntakeStoresJobsAndAcks(t *testing.T) {
+	srv := startTestNATSServer(t)
+	appCtx := setupTestAppContext(t)
+
+	cfg := NATSConfig{
+		URL:        srv.ClientURL(),
+		Stream:     "VIDEO_JOBS",
+		Subject:    "video.process",
+		Durable:    "test-intake",
+		MaxDeliver: 3,
+		RetryDelay: 100 * time.Millisecond,
+		TenantID:   DefaultTenantID,
+	}
+	intake := NewNATSIntake(cfg)
+	if err := intake.Start(appCtx); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer intake.Close()
+
+	nc, err := nats.Connect(srv.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer nc.Close()
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("failed to create JetStream context: %v", err)
+	}
+
+	valid, _ := json.Marshal(RequestPayload{
+		VideoId:     "vid123",
+		Input:       Input{Bucket: "input-bucket", Key: "input.mp4"},
+		Output:      Output{Bucket: "output-bucket", BasePath: "outputs/"},
+		Profiles:    []Profile{{Resolution: "720", Crf: 23}},
+		CallbackURL: "http://callback.example.com/done",
+	})
+	invalid, _ := json.Marshal(RequestPayload{VideoId: "missing-fields"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, data := range [][]byte{invalid, []byte("not json"), valid} {
+		if _, err := js.Publish(ctx, cfg.Subject, data); err != nil {
+			t.Fatalf("publish failed: %v", err)
+		}
+	}
+
+	consumer, err := js.Consumer(ctx, cfg.Stream, cfg.Durable)
+	if err != nil {
+		t.Fatalf("failed to look up consumer: %v", err)
+	}
+	for {
+		info, err := consumer.Info(ctx)
+		if err != nil {
+			t.Fatalf("consumer info failed: %v", err)
+		}
+		if info.AckFloor.Stream == 3 && info.NumAckPending == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("messages were not acknowledged: %+v", info)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	jobs, err := appCtx.Store.ListJobs(JobFilter{Statuses: []JobStatus{JobStatusEncodingPending}})
+	if err != nil {
+		t.Fatalf("ListJobs failed: %v", err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("Expected 1 job, got %d", len(jobs))
+	}
+	if jobs[0].VideoID != "vid123" || jobs[0].Resolution != 720 {
+		t.Errorf("Unexpected job stored: %+v", jobs[0])
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPIDocument describes every endpoint of the service. Requests are
+// validated against it before reaching their handlers, which then check
+// what a schema cannot express, such as bucket naming rules.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// OpenAPISpec is the part of an OpenAPI 3 document needed to validate
+// requests
+type OpenAPISpec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]*Schema `json:"schemas"`
+	} `json:"components"`
+}
+
+// Operation is an operation of the document
+type Operation struct {
+	Parameters  []Parameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *Schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+// Parameter is a path, query or header parameter of an operation
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+// Schema is the subset of JSON Schema used by the document
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Format               string             `json:"format"`
+	Nullable             bool               `json:"nullable"`
+	Enum                 []interface{}      `json:"enum"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MaxLength            *int               `json:"maxLength"`
+	MaxItems             *int               `json:"maxItems"`
+}
+
+// openAPISpec is the parsed document. It is embedded, so failing to parse
+// it is a bug caught by the tests.
+var openAPISpec = mustLoadOpenAPISpec()
+
+func mustLoadOpenAPISpec() *OpenAPISpec {
+	spec, err := loadOpenAPISpec()
+	if err != nil {
+		panic(err)
+	}
+	return spec
+}
+
+// loadOpenAPISpec parses the embedded document
+func loadOpenAPISpec() (*OpenAPISpec, error) {
+	var spec OpenAPISpec
+	if err := json.Unmarshal(openAPIDocument, &spec); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+	return &spec, nil
+}
+
+// Operation returns the operation of a method and path template, with the
+// parameters shared by the path added to its own
+func (s *OpenAPISpec) Operation(method, path string) (*Operation, bool) {
+	item, ok := s.Paths[path]
+	if !ok {
+		return nil, false
+	}
+	raw, ok := item[strings.ToLower(method)]
+	if !ok {
+		return nil, false
+	}
+	var op Operation
+	if err := json.Unmarshal(raw, &op); err != nil {
+		return nil, false
+	}
+	if shared, ok := item["parameters"]; ok {
+		var params []Parameter
+		if err := json.Unmarshal(shared, &params); err == nil {
+			op.Parameters = append(params, op.Parameters...)
+		}
+	}
+	return &op, true
+}
+
+// resolve follows a reference to a schema of the document
+func (s *OpenAPISpec) resolve(schema *Schema) *Schema {
+	for schema != nil && schema.Ref != "" {
+		schema = s.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+// validateValue checks a decoded JSON value against a schema, returning an
+// error for each field that does not conform. field is the path of the
+// value, such as profiles[0].crf.
+func (s *OpenAPISpec) validateValue(schema *Schema, value interface{}, field string) []FieldError {
+	schema = s.resolve(schema)
+	if schema == nil {
+		return nil
+	}
+	fail := func(code, message string) []FieldError {
+		return []FieldError{{Field: field, Code: code, Message: message}}
+	}
+	if value == nil {
+		if schema.Nullable || schema.Type == "" {
+			return nil
+		}
+		return fail(FieldCodeInvalidFormat, "must not be null")
+	}
+
+	switch schema.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fail(FieldCodeInvalidFormat, "must be an object")
+		}
+		return s.validateObject(schema, obj, field)
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fail(FieldCodeInvalidFormat, "must be an array")
+		}
+		if schema.MaxItems != nil && len(items) > *schema.MaxItems {
+			return fail(FieldCodeOutOfRange, fmt.Sprintf("at most %d items are allowed", *schema.MaxItems))
+		}
+		var fields []FieldError
+		for i, item := range items {
+			fields = append(fields, s.validateValue(schema.Items, item, fmt.Sprintf("%s[%d]", field, i))...)
+		}
+		return fields
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fail(FieldCodeInvalidFormat, "must be a string")
+		}
+		if schema.MaxLength != nil && len(str) > *schema.MaxLength {
+			return fail(FieldCodeTooLong, fmt.Sprintf("must be at most %d characters", *schema.MaxLength))
+		}
+		if schema.Format == "date-time" && str != "" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fail(FieldCodeInvalidFormat, "must be an RFC 3339 timestamp")
+			}
+		}
+	case "integer", "number":
+		num, ok := value.(json.Number)
+		if !ok {
+			return fail(FieldCodeInvalidFormat, "must be a "+schema.Type)
+		}
+		n, err := num.Float64()
+		if err != nil || (schema.Type == "integer" && strings.ContainsAny(num.String(), ".eE")) {
+			return fail(FieldCodeInvalidFormat, "must be a "+schema.Type)
+		}
+		if schema.Minimum != nil && n < *schema.Minimum {
+			return fail(FieldCodeOutOfRange, fmt.Sprintf("must be at least %v", *schema.Minimum))
+		}
+		if schema.Maximum != nil && n > *schema.Maximum {
+			return fail(FieldCodeOutOfRange, fmt.Sprintf("must be at most %v", *schema.Maximum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fail(FieldCodeInvalidFormat, "must be a boolean")
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		var names []string
+		for _, allowed := range schema.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(value) {
+				return nil
+			}
+			names = append(names, fmt.Sprint(allowed))
+		}
+		return fail(FieldCodeInvalidFormat, "must be one of "+strings.Join(names, ", "))
+	}
+	return nil
+}
+
+func (s *OpenAPISpec) validateObject(schema *Schema, obj map[string]interface{}, field string) []FieldError {
+	prefix := ""
+	if field != "" {
+		prefix = field + "."
+	}
+	var fields []FieldError
+	for _, name := range schema.Required {
+		if _, ok := obj[name]; !ok {
+			fields = append(fields, FieldError{Field: prefix + name, Code: FieldCodeRequired, Message: "is required"})
+		}
+	}
+	var additional *Schema
+	closed := string(schema.AdditionalProperties) == "false"
+	if len(schema.AdditionalProperties) > 0 && !closed {
+		json.Unmarshal(schema.AdditionalProperties, &additional)
+	}
+
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		property, ok := schema.Properties[name]
+		switch {
+		case ok:
+			fields = append(fields, s.validateValue(property, obj[name], prefix+name)...)
+		case additional != nil:
+			fields = append(fields, s.validateValue(additional, obj[name], prefix+name)...)
+		case closed:
+			fields = append(fields, FieldError{Field: prefix + name, Code: FieldCodeUnknown, Message: "unknown field"})
+		}
+	}
+	return fields
+}
+
+// validateQuery checks the query parameters of a request against those the
+// operation declares, rejecting any it does not
+func (s *OpenAPISpec) validateQuery(op *Operation, query map[string][]string) []FieldError {
+	declared := map[string]*Schema{}
+	for _, param := range op.Parameters {
+		if param.In == "query" {
+			declared[param.Name] = param.Schema
+		}
+	}
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var fields []FieldError
+	for _, name := range names {
+		schema, ok := declared[name]
+		if !ok {
+			fields = append(fields, FieldError{Field: name, Code: FieldCodeUnknown, Message: "unknown query parameter"})
+			continue
+		}
+		schema = s.resolve(schema)
+		values := query[name]
+		if schema.Type == "array" {
+			var items []interface{}
+			for _, value := range values {
+				for _, item := range strings.Split(value, ",") {
+					items = append(items, queryValue(s.resolve(schema.Items), strings.TrimSpace(item)))
+				}
+			}
+			fields = append(fields, s.validateValue(schema, items, name)...)
+			continue
+		}
+		fields = append(fields, s.validateValue(schema, queryValue(schema, values[len(values)-1]), name)...)
+	}
+	return fields
+}
+
+// queryValue converts a query parameter to the JSON value it stands for
+func queryValue(schema *Schema, value string) interface{} {
+	if schema != nil && (schema.Type == "integer" || schema.Type == "number") {
+		if _, err := strconv.ParseFloat(value, 64); err == nil {
+			return json.Number(value)
+		}
+	}
+	return value
+}
+
+// ValidateRequest checks the query and JSON body of a request against the
+// operation, leaving the body readable for the handler. Bodies that are too
+// large or not JSON are left for the handler to reject, so that they are
+// reported as before.
+func (s *OpenAPISpec) ValidateRequest(op *Operation, r *http.Request, maxBodyBytes int64) []FieldError {
+	fields := s.validateQuery(op, r.URL.Query())
+	if op.RequestBody == nil || r.Body == nil {
+		return fields
+	}
+	content, ok := op.RequestBody.Content["application/json"]
+	if !ok {
+		return fields
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil || int64(len(data)) > maxBodyBytes {
+		return fields
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		if op.RequestBody.Required {
+			fields = append(fields, FieldError{Field: "body", Code: FieldCodeRequired, Message: "is required"})
+		}
+		return fields
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var body interface{}
+	if err := decoder.Decode(&body); err != nil {
+		return fields
+	}
+	return append(fields, s.validateValue(content.Schema, body, "")...)
+}
+
+// ValidateAgainstSpec rejects requests that do not conform to the operation
+// of the route in the document before they reach next. Routes without a
+// method are validated as the method of each request.
+func ValidateAgainstSpec(ctx *AppContext, spec *OpenAPISpec, pattern string, next http.Handler) http.Handler {
+	method, path, found := strings.Cut(pattern, " ")
+	if !found {
+		method, path = "", pattern
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := method
+		if m == "" {
+			m = r.Method
+		}
+		op, ok := spec.Operation(m, path)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if fields := spec.ValidateRequest(op, r, ctx.Config.MaxRequestBodyBytes); len(fields) > 0 {
+			writeError(w, http.StatusBadRequest, ErrCodeValidationFailed, "Request validation failed", fields)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// OpenAPIHandler serves the OpenAPI document
+func OpenAPIHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPIDocument)
+	}
+}
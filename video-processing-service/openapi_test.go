@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"video-processing-service/client"
+)
+
+func TestOpenAPIDocumentCoversEveryRoute(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	for _, route := range Routes(ctx) {
+		method, path, found := strings.Cut(route.Pattern, " ")
+		if !found {
+			method, path = http.MethodPost, route.Pattern
+		}
+		if _, ok := openAPISpec.Operation(method, path); !ok {
+			t.Errorf("Route %q is missing from the OpenAPI document", route.Pattern)
+		}
+	}
+}
+
+// checkResponseSchema validates a JSON response against the schema the
+// document gives for the operation and status code
+func checkResponseSchema(t *testing.T, method, path string, status int, body []byte) {
+	t.Helper()
+	var op struct {
+		Responses map[string]struct {
+			Content map[string]struct {
+				Schema *Schema `json:"schema"`
+			} `json:"content"`
+		} `json:"responses"`
+	}
+	if err := json.Unmarshal(openAPISpec.Paths[path][strings.ToLower(method)], &op); err != nil {
+		t.Fatalf("Operation %s %s is invalid: %v", method, path, err)
+	}
+	resp, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		t.Fatalf("%s %s does not document a %d response", method, path, status)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("Response of %s %s is not JSON: %v", method, path, err)
+	}
+	if fields := openAPISpec.validateValue(resp.Content["application/json"].Schema, value, ""); len(fields) > 0 {
+		t.Errorf("Response of %s %s does not match the document: %+v", method, path, fields)
+	}
+}
+
+func TestClientAgainstHandlers(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	server := httptest.NewServer(NewRouter(ctx))
+	defer server.Close()
+	c := client.New(server.URL, "")
+	bg := context.Background()
+
+	req := client.SubmitRequest{
+		VideoID:        "contract-video",
+		Input:          client.Location{Bucket: "input-bucket", Key: "input.mp4"},
+		Output:         client.OutputLocation{Bucket: "output-bucket", BasePath: "outputs/"},
+		Profiles:       []client.Profile{{Resolution: "720", Crf: 23}, {Resolution: "480", Crf: 28}},
+		CallbackURL:    "http://callback.example.com/done",
+		IdempotencyKey: "contract-key",
+	}
+	submitted, err := c.Submit(bg, req)
+	if err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	if len(submitted.Jobs) != 2 || submitted.Replayed {
+		t.Fatalf("Unexpected submission %+v", submitted)
+	}
+	replay, err := c.Submit(bg, req)
+	if err != nil || !replay.Replayed || len(replay.Jobs) != 2 {
+		t.Fatalf("Expected resubmission to be replayed, got %+v, %v", replay, err)
+	}
+	original := map[string]bool{submitted.Jobs[0].JobID: true, submitted.Jobs[1].JobID: true}
+	for _, job := range replay.Jobs {
+		if !original[job.JobID] {
+			t.Errorf("Expected replay to return the original jobs, got %s", job.JobID)
+		}
+	}
+
+	job, err := c.GetJob(bg, submitted.Jobs[0].JobID)
+	if err != nil {
+		t.Fatalf("GetJob failed: %v", err)
+	}
+	if job.VideoID != "contract-video" || job.Resolution != submitted.Jobs[0].Resolution || job.Status != JobStatusEncodingPending.String() {
+		t.Errorf("Unexpected job %+v", job)
+	}
+
+	list, err := c.ListJobs(bg, client.ListOptions{VideoID: "contract-video", Sort: "-createdAt", Limit: 1})
+	if err != nil {
+		t.Fatalf("ListJobs failed: %v", err)
+	}
+	if len(list.Jobs) != 1 || list.NextCursor == "" || list.Counts[JobStatusEncodingPending.String()] != 2 {
+		t.Fatalf("Unexpected first page %+v", list)
+	}
+	next, err := c.ListJobs(bg, client.ListOptions{VideoID: "contract-video", Sort: "-createdAt", Limit: 1, Cursor: list.NextCursor})
+	if err != nil || len(next.Jobs) != 1 || next.NextCursor != "" || next.Jobs[0].JobID == list.Jobs[0].JobID {
+		t.Fatalf("Unexpected last page %+v, %v", next, err)
+	}
+
+	cancelled, err := c.CancelJob(bg, job.JobID)
+	if err != nil || cancelled.Outcome != JobOutcomeCancelled {
+		t.Fatalf("Expected job to be cancelled, got %+v, %v", cancelled, err)
+	}
+
+	// Error responses are returned as *client.Error
+	var apiErr *client.Error
+	if _, err := c.GetJob(bg, "missing"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 error, got %v", err)
+	}
+	if _, err := c.CancelJob(bg, job.JobID); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+		t.Errorf("Expected cancelling twice to conflict, got %v", err)
+	}
+	req.IdempotencyKey = ""
+	req.Profiles = []client.Profile{{Resolution: "720", Crf: 99}}
+	if _, err := c.Submit(bg, req); !errors.As(err, &apiErr) || apiErr.Code != ErrCodeValidationFailed ||
+		len(apiErr.Fields) != 1 || apiErr.Fields[0].Field != "profiles[0].crf" {
+		t.Errorf("Expected a validation error on the CRF, got %v", err)
+	}
+}
+
+func TestResponsesMatchDocument(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	jobs := submitTestJobs(t, ctx, DefaultTenantID, 2)
+	router := NewRouter(ctx)
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	for path, template := range map[string]string{
+		"/jobs":                           "/jobs",
+		"/jobs/" + jobs[0].ID:             "/jobs/{id}",
+		"/jobs/" + jobs[0].ID + "/events": "/jobs/{id}/events",
+		"/jobs/missing":                   "/jobs/{id}",
+		"/healthz":                        "/healthz",
+	} {
+		rec := get(path)
+		checkResponseSchema(t, http.MethodGet, template, rec.Code, rec.Body.Bytes())
+	}
+}
+
+func TestRequestsValidatedAgainstDocument(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	router := NewRouter(ctx)
+	cases := []struct {
+		name, method, target, body string
+		field, code                string
+	}{
+		{"unknown query parameter", http.MethodGet, "/jobs?colour=red", "", "colour", FieldCodeUnknown},
+		{"integer query parameter", http.MethodGet, "/jobs?limit=many", "", "limit", FieldCodeInvalidFormat},
+		{"wrong body type", http.MethodPost, "/process-video", `{"videoId": 7}`, "videoId", FieldCodeInvalidFormat},
+		{"nested unknown field", http.MethodPost, "/process-video", `{"input": {"bucket": "b", "key": "k", "region": "x"}}`, "input.region", FieldCodeUnknown},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body io.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.target, body))
+			var resp ErrorResponse
+			json.NewDecoder(rec.Body).Decode(&resp)
+			if rec.Code != http.StatusBadRequest || resp.Code != ErrCodeValidationFailed {
+				t.Fatalf("Expected a validation error, got %d %+v", rec.Code, resp)
+			}
+			for _, f := range resp.Fields {
+				if f.Field == tc.field && f.Code == tc.code {
+					return
+				}
+			}
+			t.Errorf("Expected %s to fail with %s, got %+v", tc.field, tc.code, resp.Fields)
+		})
+	}
+}
+
+func TestSignedCallbackVerifiedByClient(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Config.CallbackSigningSecret = "callback-secret"
+	jobs := submitTestJobs(t, ctx, DefaultTenantID, 1)
+	if _, err := ctx.Store.CancelJob(jobs[0].ID, "test"); err != nil {
+		t.Fatalf("CancelJob failed: %v", err)
+	}
+
+	received := make(chan *client.Callback, 1)
+	callbacks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callback, err := client.ParseCallback(r, "callback-secret")
+		if err != nil {
+			t.Errorf("ParseCallback failed: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		received <- callback
+	}))
+	defer callbacks.Close()
+	callback, err := ctx.Store.DequeueCallbackJob("callback-worker", 3, time.Now().Add(time.Minute))
+	if err != nil || callback == nil {
+		t.Fatalf("DequeueCallbackJob returned %v, %v", callback, err)
+	}
+	callback.CallbackURL = callbacks.URL
+	ProcessCallbackJob(ctx, callback)
+	select {
+	case got := <-received:
+		if got.JobID != jobs[0].ID || got.Status != JobOutcomeCancelled {
+			t.Errorf("Unexpected callback %+v", got)
+		}
+	default:
+		t.Fatal("Expected a verified callback")
+	}
+
+	body := []byte(`{"jobId":"job"}`)
+	now := time.Now()
+	header := SignCallback("callback-secret", now, body)
+	if err := client.VerifyCallbackSignature("callback-secret", header, body, now, time.Minute); err != nil {
+		t.Errorf("Expected signature to verify, got %v", err)
+	}
+	if err := client.VerifyCallbackSignature("other-secret", header, body, now, time.Minute); !errors.Is(err, client.ErrInvalidSignature) {
+		t.Errorf("Expected wrong secret to be rejected, got %v", err)
+	}
+	if err := client.VerifyCallbackSignature("callback-secret", header, []byte(`{"jobId":"other"}`), now, time.Minute); !errors.Is(err, client.ErrInvalidSignature) {
+		t.Errorf("Expected tampered body to be rejected, got %v", err)
+	}
+	if err := client.VerifyCallbackSignature("callback-secret", header, body, now.Add(time.Hour), time.Minute); !errors.Is(err, client.ErrExpiredSignature) {
+		t.Errorf("Expected stale signature to be rejected, got %v", err)
+	}
+}
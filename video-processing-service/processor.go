@@ -2,116 +2,453 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
-	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// ConvertVideo converts a video to 360p using ffmpeg.
+// Video encoder used by ConvertVideo
+const videoCodec = "libx264"
+
+// ffmpeg's progress lines end with the encoding speed, such as "speed=2.5x"
+var ffmpegSpeedPattern = regexp.MustCompile(`speed=\s*([0-9.]+)x`)
+
+// How much of ffmpeg's stderr is kept for the job's history when it fails
+const stderrTailBytes = 4096
+
+// FFmpegError reports a failed ffmpeg run along with the end of its output,
+// which is where ffmpeg explains what went wrong
+type FFmpegError struct {
+	ExitCode   int
+	StderrTail string
+	Err        error
+}
+
+func (e *FFmpegError) Error() string {
+	return fmt.Sprintf("ffmpeg exited with code %d: %v", e.ExitCode, e.Err)
+}
+
+func (e *FFmpegError) Unwrap() error {
+	return e.Err
+}
+
+// ErrFFmpegStalled is the cause of an ffmpeg run killed for reporting no
+// progress, so that a hung ffmpeg cannot hold on to its job's lease forever
+var ErrFFmpegStalled = errors.New("ffmpeg stopped reporting progress")
+
+// ffmpegWatchdog cancels the context of an ffmpeg run once it goes
+// stallTimeout without a progress line. A zero stallTimeout disables it.
+type ffmpegWatchdog struct {
+	ctx          context.Context
+	cancel       context.CancelCauseFunc
+	timer        *time.Timer
+	stallTimeout time.Duration
+}
+
+func newFFmpegWatchdog(ctx context.Context, stallTimeout time.Duration) *ffmpegWatchdog {
+	w := &ffmpegWatchdog{stallTimeout: stallTimeout}
+	w.ctx, w.cancel = context.WithCancelCause(ctx)
+	if stallTimeout > 0 {
+		w.timer = time.AfterFunc(stallTimeout, func() { w.cancel(ErrFFmpegStalled) })
+	}
+	return w
+}
+
+// progress restarts the countdown
+func (w *ffmpegWatchdog) progress() {
+	if w.timer != nil {
+		w.timer.Reset(w.stallTimeout)
+	}
+}
+
+// stop releases the watchdog once ffmpeg has exited
+func (w *ffmpegWatchdog) stop() {
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.cancel(nil)
+}
+
+// wrap explains a failed run that the watchdog killed
+func (w *ffmpegWatchdog) wrap(err error) error {
+	if errors.Is(context.Cause(w.ctx), ErrFFmpegStalled) {
+		return fmt.Errorf("%w for %s: %v", ErrFFmpegStalled, w.stallTimeout, err)
+	}
+	return err
+}
+
+// ConvertVideo encodes a video to a profile using ffmpeg, logging ffmpeg's
+// output line by line to logger. Profiles normalizing loudness first run
+// ffmpeg over the audio to measure it. ffmpeg is killed if ctx is
+// cancelled, such as when the job is cancelled or its lease lost, or if it
+// reports no progress for stallTimeout.
 // rawVideoName: the input file path
 // processedVideoName: the output file path
-func ConvertVideo(rawVideoName string, processedVideoName string, resolution int, crf int) error {
-	fmt.Printf("Converting video from %s to %s\n", rawVideoName, processedVideoName)
-
-	cmd := exec.Command(
-		"ffmpeg",
-		"-i", rawVideoName,
-		"-vf", fmt.Sprintf("scale=-2:%d", resolution),
-		"-c:v", "libx264",
-		"-preset", "fast",
-		"-crf", fmt.Sprintf("%d", crf),
-		processedVideoName,
-	)
+func ConvertVideo(ctx context.Context, logger *slog.Logger, rawVideoName string, processedVideoName string, profile ParsedProfile, stallTimeout time.Duration) error {
+	var measured *LoudnessMeasurement
+	if profile.Audio != nil && profile.Audio.Normalize != nil {
+		var err error
+		if measured, err = MeasureLoudness(ctx, logger, rawVideoName, profile.Audio, stallTimeout); err != nil {
+			return err
+		}
+		logger.Info("Measured loudness", "integrated", measured.InputI, "true_peak", measured.InputTP, "range", measured.InputLRA)
+	}
+	watchdog := newFFmpegWatchdog(ctx, stallTimeout)
+	defer watchdog.stop()
+	cmd := exec.CommandContext(watchdog.ctx, "ffmpeg", ffmpegArgs(rawVideoName, processedVideoName, profile, measured)...)
+	label, codec := encodeLabels(profile)
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		return fmt.Errorf("failed to get stderr pipe: %w", err)
 	}
 
+	startedAt := time.Now()
 	if err := cmd.Start(); err != nil {
+		observeEncode(label, codec, 0, 0, err)
 		return fmt.Errorf("failed to start ffmpeg: %w", err)
 	}
+	logger.Info("Started ffmpeg", "args", cmd.Args)
 
-	fmt.Printf("Spawned FFMPEG with command: %v\n", cmd.Args)
+	tail := logFFmpegOutput(logger, stderr, watchdog.progress)
+	err = cmd.Wait()
+	observeEncode(label, codec, time.Since(startedAt), ffmpegSpeed(tail), err)
+	if err != nil {
+		exitCode := -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+		return &FFmpegError{ExitCode: exitCode, StderrTail: stderrTail(tail), Err: watchdog.wrap(err)}
+	}
+
+	logger.Info("ffmpeg finished", "duration", time.Since(startedAt))
+	return nil
+}
 
-	// Print ffmpeg stderr output
-	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := stderr.Read(buf)
-			if n > 0 {
-				fmt.Printf("FFmpeg stderr: %s", string(buf[:n]))
-			}
-			if err != nil {
-				break
-			}
+// ffmpegArgs returns the arguments of the ffmpeg run encoding a profile,
+// given the loudness of the source if the profile normalizes it
+func ffmpegArgs(rawVideoName, processedVideoName string, profile ParsedProfile, measured *LoudnessMeasurement) []string {
+	args := []string{"-hide_banner", "-i", rawVideoName}
+	spec := audioStreamSpecifier(profile.Audio)
+	if profile.AudioOnly {
+		if spec == "" {
+			spec = "0:a:0"
 		}
-	}()
+		args = append(args, "-map", spec, "-vn")
+		args = append(args, audioArgs(profile.Audio, measured)...)
+		return append(args, processedVideoName)
+	}
 
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("an error occurred: %w", err)
+	if spec != "" {
+		args = append(args, "-map", "0:v:0", "-map", spec)
 	}
+	args = append(args,
+		"-vf", fmt.Sprintf("scale=-2:%d", profile.Resolution),
+		"-c:v", videoCodec,
+		"-preset", "fast",
+		"-crf", fmt.Sprintf("%d", profile.Crf),
+	)
+	if profile.Audio != nil {
+		args = append(args, audioArgs(profile.Audio, measured)...)
+	}
+	return append(args, processedVideoName)
+}
 
-	fmt.Println("Processing finished successfully")
-	return nil
+// encodeLabels returns the rendition and codec an encode is recorded under
+func encodeLabels(profile ParsedProfile) (string, string) {
+	if profile.AudioOnly {
+		return "audio", audioEncoders[profile.Audio.Codec]
+	}
+	return strconv.Itoa(profile.Resolution), videoCodec
+}
+
+// JobProfile is the profile a job encodes
+func JobProfile(job *Job) ParsedProfile {
+	return ParsedProfile{Resolution: job.Resolution, Crf: job.Crf, Audio: job.Audio, AudioOnly: job.AudioOnly}
+}
+
+// logFFmpegOutput logs ffmpeg's stderr until it closes, one line per entry,
+// and returns its tail. Progress updates, which ffmpeg ends with a carriage
+// return to overwrite them in a terminal, are logged at debug level and
+// reported to progress.
+func logFFmpegOutput(logger *slog.Logger, stderr io.Reader, progress func()) []byte {
+	var tail []byte
+	scanner := bufio.NewScanner(stderr)
+	scanner.Split(scanFFmpegLines)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if ffmpegSpeedPattern.MatchString(line) {
+			logger.Debug("ffmpeg progress", "line", line)
+			progress()
+		} else {
+			logger.Info("ffmpeg output", "line", line)
+		}
+		tail = append(tail, line+"\n"...)
+		if len(tail) > stderrTailBytes {
+			tail = tail[len(tail)-stderrTailBytes:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Warn("Failed to read ffmpeg output", "error", err)
+		// Keep draining so that ffmpeg never blocks on a full pipe
+		io.Copy(io.Discard, stderr)
+	}
+	return tail
+}
+
+// scanFFmpegLines splits ffmpeg's output into lines ending in either a
+// newline or a carriage return
+func scanFFmpegLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
 }
 
-// ProcessVideoJob processes a video job (now takes Job struct)
+// ffmpegSpeed returns the last encoding speed ffmpeg reported, or zero
+func ffmpegSpeed(stderr []byte) float64 {
+	matches := ffmpegSpeedPattern.FindAllSubmatch(stderr, -1)
+	if len(matches) == 0 {
+		return 0
+	}
+	speed, _ := strconv.ParseFloat(string(matches[len(matches)-1][1]), 64)
+	return speed
+}
+
+// stderrTail trims a truncated tail of output to whole lines
+func stderrTail(tail []byte) string {
+	s := string(tail)
+	if len(tail) == stderrTailBytes {
+		if i := strings.IndexAny(s, "\r\n"); i >= 0 {
+			s = s[i+1:]
+		}
+	}
+	return strings.TrimSpace(s)
+}
+
+// ProbeDuration returns the duration of a media file in seconds using ffprobe
+func ProbeDuration(ctx context.Context, path string) (float64, error) {
+	out, err := exec.CommandContext(ctx,
+		"ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed: %w", err)
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe reported no duration: %w", err)
+	}
+	return seconds, nil
+}
+
+// Upper bound on the delay between encoding attempts
+const maxRetryDelay = 30 * time.Minute
+
+// RetryDelay returns the exponential backoff before retrying a job that has
+// already failed failedCount times
+func RetryDelay(base time.Duration, failedCount int) time.Duration {
+	delay := base
+	for i := 0; i < failedCount && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// ProcessVideoJob processes a video job (now takes Job struct). The job's
+// lease is renewed while it runs and its result is discarded if the lease is
+// lost to another worker. If the job is cancelled, ffmpeg and any S3
+// transfer are stopped and whatever was uploaded is removed.
 func ProcessVideoJob(ctx *AppContext, job *Job) {
-	inputFilePath := filepath.Join(ctx.Config.LocalRawVideoPath, filepath.Base(job.InputKey))
-	outputBasePath := filepath.Join(ctx.Config.LocalProcessedVideoPath, filepath.Base(job.OutputPath))
+	logger := JobLogger(job, job.FailedCount+1)
+	_, span := startJobSpan(job, "encode job", job.FailedCount+1)
+	defer span.End()
+	leaseCtx, stopHeartbeat := StartHeartbeat(ctx, job, logger)
+	defer stopHeartbeat()
+	leaseCtx = trace.ContextWithSpan(leaseCtx, span)
+
+	// Local paths include the job ID so that a job requeued while a hung
+	// attempt is still running never shares files with it
+	inputFilePath := filepath.Join(ctx.Config.LocalRawVideoPath, job.ID+"-"+filepath.Base(job.InputKey))
+	outputBasePath := filepath.Join(ctx.Config.LocalProcessedVideoPath, job.ID)
+	startedAt := time.Now()
+	// finish records the attempt, unless the job was cancelled meanwhile
+	finish := func(update func() error) {
+		if errors.Is(context.Cause(leaseCtx), ErrJobCancelled) {
+			abandonCancelledJob(ctx, job, logger)
+			return
+		}
+		err := update()
+		if errors.Is(err, ErrLeaseLost) && jobCancelled(ctx, job.ID) {
+			abandonCancelledJob(ctx, job, logger)
+			return
+		}
+		logLeaseError(logger, err)
+	}
+	fail := func(err error) {
+		finish(func() error {
+			retryAt := time.Now().Add(RetryDelay(ctx.Config.EncodeRetryBackoff, job.FailedCount))
+			attempt := failedAttempt(err, time.Since(startedAt))
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			logger.Error("Encoding attempt failed", "error", err, "retry_at", retryAt)
+			return ctx.Store.MarkJobFailed(job.ID, job.WorkerID, retryAt, ctx.Config.MaxEncodingFailures, attempt)
+		})
+	}
 
 	// Ensure output directory exists before processing
 	if err := os.MkdirAll(outputBasePath, 0755); err != nil {
-		log.Printf("Failed to create output directory: %v", err)
-		UpdateJobStatus(ctx.DB, job.ID, JobStatusEncodingFailed)
+		fail(fmt.Errorf("failed to create output directory: %w", err))
 		return
 	}
 
+	// Cleanup
+	defer func() {
+		if err := os.Remove(inputFilePath); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Failed to remove input file", "path", inputFilePath, "error", err)
+		}
+		if err := os.RemoveAll(outputBasePath); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Failed to remove output directory", "path", outputBasePath, "error", err)
+		}
+	}()
+
 	// Download the input file (Bucket is now stored in Job)
-	if err := DownloadFile(context.Background(), ctx.S3Client, job.InputBucket, job.InputKey, inputFilePath); err != nil {
-		log.Printf("Failed to download file: %v", err)
-		UpdateJobStatus(ctx.DB, job.ID, JobStatusEncodingFailed)
-		IncrementJobFailedCount(ctx.DB, job.ID)
+	err := withSpan(leaseCtx, "download input", func(spanCtx context.Context) error {
+		return DownloadFile(spanCtx, ctx.S3Client, job.InputBucket, job.InputKey, inputFilePath)
+	}, attribute.String("s3.bucket", job.InputBucket), attribute.String("s3.key", job.InputKey))
+	if err != nil {
+		fail(fmt.Errorf("failed to download input: %w", err))
 		return
 	}
 
-	outputFileName := fmt.Sprintf("%dp.mp4", job.Resolution)
-	outputFilePath := filepath.Join(outputBasePath, outputFileName)
-	outputKey := filepath.Join(job.OutputPath, outputFileName)
+	outputFilePath := filepath.Join(outputBasePath, OutputFileName(job))
 
-	err := ConvertVideo(inputFilePath, outputFilePath, job.Resolution, job.Crf)
+	profile := JobProfile(job)
+	_, codec := encodeLabels(profile)
+	err = withSpan(leaseCtx, "ffmpeg", func(spanCtx context.Context) error {
+		return ConvertVideo(spanCtx, logger, inputFilePath, outputFilePath, profile, ctx.Config.EncodeStallTimeout)
+	}, attribute.String("ffmpeg.codec", codec), attribute.Int("ffmpeg.crf", job.Crf), attribute.Bool("ffmpeg.audio_only", job.AudioOnly))
+	// The encoded duration counts towards the tenant's daily quota, so an
+	// output that cannot be measured fails the attempt instead of going free
+	var encodedSeconds float64
 	if err == nil {
-		err = UploadFile(context.Background(), ctx.S3Client, job.OutputBucket, outputFilePath, outputKey)
+		if encodedSeconds, err = ProbeDuration(leaseCtx, outputFilePath); err != nil {
+			err = fmt.Errorf("failed to probe encoded duration: %w", err)
+		}
+	}
+	if err == nil {
+		err = withSpan(leaseCtx, "upload output", func(spanCtx context.Context) error {
+			return UploadFile(spanCtx, ctx.S3Client, job.OutputBucket, outputFilePath, OutputKey(job))
+		}, attribute.String("s3.bucket", job.OutputBucket), attribute.String("s3.key", OutputKey(job)))
+		if err != nil {
+			err = fmt.Errorf("failed to upload output: %w", err)
+		}
 	}
 
 	if err == nil {
-		UpdateJobStatus(ctx.DB, job.ID, JobStatusEncodingSuccess)
+		finish(func() error {
+			attempt := Attempt{Duration: time.Since(startedAt)}
+			logger.Info("Encoded job", "output_key", OutputKey(job), "encoded_seconds", encodedSeconds, "duration", attempt.Duration)
+			return ctx.Store.MarkJobEncoded(job.ID, job.WorkerID, encodedSeconds, attempt)
+		})
 	} else {
-		log.Printf("Failed to process video for job %s: %v", job.ID, err)
-		UpdateJobStatus(ctx.DB, job.ID, JobStatusEncodingFailed)
-		IncrementJobFailedCount(ctx.DB, job.ID)
+		fail(err)
 	}
+}
 
-	// Cleanup
-	if err := os.Remove(inputFilePath); err != nil && !os.IsNotExist(err) {
-		log.Printf("Failed to remove input file: %v", err)
+// failedAttempt describes a failed encoding attempt for the job's history,
+// including ffmpeg's exit code and last words if ffmpeg was what failed
+func failedAttempt(err error, duration time.Duration) Attempt {
+	attempt := Attempt{Error: err.Error(), Duration: duration}
+	var ffmpegErr *FFmpegError
+	if errors.As(err, &ffmpegErr) {
+		attempt.ExitCode = &ffmpegErr.ExitCode
+		attempt.StderrTail = ffmpegErr.StderrTail
 	}
-	if err := os.RemoveAll(outputBasePath); err != nil && !os.IsNotExist(err) {
-		log.Printf("Failed to remove output directory: %v", err)
+	return attempt
+}
+
+// OutputFileName is the name of the file a job encodes to
+func OutputFileName(job *Job) string {
+	if job.AudioOnly {
+		return AudioOutputFileName(job.Audio)
+	}
+	return fmt.Sprintf("%dp.mp4", job.Resolution)
+}
+
+// OutputKey is where a job's output is uploaded within its output bucket
+func OutputKey(job *Job) string {
+	return filepath.Join(job.OutputPath, OutputFileName(job))
+}
+
+// logLeaseError logs a failed job state update
+func logLeaseError(logger *slog.Logger, err error) {
+	if errors.Is(err, ErrLeaseLost) {
+		logger.Warn("Job was requeued while running, discarding result")
+	} else if err != nil {
+		logger.Error("Failed to update job", "error", err)
 	}
 }
 
-// CreateJobsInDB inserts new jobs into the database for each profile in the request payload
-func CreateJobsInDB(db *sql.DB, reqPayload *RequestPayload) error {
-	for _, profile := range reqPayload.Profiles {
+// CreateJobsInDB inserts new jobs into the database for each profile in the
+// request payload. Profiles are validated before anything is written and all
+// jobs are inserted in a single transaction, so either every job of the
+// request is stored or none is. The same transaction checks the tenant's
+// limits, returning a QuotaError if the jobs would exceed them. The jobs
+// remember the trace of ctx, so that their processing can be traced back to
+// the request.
+func CreateJobsInDB(ctx context.Context, store JobStore, tenantID string, reqPayload *RequestPayload, limits TenantLimits) ([]Job, error) {
+	profiles, err := ParseProfiles(reqPayload.Profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	priority := DefaultPriority
+	if reqPayload.Priority != nil {
+		priority = *reqPayload.Priority
+	}
+	var deadline string
+	if reqPayload.Deadline != "" {
+		t, err := time.Parse(time.RFC3339, reqPayload.Deadline)
+		if err != nil {
+			return nil, &ValidationError{Code: ErrCodeValidationFailed, Message: "Invalid deadline",
+				Fields: []FieldError{{Field: "deadline", Code: FieldCodeInvalidFormat, Message: "must be an RFC 3339 timestamp"}}}
+		}
+		deadline = sqlTime(t)
+	}
+
+	traceParent := TraceParent(ctx)
+	var jobs []Job
+	for _, profile := range profiles {
 		job := Job{
 			ID:               uuid.New().String(),
 			VideoID:          reqPayload.VideoId,
@@ -119,19 +456,28 @@ func CreateJobsInDB(db *sql.DB, reqPayload *RequestPayload) error {
 			InputBucket:      reqPayload.Input.Bucket,
 			OutputPath:       reqPayload.Output.BasePath,
 			OutputBucket:     reqPayload.Output.Bucket,
-			Resolution:       0, // Default resolution, will be set later if valid
+			Resolution:       profile.Resolution,
 			Crf:              profile.Crf,
+			Audio:            profile.Audio,
+			AudioOnly:        profile.AudioOnly,
 			CallbackURL:      reqPayload.CallbackURL,
 			Status:           JobStatusEncodingPending,
 			FailedCount:      0,
 			CallbackFailures: 0,
+			IdempotencyKey:   reqPayload.IdempotencyKey,
+			TenantID:         tenantID,
+			Priority:         priority,
+			Deadline:         deadline,
+			TraceParent:      traceParent,
 		}
-		if res, err := strconv.Atoi(profile.Resolution); err == nil {
-			job.Resolution = res
-		}
-		if err := InsertJob(db, job); err != nil {
-			return err
-		}
+		jobs = append(jobs, job)
 	}
-	return nil
+
+	err = withSpan(ctx, "insert jobs", func(context.Context) error {
+		return store.InsertJobsWithinQuota(jobs, limits, time.Now())
+	}, attribute.String("job.video_id", reqPayload.VideoId), attribute.Int("jobs", len(jobs)))
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
 }
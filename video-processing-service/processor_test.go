@@ -1,47 +1,70 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
+func setupTestDB(t *testing.T) *SQLiteStore {
+	t.Helper()
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "jobs.db"), SQLiteConfig{})
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	return store
+}
+
+func setupTestAppContext(t *testing.T) *AppContext {
+	t.Helper()
+	db := setupTestDB(t)
+	t.Cleanup(func() { db.Close() })
+	return &AppContext{
+		Config: Config{
+			MaxRequestBodyBytes: 1 << 20,
+			AuthDisabled:        true,
+			TenantDefaults:      TenantLimits{Weight: 1},
+			MaxCallbackFailures: 3,
+			LeaseDuration:       time.Minute,
+			CallbackTimeout:     time.Second,
+		},
+		Store: db,
+	}
+}
+
 func TestCreateJobsInDB(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
 
 	payload := &RequestPayload{
 		VideoId: "vid123",
-		Input: struct {
-			Key    string
-			Bucket string
-		}{
+		Input: Input{
 			Key:    "input.mp4",
 			Bucket: "input-bucket",
 		},
-		Output: struct {
-			BasePath string
-			Bucket   string
-		}{
+		Output: Output{
 			BasePath: "outputs/",
 			Bucket:   "output-bucket",
 		},
 		CallbackURL: "http://callback",
-		Profiles: []struct {
-			Resolution string
-			Crf        int
-		}{
+		Profiles: []Profile{
 			{Resolution: "720", Crf: 23},
 			{Resolution: "1080", Crf: 20},
 		},
 	}
 
-	err := CreateJobsInDB(db, payload)
+	_, err := CreateJobsInDB(context.Background(), db, DefaultTenantID, payload, TenantLimits{})
 	if err != nil {
 		t.Fatalf("CreateJobsInDB failed: %v", err)
 	}
 
-	jobs, err := GetPendingJobs(db)
+	jobs, err := db.ListJobs(JobFilter{Statuses: []JobStatus{JobStatusEncodingPending}})
 	if err != nil {
-		t.Fatalf("GetPendingJobs failed: %v", err)
+		t.Fatalf("ListJobs failed: %v", err)
 	}
 	if len(jobs) != 2 {
 		t.Errorf("Expected 2 jobs, got %d", len(jobs))
@@ -64,3 +87,82 @@ func TestCreateJobsInDB(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateJobsInDBRejectsInvalidProfiles(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	payload := &RequestPayload{
+		VideoId:     "vid123",
+		Input:       Input{Key: "input.mp4", Bucket: "input-bucket"},
+		Output:      Output{BasePath: "outputs/", Bucket: "output-bucket"},
+		CallbackURL: "http://callback",
+		Profiles: []Profile{
+			{Resolution: "720", Crf: 23},
+			{Resolution: "1080", Crf: 20},
+			{Resolution: "hd", Crf: 99},
+		},
+	}
+
+	_, err := CreateJobsInDB(context.Background(), db, DefaultTenantID, payload, TenantLimits{})
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected ValidationError, got %v", err)
+	}
+	if len(validationErr.Fields) != 2 {
+		t.Errorf("Expected 2 field errors, got %+v", validationErr.Fields)
+	}
+
+	jobs, err := db.ListJobs(JobFilter{Statuses: []JobStatus{JobStatusEncodingPending}})
+	if err != nil {
+		t.Fatalf("ListJobs failed: %v", err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("Expected no jobs to be written, got %d", len(jobs))
+	}
+}
+
+// fakeTool puts an executable shell script named name first on the PATH
+func fakeTool(t *testing.T, name, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatalf("Failed to write fake %s: %v", name, err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestProbeDuration(t *testing.T) {
+	fakeTool(t, "ffprobe", "echo 12.480000")
+	if seconds, err := ProbeDuration(context.Background(), "out.mp4"); err != nil || seconds != 12.48 {
+		t.Errorf("Expected 12.48 seconds, got %v, %v", seconds, err)
+	}
+
+	// An output without a duration must not count as zero encoded seconds
+	fakeTool(t, "ffprobe", "echo N/A")
+	if _, err := ProbeDuration(context.Background(), "out.mp4"); err == nil {
+		t.Error("Expected a missing duration to fail the probe")
+	}
+}
+
+func TestConvertVideoKillsStalledFFmpeg(t *testing.T) {
+	profile := ParsedProfile{Resolution: 720, Crf: 23}
+
+	// exec replaces the shell so that killing ffmpeg closes its stderr
+	fakeTool(t, "ffmpeg", "echo 'Input #0, mov,mp4' >&2; exec sleep 30")
+	started := time.Now()
+	err := ConvertVideo(context.Background(), slog.Default(), "in.mp4", "out.mp4", profile, 200*time.Millisecond)
+	var ffmpegErr *FFmpegError
+	if !errors.Is(err, ErrFFmpegStalled) || !errors.As(err, &ffmpegErr) {
+		t.Fatalf("Expected a stalled ffmpeg error, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("Expected the stalled ffmpeg to be killed promptly, took %s", elapsed)
+	}
+
+	// A slow encode is left alone as long as it keeps reporting progress
+	fakeTool(t, "ffmpeg", `for i in 1 2 3 4 5 6; do printf 'frame=%d speed=0.1x\r' $i >&2; sleep 0.1; done`)
+	if err := ConvertVideo(context.Background(), slog.Default(), "in.mp4", "out.mp4", profile, 300*time.Millisecond); err != nil {
+		t.Errorf("Expected a progressing ffmpeg to finish, got %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// retentionPolicy is how long finished jobs with an outcome are kept. The
+// outcome, not the final status, decides: a failed encode whose callback
+// was delivered ends as callback_success but is still a failure.
+type retentionPolicy struct {
+	outcome string
+	keep    time.Duration
+}
+
+// retentionPolicies returns the configured policies, skipping outcomes whose
+// jobs are kept forever
+func retentionPolicies(cfg RetentionConfig) []retentionPolicy {
+	var policies []retentionPolicy
+	for _, p := range []retentionPolicy{
+		{JobOutcomeSucceeded, cfg.Succeeded},
+		{JobOutcomeFailed, cfg.Failed},
+		{JobOutcomeCancelled, cfg.Cancelled},
+	} {
+		if p.keep > 0 {
+			policies = append(policies, p)
+		}
+	}
+	return policies
+}
+
+// Delete finished jobs together with their history, returning how many were
+// deleted. Jobs that are not finished are left alone.
+func (s *sqlStore) PurgeJobs(jobIDs []string) (int64, error) {
+	if len(jobIDs) == 0 {
+		return 0, nil
+	}
+	var purged int64
+	err := s.inTx(func(tx *sql.Tx) error {
+		args := make([]interface{}, 0, len(jobIDs)+len(finishedJobStatuses))
+		for _, id := range jobIDs {
+			args = append(args, id)
+		}
+		for _, status := range finishedJobStatuses {
+			args = append(args, int(status))
+		}
+		res, err := tx.Exec(s.rebind(`DELETE FROM jobs WHERE id IN (`+placeholders(len(jobIDs))+`)
+			AND status IN (`+placeholders(len(finishedJobStatuses))+`)`), args...)
+		if err != nil {
+			return err
+		}
+		if purged, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		// Only the history of the jobs actually deleted goes with them
+		_, err = tx.Exec(s.rebind(`DELETE FROM job_events WHERE job_id IN (`+placeholders(len(jobIDs))+`)
+			AND NOT EXISTS (SELECT 1 FROM jobs WHERE jobs.id = job_events.job_id)`), args[:len(jobIDs)]...)
+		return err
+	})
+	return purged, err
+}
+
+// ArchivedJob is a line of a job archive: every column of the job and its
+// history
+type ArchivedJob struct {
+	ID               string             `json:"id"`
+	TenantID         string             `json:"tenantId"`
+	VideoID          string             `json:"videoId"`
+	InputBucket      string             `json:"inputBucket"`
+	InputKey         string             `json:"inputKey"`
+	OutputBucket     string             `json:"outputBucket"`
+	OutputPath       string             `json:"outputPath"`
+	Resolution       int                `json:"resolution"`
+	Crf              int                `json:"crf"`
+	Audio            *AudioProfile      `json:"audio,omitempty"`
+	AudioOnly        bool               `json:"audioOnly,omitempty"`
+	CallbackURL      string             `json:"callbackUrl"`
+	Status           string             `json:"status"`
+	Outcome          string             `json:"outcome,omitempty"`
+	FailedCount      int                `json:"failedCount"`
+	CallbackFailures int                `json:"callbackFailures"`
+	IdempotencyKey   string             `json:"idempotencyKey,omitempty"`
+	EncodedSeconds   float64            `json:"encodedSeconds"`
+	Priority         int                `json:"priority"`
+	Deadline         string             `json:"deadline,omitempty"`
+	TraceParent      string             `json:"traceParent,omitempty"`
+	CreatedAt        string             `json:"createdAt"`
+	UpdatedAt        string             `json:"updatedAt"`
+	StartedAt        string             `json:"startedAt,omitempty"`
+	FinishedAt       string             `json:"finishedAt,omitempty"`
+	Events           []JobEventResponse `json:"events"`
+}
+
+// NewArchivedJob converts a job and its history to an archive line
+func NewArchivedJob(job *Job, events []JobEvent) ArchivedJob {
+	return ArchivedJob{
+		ID:               job.ID,
+		TenantID:         job.TenantID,
+		VideoID:          job.VideoID,
+		InputBucket:      job.InputBucket,
+		InputKey:         job.InputKey,
+		OutputBucket:     job.OutputBucket,
+		OutputPath:       job.OutputPath,
+		Resolution:       job.Resolution,
+		Crf:              job.Crf,
+		Audio:            job.Audio,
+		AudioOnly:        job.AudioOnly,
+		CallbackURL:      job.CallbackURL,
+		Status:           job.Status.String(),
+		Outcome:          job.Outcome,
+		FailedCount:      job.FailedCount,
+		CallbackFailures: job.CallbackFailures,
+		IdempotencyKey:   job.IdempotencyKey,
+		EncodedSeconds:   job.EncodedSeconds,
+		Priority:         job.Priority,
+		Deadline:         job.Deadline,
+		TraceParent:      job.TraceParent,
+		CreatedAt:        job.CreatedAt,
+		UpdatedAt:        job.UpdatedAt,
+		StartedAt:        job.StartedAt,
+		FinishedAt:       job.FinishedAt,
+		Events:           NewJobEventResponses(events),
+	}
+}
+
+// WriteJobArchive writes jobs and their history to w as gzipped JSON lines
+func WriteJobArchive(w io.Writer, store JobStore, jobs []Job) error {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	for i := range jobs {
+		events, err := store.ListJobEvents(jobs[i].ID)
+		if err != nil {
+			return fmt.Errorf("failed to read history of job %s: %w", jobs[i].ID, err)
+		}
+		if err := enc.Encode(NewArchivedJob(&jobs[i], events)); err != nil {
+			return err
+		}
+	}
+	return gz.Close()
+}
+
+// archiveJobs uploads an archive of the jobs to the archive bucket, under a
+// key named after their outcome and the time
+func archiveJobs(ctx *AppContext, outcome string, jobs []Job, now time.Time) error {
+	cfg := ctx.Config.Retention
+	f, err := os.CreateTemp("", "job-archive-*.jsonl.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := WriteJobArchive(f, ctx.Store, jobs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s%s/%s/%s-%s.jsonl.gz", cfg.ArchivePrefix, outcome, now.UTC().Format("2006/01/02"),
+		now.UTC().Format("20060102T150405Z"), jobs[0].ID)
+	return UploadFile(context.Background(), ctx.S3Client, cfg.ArchiveBucket, f.Name(), key)
+}
+
+// PurgeExpiredJobs deletes the finished jobs that have outlived the
+// retention of their outcome, in batches, archiving each batch first if an archive bucket
+// is configured. A batch that fails to archive is kept, and stops the run.
+func PurgeExpiredJobs(ctx *AppContext, now time.Time) (int64, error) {
+	cfg := ctx.Config.Retention
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	var total int64
+	for _, policy := range retentionPolicies(cfg) {
+		filter := JobFilter{
+			Statuses:      finishedJobStatuses,
+			Outcomes:      []string{policy.outcome},
+			UpdatedBefore: now.Add(-policy.keep),
+			Sort:          JobSort{Column: "updated_at"},
+			Limit:         batchSize,
+		}
+		for {
+			jobs, err := ctx.Store.ListJobs(filter)
+			if err != nil {
+				return total, err
+			}
+			if len(jobs) == 0 {
+				break
+			}
+			if cfg.ArchiveBucket != "" {
+				if err := archiveJobs(ctx, policy.outcome, jobs, now); err != nil {
+					return total, fmt.Errorf("failed to archive %s jobs: %w", policy.outcome, err)
+				}
+				jobsArchived.Add(float64(len(jobs)))
+			}
+			ids := make([]string, len(jobs))
+			for i, job := range jobs {
+				ids[i] = job.ID
+			}
+			purged, err := ctx.Store.PurgeJobs(ids)
+			if err != nil {
+				return total, err
+			}
+			jobsPurged.WithLabelValues(policy.outcome).Add(float64(purged))
+			total += purged
+			if len(jobs) < batchSize {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+// StartJanitor periodically purges jobs past their retention. It does
+// nothing if every job is kept forever.
+func StartJanitor(ctx *AppContext) {
+	if len(retentionPolicies(ctx.Config.Retention)) == 0 {
+		return
+	}
+	go func() {
+		for {
+			purged, err := PurgeExpiredJobs(ctx, time.Now())
+			if err != nil {
+				slog.Error("Failed to purge expired jobs", "purged", purged, "error", err)
+			} else if purged > 0 {
+				slog.Info("Purged expired jobs", "purged", purged)
+			}
+			time.Sleep(ctx.Config.Retention.Interval)
+		}
+	}()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestPurgeExpiredJobsKeepsJobsWithinRetention(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Config.Retention = RetentionConfig{Succeeded: time.Hour, Cancelled: 3 * time.Hour, BatchSize: 2}
+	jobs := submitTestJobs(t, ctx, DefaultTenantID, 6)
+	for i, final := range []struct {
+		status  JobStatus
+		outcome string
+	}{
+		{JobStatusCallbackSuccess, JobOutcomeSucceeded},
+		{JobStatusCallbackSuccess, JobOutcomeSucceeded},
+		{JobStatusCallbackSuccess, JobOutcomeSucceeded},
+		{JobStatusCallbackFailed, JobOutcomeSucceeded},
+		{JobStatusCancelled, JobOutcomeCancelled},
+		// A failed encode whose failure callback was delivered
+		{JobStatusCallbackSuccess, JobOutcomeFailed},
+	} {
+		if _, err := ctx.Store.(*SQLiteStore).db.Exec(`UPDATE jobs SET status = ?, outcome = ? WHERE id = ?`, int(final.status), final.outcome, jobs[i].ID); err != nil {
+			t.Fatalf("Failed to finish job %d: %v", i, err)
+		}
+	}
+
+	// Two hours on, succeeded jobs have expired, in batches, including the
+	// one whose callback failed, while failed jobs are kept forever and
+	// cancelled ones for longer
+	purged, err := PurgeExpiredJobs(ctx, time.Now().Add(2*time.Hour))
+	if err != nil || purged != 4 {
+		t.Fatalf("Expected 4 jobs to be purged, got %d, %v", purged, err)
+	}
+	for i, job := range jobs {
+		_, err := ctx.Store.GetJob(job.ID)
+		if kept := err == nil; kept != (i >= 4) {
+			t.Errorf("Expected job %d kept to be %v, got %v", i, i >= 4, err)
+		}
+	}
+	if events, _ := ctx.Store.ListJobEvents(jobs[0].ID); len(events) != 0 {
+		t.Errorf("Expected history of purged job to be deleted, got %+v", events)
+	}
+	if events, _ := ctx.Store.ListJobEvents(jobs[5].ID); len(events) == 0 {
+		t.Error("Expected history of kept job to remain")
+	}
+
+	if purged, err := PurgeExpiredJobs(ctx, time.Now().Add(4*time.Hour)); err != nil || purged != 1 {
+		t.Errorf("Expected the cancelled job to be purged, got %d, %v", purged, err)
+	}
+	if err := ctx.Store.(*SQLiteStore).Vacuum(); err != nil {
+		t.Errorf("Vacuum failed: %v", err)
+	}
+}
+
+func TestWriteJobArchiveIncludesHistory(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	jobs := submitTestJobs(t, ctx, DefaultTenantID, 2)
+
+	var buf bytes.Buffer
+	if err := WriteJobArchive(&buf, ctx.Store, jobs); err != nil {
+		t.Fatalf("WriteJobArchive failed: %v", err)
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Archive is not gzipped: %v", err)
+	}
+	scanner := bufio.NewScanner(gz)
+	var archived []ArchivedJob
+	for scanner.Scan() {
+		var job ArchivedJob
+		if err := json.Unmarshal(scanner.Bytes(), &job); err != nil {
+			t.Fatalf("Archive line is not JSON: %v", err)
+		}
+		archived = append(archived, job)
+	}
+	if len(archived) != 2 || archived[1].ID != jobs[1].ID || archived[1].InputKey != "input.mp4" || len(archived[1].Events) == 0 {
+		t.Errorf("Unexpected archive %+v", archived)
+	}
+}
@@ -7,6 +7,7 @@ import (
     "io"
     "os"
     "path/filepath"
+    "time"
 
     "github.com/aws/aws-sdk-go-v2/aws"
     "github.com/aws/aws-sdk-go-v2/config"
@@ -40,7 +41,11 @@ func NewS3Client(cfg S3Config) (*s3.Client, error) {
 }
 
 // DownloadFile downloads an object from S3 to a local file.
-func DownloadFile(ctx context.Context, client *s3.Client, bucket, key, localPath string) error {
+func DownloadFile(ctx context.Context, client *s3.Client, bucket, key, localPath string) (err error) {
+    var n int64
+    start := time.Now()
+    defer func() { observeS3Transfer("download", n, time.Since(start), err) }()
+
     if bucket == "" || key == "" || localPath == "" {
         return errors.New("invalid arguments: bucket, key, and localPath are required")
     }
@@ -69,12 +74,16 @@ func DownloadFile(ctx context.Context, client *s3.Client, bucket, key, localPath
     }
     defer f.Close()
 
-    _, err = io.Copy(f, out.Body)
+    n, err = io.Copy(f, out.Body)
     return err
 }
 
 // UploadFile uploads a local file to S3.
-func UploadFile(ctx context.Context, client *s3.Client, bucket, localPath, key string) error {
+func UploadFile(ctx context.Context, client *s3.Client, bucket, localPath, key string) (err error) {
+    var n int64
+    start := time.Now()
+    defer func() { observeS3Transfer("upload", n, time.Since(start), err) }()
+
     if bucket == "" || localPath == "" || key == "" {
         return errors.New("invalid arguments: bucket, localPath, and key are required")
     }
@@ -93,5 +102,20 @@ func UploadFile(ctx context.Context, client *s3.Client, bucket, localPath, key s
     if err != nil {
         return fmt.Errorf("failed to upload file: %s to bucket: %s with key: %s. Error: %w", localPath, bucket, key, err)
     }
+    if info, statErr := f.Stat(); statErr == nil {
+        n = info.Size()
+    }
+    return nil
+}
+
+// DeleteFile deletes an object from S3. Deleting a missing object succeeds.
+func DeleteFile(ctx context.Context, client *s3.Client, bucket, key string) error {
+    _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+        Bucket: aws.String(bucket),
+        Key:    aws.String(key),
+    })
+    if err != nil {
+        return fmt.Errorf("failed to delete key: %s from bucket: %s. Error: %w", key, bucket, err)
+    }
     return nil
-}
\ No newline at end of file
+}
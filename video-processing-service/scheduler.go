@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// How often idle workers look for work that became claimable without a
+// notification, such as retries whose backoff has expired
+const workerPollInterval = 2 * time.Second
+
+// DequeueOptions controls which jobs are claimable and in what order, and
+// who the claimed job is leased to
+type DequeueOptions struct {
+	TenantDefaults TenantLimits
+	AgingInterval  time.Duration
+	MaxFailures    int
+	WorkerID       string
+	LeaseDuration  time.Duration
+}
+
+// schedulableJobsQuery selects the claimable encoding jobs in the order
+// workers should take them, implementing weighted fair queuing across tenants.
+//
+// Each tenant is entitled to a share of the encoder workers proportional to
+// its weight. Jobs of the tenant currently using the smallest fraction of its
+// share (running encodes divided by weight) come first, ties going to the
+// tenant that was dispatched to least recently, so a tenant with thousands of
+// queued jobs cannot starve one with a handful. Tenants already at their
+// concurrent encode limit are left out entirely.
+//
+// Within a tenant, jobs are ordered by effective priority, then deadline
+// (jobs without one last), then submission time. The effective priority is
+// the job's priority plus one for every agingInterval it has waited, capped
+// at the maximum priority, so low-priority work eventually competes with
+// urgent jobs on age alone and cannot be starved by a steady stream of them.
+//
+// Jobs waiting out a retry backoff or that have used up their encoding
+// attempts are not claimable.
+func (s *sqlStore) schedulableJobsQuery(columns string, opts DequeueOptions, now time.Time) (string, []interface{}) {
+	agingSeconds := int64(opts.AgingInterval / time.Second)
+	if agingSeconds < 1 {
+		agingSeconds = 1
+	}
+	query := `
+		SELECT ` + columns + `
+		FROM jobs j
+		LEFT JOIN tenants t ON t.id = j.tenant_id
+		LEFT JOIN (
+			SELECT tenant_id, COUNT(*) AS running FROM jobs WHERE status = ? GROUP BY tenant_id
+		) r ON r.tenant_id = j.tenant_id
+		WHERE j.status IN (?, ?)
+		  AND j.next_attempt_at <= ?
+		  AND (? <= 0 OR j.failed_count < ?)
+		  AND (COALESCE(t.max_concurrent_encodes, ?) <= 0
+		       OR COALESCE(r.running, 0) < COALESCE(t.max_concurrent_encodes, ?))
+		ORDER BY CAST(COALESCE(r.running, 0) AS REAL) / ` + s.dialect.greatest + `(COALESCE(t.weight, ?), 1),
+		         COALESCE(t.last_dispatched_at, ''),
+		         ` + s.dialect.least + `(j.priority + ` + s.dialect.elapsedSeconds("j.created_at", "?") + ` / ?, ?) DESC,
+		         j.deadline IS NULL, j.deadline,
+		         j.created_at, j.id`
+	args := []interface{}{
+		int(JobStatusEncodingRunning),
+		int(JobStatusEncodingPending), int(JobStatusEncodingFailed),
+		sqlTime(now),
+		opts.MaxFailures, opts.MaxFailures,
+		opts.TenantDefaults.MaxConcurrentEncodes, opts.TenantDefaults.MaxConcurrentEncodes,
+		opts.TenantDefaults.Weight,
+		sqlTime(now), agingSeconds, maxPriority,
+	}
+	return query, args
+}
+
+// DequeueJob atomically selects and claims the next encoding job in a single
+// statement, leasing it to opts.WorkerID for opts.LeaseDuration. Returns nil
+// if no job is claimable. The tenant's dispatch time and the claim in the
+// job's history are recorded in the same transaction. Where the database has
+// row locks, concurrent workers skip the candidate another worker is claiming
+// rather than queueing behind it.
+func (s *sqlStore) DequeueJob(opts DequeueOptions, now time.Time) (*Job, error) {
+	// A claim that lost the race for its tenant's last free slot is retried,
+	// by which time the winner has committed and the tenant is excluded
+	for attempt := 0; attempt < 3; attempt++ {
+		job, overLimit, err := s.dequeueJob(opts, now)
+		if !overLimit {
+			return job, err
+		}
+	}
+	return nil, nil
+}
+
+// dequeueJob makes one attempt at claiming a job, reporting overLimit when
+// the claim was rolled back because it would exceed the tenant's
+// MaxConcurrentEncodes.
+func (s *sqlStore) dequeueJob(opts DequeueOptions, now time.Time) (job *Job, overLimit bool, err error) {
+	candidate, candidateArgs := s.schedulableJobsQuery("j.id", opts, now)
+	args := []interface{}{int(JobStatusEncodingRunning), sqlTime(now), opts.WorkerID, sqlTime(now.Add(opts.LeaseDuration))}
+	args = append(args, candidateArgs...)
+	args = append(args, int(JobStatusEncodingPending), int(JobStatusEncodingFailed))
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(s.rebind(`
+		UPDATE jobs SET status = ?, started_at = ?, worker_id = ?, lease_expires_at = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = (`+candidate+` LIMIT 1`+s.dialect.lockClause("j")+`)
+		  AND status IN (?, ?)
+		RETURNING `+jobColumns), args...)
+	if err != nil {
+		return nil, false, err
+	}
+	jobs, err := scanJobs(rows)
+	rows.Close()
+	if err != nil {
+		return nil, false, err
+	}
+	if len(jobs) == 0 {
+		return nil, false, nil
+	}
+
+	// The running count in the candidate query is read without locks, so two
+	// workers can each see a free slot. Recounting under the tenant lock lets
+	// only the first claim through. Databases without one have a single
+	// writer, whose claims cannot race.
+	if s.dialect.tenantLock != "" {
+		over, err := s.exceedsConcurrencyLimit(tx, jobs[0].TenantID, opts.TenantDefaults.MaxConcurrentEncodes)
+		if err != nil || over {
+			return nil, over, err
+		}
+	}
+
+	if err := s.recordTenantDispatch(tx, jobs[0].TenantID, now); err != nil {
+		return nil, false, err
+	}
+	if err := s.insertJobEvent(tx, JobEvent{JobID: jobs[0].ID, Type: JobEventClaimed, Status: JobStatusEncodingRunning,
+		WorkerID: opts.WorkerID, Attempt: jobs[0].FailedCount + 1}); err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return &jobs[0], false, nil
+}
+
+// exceedsConcurrencyLimit takes the tenant lock and reports whether the
+// tenant has more running jobs than its MaxConcurrentEncodes allows, counting
+// the claim made in tx.
+func (s *sqlStore) exceedsConcurrencyLimit(tx *sql.Tx, tenantID string, defaultLimit int) (bool, error) {
+	if _, err := tx.Exec(s.rebind(s.dialect.tenantLock), tenantID); err != nil {
+		return false, err
+	}
+	var running int
+	var limit sql.NullInt64
+	err := tx.QueryRow(s.rebind(`SELECT COUNT(*), (SELECT max_concurrent_encodes FROM tenants WHERE id = ?)
+		FROM jobs WHERE tenant_id = ? AND status = ?`),
+		tenantID, tenantID, int(JobStatusEncodingRunning)).Scan(&running, &limit)
+	if err != nil {
+		return false, err
+	}
+	max := defaultLimit
+	if limit.Valid {
+		max = int(limit.Int64)
+	}
+	return max > 0 && running > max, nil
+}
+
+// recordTenantDispatch notes that a job of the tenant was just claimed, so
+// that the tenant goes to the back of the round-robin among equal shares.
+func (s *sqlStore) recordTenantDispatch(tx *sql.Tx, tenantID string, now time.Time) error {
+	_, err := tx.Exec(s.rebind(`INSERT INTO tenants (id, last_dispatched_at) VALUES (?, ?)
+		ON CONFLICT(id) DO UPDATE SET last_dispatched_at = excluded.last_dispatched_at`),
+		tenantID, sqlTimeNano(now))
+	return err
+}
+
+// JobNotifier wakes idle workers as soon as new work is stored instead of
+// leaving them to find it on their next poll. A nil notifier never wakes
+// anyone, so workers fall back to polling.
+type JobNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// NewJobNotifier creates a notifier
+func NewJobNotifier() *JobNotifier {
+	return &JobNotifier{ch: make(chan struct{})}
+}
+
+// Wait returns a channel that is closed by the next call to Notify. Workers
+// must obtain it before looking for work so that no notification is missed.
+func (n *JobNotifier) Wait() <-chan struct{} {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch
+}
+
+// Notify wakes every worker currently waiting
+func (n *JobNotifier) Notify() {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
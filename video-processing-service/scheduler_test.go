@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func submitTestJobs(t *testing.T, ctx *AppContext, tenantID string, count int) []Job {
+	t.Helper()
+	var profiles []Profile
+	for i := 0; i < count; i++ {
+		profiles = append(profiles, Profile{Resolution: fmt.Sprintf("%d", 240+i), Crf: 23})
+	}
+	jobs, _, err := SubmitJobs(context.Background(), ctx, tenantID, &RequestPayload{
+		VideoId:     tenantID + "-video",
+		Input:       Input{Bucket: "input-bucket", Key: "input.mp4"},
+		Output:      Output{Bucket: "output-bucket", BasePath: "outputs/"},
+		Profiles:    profiles,
+		CallbackURL: "http://callback.example.com/done",
+	})
+	if err != nil {
+		t.Fatalf("SubmitJobs failed: %v", err)
+	}
+	return jobs
+}
+
+func testDequeueOptions(ctx *AppContext) DequeueOptions {
+	return DequeueOptions{
+		TenantDefaults: ctx.Config.TenantDefaults,
+		AgingInterval:  time.Hour,
+		MaxFailures:    3,
+		WorkerID:       "test-worker",
+		LeaseDuration:  ctx.Config.LeaseDuration,
+	}
+}
+
+func TestSchedulableJobsSharesWorkersAcrossTenants(t *testing.T) {
+	ctx := setupTestAppContext(t)
+
+	bulk := submitTestJobs(t, ctx, "bulk", 10)
+	small := submitTestJobs(t, ctx, "small", 1)
+
+	// The bulk tenant already has an encode running, so the small tenant goes next
+	if ok, err := ctx.Store.(testStore).claimJob(bulk[0].ID); err != nil || !ok {
+		t.Fatalf("claimJob failed: %v", err)
+	}
+	jobs, err := ctx.Store.(testStore).schedulableJobs(testDequeueOptions(ctx), time.Now())
+	if err != nil {
+		t.Fatalf("schedulableJobs failed: %v", err)
+	}
+	if jobs[0].ID != small[0].ID {
+		t.Errorf("Expected small tenant's job first, got tenant %s", jobs[0].TenantID)
+	}
+
+	// A weight of 2 entitles the bulk tenant to twice the running encodes
+	weight := 2
+	if err := ctx.Store.UpsertTenantSettings("bulk", TenantSettings{Weight: &weight}); err != nil {
+		t.Fatalf("UpsertTenantSettings failed: %v", err)
+	}
+	if ok, err := ctx.Store.(testStore).claimJob(small[0].ID); err != nil || !ok {
+		t.Fatalf("claimJob failed: %v", err)
+	}
+	jobs, err = ctx.Store.(testStore).schedulableJobs(testDequeueOptions(ctx), time.Now())
+	if err != nil {
+		t.Fatalf("schedulableJobs failed: %v", err)
+	}
+	if len(jobs) != 9 || jobs[0].TenantID != "bulk" {
+		t.Errorf("Expected 9 bulk jobs to remain schedulable, got %d", len(jobs))
+	}
+
+	// Tenants at their concurrency limit are not scheduled at all
+	limit := 1
+	if err := ctx.Store.UpsertTenantSettings("bulk", TenantSettings{MaxConcurrentEncodes: &limit}); err != nil {
+		t.Fatalf("UpsertTenantSettings failed: %v", err)
+	}
+	jobs, err = ctx.Store.(testStore).schedulableJobs(testDequeueOptions(ctx), time.Now())
+	if err != nil {
+		t.Fatalf("schedulableJobs failed: %v", err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("Expected no schedulable jobs, got %d", len(jobs))
+	}
+}
+
+func TestProcessVideoHandlerRejectsOverQuota(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Config.TenantDefaults.MaxQueuedJobs = 2
+	handler := ProcessVideoHandler(ctx)
+
+	payload := RequestPayload{
+		VideoId:     "vid123",
+		Input:       Input{Bucket: "input-bucket", Key: "input.mp4"},
+		Output:      Output{Bucket: "output-bucket", BasePath: "outputs/"},
+		Profiles:    []Profile{{Resolution: "720", Crf: 23}, {Resolution: "1080", Crf: 20}},
+		CallbackURL: "http://callback.example.com/done",
+	}
+	if rec := postProcessVideo(t, handler, payload, nil); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 within quota, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := postProcessVideo(t, handler, payload, nil); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 over quota, got %d", rec.Code)
+	}
+}
+
+func TestDailyEncodedMinutesIsASoftLimit(t *testing.T) {
+	limits := TenantLimits{MaxDailyEncodedMinutes: 10}
+
+	// Queued jobs are not counted, so any minutes left admit a request
+	if err := limits.quotaError(TenantUsage{EncodedMinutesToday: 9.99, QueuedJobs: 50}, 20); err != nil {
+		t.Errorf("Expected submissions to be accepted below the limit, got %v", err)
+	}
+	for _, used := range []float64{10, 12.5} {
+		var quotaErr *QuotaError
+		if err := limits.quotaError(TenantUsage{EncodedMinutesToday: used}, 1); !errors.As(err, &quotaErr) {
+			t.Errorf("Expected a QuotaError with %v minutes used, got %v", used, err)
+		}
+	}
+}
+
+func TestSchedulableJobsOrdersByPriorityDeadlineAndAge(t *testing.T) {
+	ctx := setupTestAppContext(t)
+
+	submit := func(videoID string, priority int, deadline string) string {
+		jobs, _, err := SubmitJobs(context.Background(), ctx, DefaultTenantID, &RequestPayload{
+			VideoId:     videoID,
+			Input:       Input{Bucket: "input-bucket", Key: "input.mp4"},
+			Output:      Output{Bucket: "output-bucket", BasePath: "outputs/"},
+			Profiles:    []Profile{{Resolution: "720", Crf: 23}},
+			CallbackURL: "http://callback.example.com/done",
+			Priority:    &priority,
+			Deadline:    deadline,
+		})
+		if err != nil {
+			t.Fatalf("SubmitJobs failed: %v", err)
+		}
+		return jobs[0].VideoID
+	}
+	submit("backfill", 1, "")
+	submit("normal", 5, "")
+	submit("normal-due-later", 5, "2030-01-02T00:00:00Z")
+	submit("normal-due-soon", 5, "2030-01-01T00:00:00Z")
+	submit("breaking", 9, "")
+
+	order := func(now time.Time) []string {
+		jobs, err := ctx.Store.(testStore).schedulableJobs(testDequeueOptions(ctx), now)
+		if err != nil {
+			t.Fatalf("schedulableJobs failed: %v", err)
+		}
+		var ids []string
+		for _, job := range jobs {
+			ids = append(ids, job.VideoID)
+		}
+		return ids
+	}
+
+	got := fmt.Sprint(order(time.Now()))
+	want := fmt.Sprint([]string{"breaking", "normal-due-soon", "normal-due-later", "normal", "backfill"})
+	if got != want {
+		t.Errorf("Expected order %s, got %s", want, got)
+	}
+
+	// After waiting long enough every job has aged up to the maximum priority,
+	// and with equal effective priorities the deadlines decide
+	got = fmt.Sprint(order(time.Now().Add(20 * time.Hour))[:2])
+	want = fmt.Sprint([]string{"normal-due-soon", "normal-due-later"})
+	if got != want {
+		t.Errorf("Expected aged order to start with %s, got %s", want, got)
+	}
+}
+
+func TestDequeueJobClaimsOnceAndSkipsBackoff(t *testing.T) {
+	ctx := setupTestAppContext(t)
+	ctx.Notifier = NewJobNotifier()
+	opts := testDequeueOptions(ctx)
+
+	wake := ctx.Notifier.Wait()
+	jobs := submitTestJobs(t, ctx, DefaultTenantID, 2)
+	select {
+	case <-wake:
+	default:
+		t.Error("Expected submission to notify waiting workers")
+	}
+
+	claimed := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		job, err := ctx.Store.DequeueJob(opts, time.Now())
+		if err != nil || job == nil {
+			t.Fatalf("DequeueJob returned %v, %v", job, err)
+		}
+		if job.Status != JobStatusEncodingRunning || claimed[job.ID] {
+			t.Errorf("Unexpected dequeued job %+v", job)
+		}
+		claimed[job.ID] = true
+	}
+	if job, err := ctx.Store.DequeueJob(opts, time.Now()); err != nil || job != nil {
+		t.Fatalf("Expected empty queue, got %v, %v", job, err)
+	}
+
+	// A failed job is only claimable again once its backoff has passed
+	if err := ctx.Store.MarkJobFailed(jobs[0].ID, opts.WorkerID, time.Now().Add(time.Minute), 3, Attempt{Error: "encode failed"}); err != nil {
+		t.Fatalf("MarkJobFailed failed: %v", err)
+	}
+	if job, _ := ctx.Store.DequeueJob(opts, time.Now()); job != nil {
+		t.Errorf("Expected job in backoff not to be claimed")
+	}
+	job, err := ctx.Store.DequeueJob(opts, time.Now().Add(2*time.Minute))
+	if err != nil || job == nil || job.ID != jobs[0].ID || job.FailedCount != 1 {
+		t.Errorf("Expected retried job after backoff, got %+v, %v", job, err)
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"database/sql"
-	"log"
-
-	_ "github.com/mattn/go-sqlite3"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // JobStatus type and constants
@@ -19,178 +21,522 @@ const (
 	JobStatusCallbackInProgress JobStatus = 5
 	JobStatusCallbackFailed     JobStatus = 6
 	JobStatusCallbackSuccess    JobStatus = 7
+	JobStatusCancelled          JobStatus = 8
 )
 
 // Struct for job
 type Job struct {
-	ID               string
-	VideoID          string
-	InputKey         string
-	InputBucket      string
-	OutputPath       string
-	OutputBucket     string
-	Resolution       int
-	Crf              int
+	ID           string
+	VideoID      string
+	InputKey     string
+	InputBucket  string
+	OutputPath   string
+	OutputBucket string
+	Resolution   int
+	Crf          int
+	// Audio is nil if the job leaves audio to ffmpeg
+	Audio *AudioProfile
+	// AudioOnly jobs have no resolution and encode only the audio
+	AudioOnly        bool
 	CallbackURL      string
 	CreatedAt        string
 	UpdatedAt        string
 	Status           JobStatus
 	FailedCount      int
 	CallbackFailures int // new field for tracking callback failures
+	IdempotencyKey   string
+	TenantID         string
+	EncodedSeconds   float64
+	StartedAt        string
+	FinishedAt       string
+	Priority         int
+	Deadline         string
+	WorkerID         string
+	LeaseExpiresAt   string
+	// Outcome is set once encoding has finished, successfully or for good
+	Outcome string
+	// TraceParent is the W3C trace context of the submitting request
+	TraceParent string
 }
 
-// Initialize DB and schema
-func InitDB(filepath string) *sql.DB {
-	log.Printf("Initializing database at %s", filepath)
-	db, err := sql.Open("sqlite3", filepath)
-	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
-	}
-
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS jobs (
-		id TEXT PRIMARY KEY,
-		video_id TEXT NOT NULL,
-		input_key TEXT NOT NULL,
-		input_bucket TEXT NOT NULL,
-		output_path TEXT NOT NULL,
-		output_bucket TEXT NOT NULL,
-		resolution INTEGER,
-		crf INTEGER,
-		callback_url TEXT NOT NULL,
-		status INTEGER NOT NULL,
-		failed_count INTEGER DEFAULT 0,
-		callback_failures INTEGER DEFAULT 0,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-	`
-
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
-		log.Fatalf("Failed to create table: %v", err)
+// String returns the name of the status as exposed by the API
+func (s JobStatus) String() string {
+	switch s {
+	case JobStatusEncodingPending:
+		return "encoding_pending"
+	case JobStatusEncodingRunning:
+		return "encoding_running"
+	case JobStatusEncodingFailed:
+		return "encoding_failed"
+	case JobStatusEncodingSuccess:
+		return "encoding_success"
+	case JobStatusCallbackPending:
+		return "callback_pending"
+	case JobStatusCallbackInProgress:
+		return "callback_in_progress"
+	case JobStatusCallbackFailed:
+		return "callback_failed"
+	case JobStatusCallbackSuccess:
+		return "callback_success"
+	case JobStatusCancelled:
+		return "cancelled"
 	}
-
-	return db
+	return "unknown"
 }
 
-// Insert new job
-func InsertJob(db *sql.DB, job Job) error {
-	_, err := db.Exec(`INSERT INTO jobs (id, video_id, input_key, input_bucket, output_path, output_bucket, resolution, crf, callback_url, status, failed_count, callback_failures) 
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		job.ID, job.VideoID, job.InputKey, job.InputBucket, job.OutputPath, job.OutputBucket, job.Resolution, job.Crf, job.CallbackURL, int(job.Status), job.FailedCount, job.CallbackFailures)
-	return err
+// ParseJobStatus returns the status with the given API name
+func ParseJobStatus(name string) (JobStatus, bool) {
+	for status := JobStatusEncodingPending; status <= JobStatusCancelled; status++ {
+		if status.String() == name {
+			return status, true
+		}
+	}
+	return 0, false
 }
 
-// Update job status
-func UpdateJobStatus(db *sql.DB, jobID string, status JobStatus) error {
-	_, err := db.Exec(`UPDATE jobs SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, int(status), jobID)
-	return err
+// Columns selected by every job query, in the order scanJobs expects
+var jobColumnNames = []string{
+	"id", "video_id", "input_key", "input_bucket", "output_path", "output_bucket", "resolution", "crf", "callback_url",
+	"status", "failed_count", "callback_failures", "idempotency_key", "tenant_id", "encoded_seconds",
+	"created_at", "updated_at", "started_at", "finished_at", "priority", "deadline",
+	"worker_id", "lease_expires_at", "outcome", "trace_parent", "audio", "audio_only",
 }
 
-// Update job failed count
-func IncrementJobFailedCount(db *sql.DB, jobID string) error {
-	_, err := db.Exec(`UPDATE jobs SET failed_count = failed_count + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, jobID)
-	return err
-}
+var jobColumns = strings.Join(jobColumnNames, ", ")
 
-// Fetch pending jobs (for worker loop)
-func GetPendingJobs(db *sql.DB) ([]Job, error) {
-	rows, err := db.Query(`SELECT id, video_id, input_key, input_bucket, output_path, output_bucket, resolution, crf, callback_url, status, failed_count FROM jobs WHERE status = ?`, int(JobStatusEncodingPending))
-	if err != nil {
-		return nil, err
+// qualifiedJobColumns returns jobColumns prefixed with a table alias, for
+// queries joining jobs with other tables
+func qualifiedJobColumns(alias string) string {
+	qualified := make([]string, len(jobColumnNames))
+	for i, name := range jobColumnNames {
+		qualified[i] = alias + "." + name
 	}
-	defer rows.Close()
+	return strings.Join(qualified, ", ")
+}
 
+// scanJobs reads all rows of a query selecting jobColumns
+func scanJobs(rows *sql.Rows) ([]Job, error) {
 	var jobs []Job
 	for rows.Next() {
 		var job Job
 		var status int
-		err := rows.Scan(&job.ID, &job.VideoID, &job.InputKey, &job.InputBucket, &job.OutputPath, &job.OutputBucket, &job.Resolution, &job.Crf, &job.CallbackURL, &status, &job.FailedCount)
+		var idempotencyKey, startedAt, finishedAt, deadline, workerID, leaseExpiresAt, outcome, traceParent, audio sql.NullString
+		err := rows.Scan(&job.ID, &job.VideoID, &job.InputKey, &job.InputBucket, &job.OutputPath, &job.OutputBucket, &job.Resolution, &job.Crf, &job.CallbackURL,
+			&status, &job.FailedCount, &job.CallbackFailures, &idempotencyKey, &job.TenantID, &job.EncodedSeconds,
+			&job.CreatedAt, &job.UpdatedAt, &startedAt, &finishedAt, &job.Priority, &deadline,
+			&workerID, &leaseExpiresAt, &outcome, &traceParent, &audio, &job.AudioOnly)
 		if err != nil {
 			return nil, err
 		}
+		if audio.Valid {
+			if err := json.Unmarshal([]byte(audio.String), &job.Audio); err != nil {
+				return nil, fmt.Errorf("invalid audio settings of job %s: %w", job.ID, err)
+			}
+		}
 		job.Status = JobStatus(status)
+		job.IdempotencyKey = idempotencyKey.String
+		job.CreatedAt = apiTime(job.CreatedAt)
+		job.UpdatedAt = apiTime(job.UpdatedAt)
+		job.StartedAt = apiTime(startedAt.String)
+		job.FinishedAt = apiTime(finishedAt.String)
+		job.Deadline = apiTime(deadline.String)
+		job.WorkerID = workerID.String
+		job.LeaseExpiresAt = apiTime(leaseExpiresAt.String)
+		job.Outcome = outcome.String
+		job.TraceParent = traceParent.String
 		jobs = append(jobs, job)
 	}
-	return jobs, nil
+	return jobs, rows.Err()
 }
 
-// Fetch jobs with status 'pending' or 'failed'
-func GetPendingOrFailedJobs(db *sql.DB) ([]Job, error) {
-	log.Printf("Fetching jobs with status 'pending' or 'failed' from database...")
-	rows, err := db.Query(`SELECT id, video_id, input_key, input_bucket, output_path, output_bucket, resolution, crf, callback_url, status, failed_count FROM jobs WHERE status = ? OR status = ?`, int(JobStatusEncodingPending), int(JobStatusEncodingFailed))
-	if err != nil {
-		log.Printf("Error querying jobs: %v", err)
-		return nil, err
+// placeholders returns n comma-separated ? placeholders
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// nullIfEmpty maps empty strings to NULL so they are ignored by unique indexes
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
 	}
-	defer rows.Close()
+	return s
+}
 
-	var jobs []Job
-	for rows.Next() {
-		var job Job
-		var status int
-		err := rows.Scan(&job.ID, &job.VideoID, &job.InputKey, &job.InputBucket, &job.OutputPath, &job.OutputBucket, &job.Resolution, &job.Crf, &job.CallbackURL, &status, &job.FailedCount)
+// sqlTime formats a time like SQLite's CURRENT_TIMESTAMP so the two compare correctly
+func sqlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// apiTime converts a stored timestamp to RFC 3339. The SQLite driver does
+// this itself for TIMESTAMP columns, other databases return the stored text.
+func apiTime(s string) string {
+	if t, err := time.Parse("2006-01-02 15:04:05", s); err == nil {
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return s
+}
+
+// sqlTimeNano is sqlTime with microseconds, for ordering events within a second
+func sqlTimeNano(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.000000")
+}
+
+// Insert jobs of one tenant, returning a QuotaError instead if they would
+// exceed its limits. The usage is counted in the inserting transaction, with
+// the tenant locked, so concurrent submissions cannot both pass the check.
+func (s *sqlStore) InsertJobsWithinQuota(jobs []Job, limits TenantLimits, now time.Time) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if len(jobs) > 0 && limits.hasQuota() {
+			tenantID := jobs[0].TenantID
+			if s.dialect.tenantLock != "" {
+				if _, err := tx.Exec(s.rebind(s.dialect.tenantLock), tenantID); err != nil {
+					return err
+				}
+			}
+			usage, err := s.tenantUsage(tx, tenantID, now)
+			if err != nil {
+				return err
+			}
+			if err := limits.quotaError(usage, len(jobs)); err != nil {
+				return err
+			}
+		}
+		return s.insertJobs(tx, jobs)
+	})
+}
+
+func (s *sqlStore) insertJobs(tx *sql.Tx, jobs []Job) error {
+	insert := s.rebind(`INSERT INTO jobs (id, video_id, input_key, input_bucket, output_path, output_bucket, resolution, crf, callback_url, status, failed_count, callback_failures, idempotency_key, tenant_id, priority, deadline, trace_parent, audio, audio_only, output_name) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	for _, job := range jobs {
+		var audio interface{}
+		if job.Audio != nil {
+			data, err := json.Marshal(job.Audio)
+			if err != nil {
+				return err
+			}
+			audio = string(data)
+		}
+		_, err := tx.Exec(insert,
+			job.ID, job.VideoID, job.InputKey, job.InputBucket, job.OutputPath, job.OutputBucket, job.Resolution, job.Crf, job.CallbackURL, int(job.Status), job.FailedCount, job.CallbackFailures, nullIfEmpty(job.IdempotencyKey), job.TenantID, job.Priority, nullIfEmpty(job.Deadline), nullIfEmpty(job.TraceParent), audio, job.AudioOnly, OutputFileName(&job))
 		if err != nil {
-			log.Printf("Error scanning job row: %v", err)
-			return nil, err
+			return err
+		}
+		if err := s.insertJobEvent(tx, JobEvent{JobID: job.ID, Type: JobEventCreated, Status: job.Status}); err != nil {
+			return err
 		}
-		job.Status = JobStatus(status)
-		jobs = append(jobs, job)
 	}
-	log.Printf("Fetched %d jobs with status 'pending' or 'failed'", len(jobs))
-	return jobs, nil
+	return nil
 }
 
-// Atomically claim a job (set to in_progress if still pending/failed)
-func ClaimJob(db *sql.DB, jobID string) (bool, error) {
-	res, err := db.Exec(`UPDATE jobs SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND (status = ? OR status = ?)`, int(JobStatusEncodingPending+1), jobID, int(JobStatusEncodingPending), int(JobStatusEncodingFailed))
+// Move a job to a new status, optionally only from the given statuses
+func (s *sqlStore) TransitionJob(jobID string, to JobStatus, from ...JobStatus) (bool, error) {
+	query := `UPDATE jobs SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`
+	args := []interface{}{int(to), jobID}
+	if len(from) > 0 {
+		query += ` AND status IN (` + placeholders(len(from)) + `)`
+		for _, status := range from {
+			args = append(args, int(status))
+		}
+	}
+	var moved bool
+	err := s.inTx(func(tx *sql.Tx) error {
+		res, err := tx.Exec(s.rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil || affected == 0 {
+			return err
+		}
+		moved = true
+		return s.insertJobEvent(tx, JobEvent{JobID: jobID, Type: JobEventTransitioned, Status: to})
+	})
+	return moved, err
+}
+
+// Mark a job as successfully encoded, recording how much video was produced,
+// and queue its callback. Returns ErrLeaseLost if the worker no longer holds
+// the job's lease.
+func (s *sqlStore) MarkJobEncoded(jobID, workerID string, encodedSeconds float64, attempt Attempt) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var failedCount int
+		err := scanLeased(tx.QueryRow(s.rebind(`UPDATE jobs SET status = ?, outcome = ?, encoded_seconds = ?, finished_at = CURRENT_TIMESTAMP, worker_id = NULL, lease_expires_at = NULL, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ? AND worker_id = ? AND status = ?
+			RETURNING failed_count`),
+			int(JobStatusCallbackPending), JobOutcomeSucceeded, encodedSeconds, jobID, workerID, int(JobStatusEncodingRunning)), &failedCount)
+		if err != nil {
+			return err
+		}
+		return s.insertJobEvent(tx, newAttemptEvent(jobID, JobEventEncoded, JobStatusCallbackPending, workerID, failedCount+1, attempt))
+	})
+}
+
+// Mark a job as failed, counting the attempt and delaying the next one until
+// retryAt. Once the job has failed maxFailures times it is given up on and
+// its failure callback queued. Returns ErrLeaseLost if the worker no longer
+// holds the job's lease.
+func (s *sqlStore) MarkJobFailed(jobID, workerID string, retryAt time.Time, maxFailures int, attempt Attempt) error {
+	assignments, args := failedEncodeAssignments(maxFailures)
+	args = append(args, sqlTime(retryAt), jobID, workerID, int(JobStatusEncodingRunning))
+	return s.inTx(func(tx *sql.Tx) error {
+		var status, failedCount int
+		err := scanLeased(tx.QueryRow(s.rebind(`UPDATE jobs SET `+assignments+`, next_attempt_at = ?, worker_id = NULL, lease_expires_at = NULL, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ? AND worker_id = ? AND status = ?
+			RETURNING status, failed_count`), args...), &status, &failedCount)
+		if err != nil {
+			return err
+		}
+		return s.insertJobEvent(tx, newAttemptEvent(jobID, JobEventEncodeFailed, JobStatus(status), workerID, failedCount, attempt))
+	})
+}
+
+// failedEncodeAssignments returns the SET assignments counting a failed
+// encoding attempt. A job that has failed maxFailures times is given up on
+// and its failure callback queued; zero allows unlimited attempts.
+func failedEncodeAssignments(maxFailures int) (string, []interface{}) {
+	exhausted := `(? > 0 AND failed_count + 1 >= ?)`
+	assignments := `status = CASE WHEN ` + exhausted + ` THEN CAST(? AS INTEGER) ELSE CAST(? AS INTEGER) END,
+		outcome = CASE WHEN ` + exhausted + ` THEN ? ELSE outcome END,
+		finished_at = CASE WHEN ` + exhausted + ` THEN CURRENT_TIMESTAMP ELSE finished_at END,
+		failed_count = failed_count + 1`
+	args := []interface{}{
+		maxFailures, maxFailures, int(JobStatusCallbackPending), int(JobStatusEncodingFailed),
+		maxFailures, maxFailures, JobOutcomeFailed,
+		maxFailures, maxFailures,
+	}
+	return assignments, args
+}
+
+// jobFilterConditions returns the WHERE clause selecting the jobs matching
+// a filter, ignoring its cursor
+func jobFilterConditions(filter JobFilter) (string, []interface{}) {
+	where := ` WHERE 1 = 1`
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		where += ` AND ` + condition
+		args = append(args, arg)
+	}
+	if filter.TenantID != "" {
+		add(`tenant_id = ?`, filter.TenantID)
+	}
+	if filter.VideoID != "" {
+		add(`video_id = ?`, filter.VideoID)
+	}
+	if len(filter.Statuses) > 0 {
+		where += ` AND status IN (` + placeholders(len(filter.Statuses)) + `)`
+		for _, status := range filter.Statuses {
+			args = append(args, int(status))
+		}
+	}
+	if len(filter.Outcomes) > 0 {
+		where += ` AND outcome IN (` + placeholders(len(filter.Outcomes)) + `)`
+		for _, outcome := range filter.Outcomes {
+			args = append(args, outcome)
+		}
+	}
+	if filter.Resolution > 0 {
+		add(`resolution = ?`, filter.Resolution)
+	}
+	if filter.MinFailedCount > 0 {
+		add(`failed_count >= ?`, filter.MinFailedCount)
+	}
+	if filter.MinCallbackFailures > 0 {
+		add(`callback_failures >= ?`, filter.MinCallbackFailures)
+	}
+	for _, r := range []struct {
+		condition string
+		t         time.Time
+	}{
+		{`created_at >= ?`, filter.CreatedAfter},
+		{`created_at < ?`, filter.CreatedBefore},
+		{`updated_at >= ?`, filter.UpdatedAfter},
+		{`updated_at < ?`, filter.UpdatedBefore},
+	} {
+		if !r.t.IsZero() {
+			add(r.condition, sqlTime(r.t))
+		}
+	}
+	return where, args
+}
+
+// isJobSortColumn reports whether jobs can be listed by the column
+func isJobSortColumn(column string) bool {
+	for _, c := range JobSortColumns {
+		if c == column {
+			return true
+		}
+	}
+	return false
+}
+
+// JobCursorFor returns the position of the job in a listing in sort order
+func JobCursorFor(job *Job, sort JobSort) JobCursor {
+	cursor := JobCursor{ID: job.ID}
+	switch sort.Column {
+	case "updated_at":
+		cursor.Value = storedTime(job.UpdatedAt)
+	case "priority":
+		cursor.Value = strconv.Itoa(job.Priority)
+	case "failed_count":
+		cursor.Value = strconv.Itoa(job.FailedCount)
+	default:
+		cursor.Value = storedTime(job.CreatedAt)
+	}
+	return cursor
+}
+
+// storedTime converts an API timestamp back to the form it is stored in
+func storedTime(s string) string {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return sqlTime(t)
+	}
+	return s
+}
+
+// List the jobs matching a filter in its sort order, oldest first by default
+func (s *sqlStore) ListJobs(filter JobFilter) ([]Job, error) {
+	column, direction, op := "created_at", "ASC", ">"
+	if filter.Sort.Column != "" {
+		if !isJobSortColumn(filter.Sort.Column) {
+			return nil, fmt.Errorf("cannot sort jobs by %q", filter.Sort.Column)
+		}
+		column = filter.Sort.Column
+	}
+	if filter.Sort.Descending {
+		direction, op = "DESC", "<"
+	}
+
+	where, args := jobFilterConditions(filter)
+	if filter.After != nil {
+		var value interface{} = filter.After.Value
+		if column == "priority" || column == "failed_count" {
+			n, err := strconv.Atoi(filter.After.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cursor value %q: %w", filter.After.Value, err)
+			}
+			value = n
+		}
+		where += ` AND (` + column + ` ` + op + ` ? OR (` + column + ` = ? AND id ` + op + ` ?))`
+		args = append(args, value, value, filter.After.ID)
+	}
+	query := `SELECT ` + jobColumns + ` FROM jobs` + where + ` ORDER BY ` + column + ` ` + direction + `, id ` + direction
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+	rows, err := s.query(query, args...)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	affected, err := res.RowsAffected()
+	defer rows.Close()
+	return scanJobs(rows)
+}
+
+// Count the jobs matching a filter in each status
+func (s *sqlStore) CountJobsByStatus(filter JobFilter) (map[JobStatus]int, error) {
+	where, args := jobFilterConditions(filter)
+	rows, err := s.query(`SELECT status, COUNT(*) FROM jobs`+where+` GROUP BY status`, args...)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	defer rows.Close()
+	counts := map[JobStatus]int{}
+	for rows.Next() {
+		var status, count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[JobStatus(status)] = count
 	}
-	return affected > 0, nil
+	return counts, rows.Err()
 }
 
-// Reset jobs stuck in 'in_progress' state on startup
-func ResetInProgressJobs(db *sql.DB) error {
-	// Set jobs with failed_count > 0 to 'failed', others to 'pending'
-	_, err := db.Exec(`
-		UPDATE jobs
-		SET status = CASE WHEN failed_count > 0 THEN ? ELSE ? END,
-		    updated_at = CURRENT_TIMESTAMP
-		WHERE status = ?
-	`, int(JobStatusEncodingFailed), int(JobStatusEncodingPending), int(JobStatusEncodingRunning))
-	return err
+// Fetch the jobs a tenant previously created with an idempotency key
+func (s *sqlStore) GetJobsByIdempotencyKey(tenantID, key string) ([]Job, error) {
+	rows, err := s.query(`SELECT `+jobColumns+` FROM jobs WHERE tenant_id = ? AND idempotency_key = ? ORDER BY created_at, id`, tenantID, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanJobs(rows)
 }
 
-// Fetch jobs with status 'callback pending'
-func GetCallbackPendingJobs(db *sql.DB) ([]Job, error) {
-	rows, err := db.Query(`SELECT id, video_id, input_key, input_bucket, output_path, output_bucket, resolution, crf, callback_url, status, failed_count, callback_failures FROM jobs WHERE status = ?`, int(JobStatusCallbackPending))
+// Fetch a single job by ID, returning sql.ErrNoRows if it does not exist
+func (s *sqlStore) GetJob(jobID string) (*Job, error) {
+	rows, err := s.query(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`, jobID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
+	jobs, err := scanJobs(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &jobs[0], nil
+}
 
-	var jobs []Job
-	for rows.Next() {
-		var job Job
-		var status int
-		err := rows.Scan(&job.ID, &job.VideoID, &job.InputKey, &job.InputBucket, &job.OutputPath, &job.OutputBucket, &job.Resolution, &job.Crf, &job.CallbackURL, &status, &job.FailedCount, &job.CallbackFailures)
+// DequeueCallbackJob atomically claims the oldest pending callback that has
+// attempts left, leasing it to the worker. Returns nil if there is none.
+func (s *sqlStore) DequeueCallbackJob(workerID string, maxCallbackFailures int, leaseExpiresAt time.Time) (*Job, error) {
+	var claimed *Job
+	err := s.inTx(func(tx *sql.Tx) error {
+		rows, err := tx.Query(s.rebind(`UPDATE jobs SET status = ?, worker_id = ?, lease_expires_at = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = (
+				SELECT id FROM jobs WHERE status = ? AND callback_failures < ? ORDER BY updated_at, id LIMIT 1`+s.dialect.lockClause("jobs")+`
+			) AND status = ?
+			RETURNING `+jobColumns),
+			int(JobStatusCallbackInProgress), workerID, sqlTime(leaseExpiresAt),
+			int(JobStatusCallbackPending), maxCallbackFailures, int(JobStatusCallbackPending))
 		if err != nil {
-			return nil, err
+			return err
 		}
-		job.Status = JobStatus(status)
-		jobs = append(jobs, job)
+		jobs, err := scanJobs(rows)
+		rows.Close()
+		if err != nil || len(jobs) == 0 {
+			return err
+		}
+		claimed = &jobs[0]
+		return s.insertJobEvent(tx, JobEvent{JobID: claimed.ID, Type: JobEventCallbackClaimed, Status: JobStatusCallbackInProgress,
+			WorkerID: workerID, Attempt: claimed.CallbackFailures + 1})
+	})
+	if err != nil {
+		return nil, err
 	}
-	return jobs, nil
+	return claimed, nil
 }
 
-// Increment callback_failures for a job
-func IncrementCallbackFailures(db *sql.DB, jobID string) error {
-	_, err := db.Exec(`UPDATE jobs SET callback_failures = callback_failures + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, jobID)
-	return err
+// Record the outcome of a callback attempt by the worker holding its lease.
+// Failed attempts are counted and the callback is retried until it has
+// failed maxCallbackFailures times.
+func (s *sqlStore) CompleteCallback(jobID, workerID string, attempt Attempt, maxCallbackFailures int) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		var status, callbackFailures int
+		var row *sql.Row
+		eventType := JobEventCallbackSucceeded
+		if attempt.Error == "" {
+			// Cancelled jobs are only cancelled for good once the caller knows
+			row = tx.QueryRow(s.rebind(`UPDATE jobs SET status = CASE WHEN outcome = ? THEN CAST(? AS INTEGER) ELSE CAST(? AS INTEGER) END,
+					worker_id = NULL, lease_expires_at = NULL, updated_at = CURRENT_TIMESTAMP
+				WHERE id = ? AND worker_id = ? AND status = ?
+				RETURNING status, callback_failures + 1`),
+				JobOutcomeCancelled, int(JobStatusCancelled), int(JobStatusCallbackSuccess),
+				jobID, workerID, int(JobStatusCallbackInProgress))
+		} else {
+			eventType = JobEventCallbackFailed
+			row = tx.QueryRow(s.rebind(`UPDATE jobs SET status = CASE WHEN callback_failures + 1 >= ? THEN CAST(? AS INTEGER) ELSE CAST(? AS INTEGER) END,
+					callback_failures = callback_failures + 1, worker_id = NULL, lease_expires_at = NULL, updated_at = CURRENT_TIMESTAMP
+				WHERE id = ? AND worker_id = ? AND status = ?
+				RETURNING status, callback_failures`),
+				maxCallbackFailures, int(JobStatusCallbackFailed), int(JobStatusCallbackPending),
+				jobID, workerID, int(JobStatusCallbackInProgress))
+		}
+		if err := scanLeased(row, &status, &callbackFailures); err != nil {
+			return err
+		}
+		return s.insertJobEvent(tx, newAttemptEvent(jobID, eventType, JobStatus(status), workerID, callbackFailures, attempt))
+	})
 }
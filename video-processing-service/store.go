@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JobStore persists jobs and hands them out to workers. Every process of a
+// deployment shares one store, which is what lets the API and the workers
+// run on different hosts.
+type JobStore interface {
+	// InsertJobsWithinQuota inserts jobs of one tenant unless they would
+	// exceed its limits, in which case it returns a QuotaError
+	InsertJobsWithinQuota(jobs []Job, limits TenantLimits, now time.Time) error
+	GetJob(jobID string) (*Job, error)
+	GetJobsByIdempotencyKey(tenantID, key string) ([]Job, error)
+	ListJobs(filter JobFilter) ([]Job, error)
+	CountJobsByStatus(filter JobFilter) (map[JobStatus]int, error)
+
+	// TransitionJob moves a job to a new status if it is currently in one of
+	// the from statuses, or unconditionally if none are given, reporting
+	// whether it moved
+	TransitionJob(jobID string, to JobStatus, from ...JobStatus) (bool, error)
+	ListJobEvents(jobID string) ([]JobEvent, error)
+
+	// Administrative operations apply only to jobs in a status they allow,
+	// reporting whether the job was updated, and are recorded in the job's
+	// history with the given detail, except for purging which deletes it
+	CancelJob(jobID, detail string) (bool, error)
+	RetryJob(jobID, detail string) (bool, error)
+	RequeueCallback(jobID, detail string) (bool, error)
+	SetJobPriority(jobID string, priority int, detail string) (bool, error)
+	PurgeJob(jobID string) (bool, error)
+	PurgeJobs(jobIDs []string) (int64, error)
+
+	DequeueJob(opts DequeueOptions, now time.Time) (*Job, error)
+	RenewLease(jobID, workerID string, expiresAt time.Time) error
+	MarkJobEncoded(jobID, workerID string, encodedSeconds float64, attempt Attempt) error
+	MarkJobFailed(jobID, workerID string, retryAt time.Time, maxFailures int, attempt Attempt) error
+	DequeueCallbackJob(workerID string, maxCallbackFailures int, leaseExpiresAt time.Time) (*Job, error)
+	CompleteCallback(jobID, workerID string, attempt Attempt, maxCallbackFailures int) error
+	ReapExpiredLeases(maxEncodingFailures, maxCallbackFailures int, now time.Time) (int64, error)
+
+	// IsUniqueViolation reports whether err was caused by a unique constraint
+	IsUniqueViolation(err error) bool
+}
+
+// JobFilter selects jobs for ListJobs. Zero fields match every job. Time
+// ranges include their start and exclude their end.
+type JobFilter struct {
+	TenantID            string
+	VideoID             string
+	Statuses            []JobStatus
+	Outcomes            []string
+	Resolution          int
+	MinFailedCount      int
+	MinCallbackFailures int
+	CreatedAfter        time.Time
+	CreatedBefore       time.Time
+	UpdatedAfter        time.Time
+	UpdatedBefore       time.Time
+
+	// Jobs are listed in Sort order, starting after the job at After if it
+	// is set. Counts ignore both, and Limit.
+	Sort  JobSort
+	After *JobCursor
+	Limit int
+}
+
+// JobSort orders listed jobs by one of JobSortColumns, with the job ID
+// breaking ties. The zero value lists the oldest jobs first.
+type JobSort struct {
+	Column     string
+	Descending bool
+}
+
+// JobSortColumns are the columns jobs can be listed by
+var JobSortColumns = []string{"created_at", "updated_at", "priority", "failed_count"}
+
+// JobCursor is the position of a job in a listing: the value of the sort
+// column, in its stored form, and the job's ID
+type JobCursor struct {
+	Value string
+	ID    string
+}
+
+// TenantStore persists tenant settings and reports their usage
+type TenantStore interface {
+	GetTenantSettings(tenantID string) (TenantSettings, error)
+	UpsertTenantSettings(tenantID string, settings TenantSettings) error
+	ListTenantIDs() ([]string, error)
+	GetTenantUsage(tenantID string, now time.Time) (TenantUsage, error)
+}
+
+// APIKeyStore persists API keys, which are only ever stored hashed
+type APIKeyStore interface {
+	InsertAPIKey(key APIKey, keyHash string) error
+	GetAPIKeyByHash(keyHash string) (*APIKey, error)
+	ListAPIKeys() ([]APIKey, error)
+	RevokeAPIKey(id string) error
+}
+
+// Migrator manages the versioned schema of a store
+type Migrator interface {
+	SchemaVersion() (int, error)
+	PendingMigrations() ([]Migration, error)
+	Migrate() ([]Migration, error)
+}
+
+// Store is everything the service keeps in its database
+type Store interface {
+	JobStore
+	TenantStore
+	APIKeyStore
+	Migrator
+	// Ping checks that the database can be reached
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// OpenStore opens the configured store: PostgreSQL if a database URL is set,
+// otherwise the SQLite file at DBFilePath. If migrate is set, pending schema
+// migrations are applied first, and a database newer than this binary is
+// refused with a SchemaTooNewError.
+func OpenStore(cfg Config, migrate bool) (Store, error) {
+	var store Store
+	if cfg.DatabaseURL != "" {
+		pgStore, err := openPostgresStore(cfg.DatabaseURL)
+		if err != nil {
+			return nil, err
+		}
+		store = pgStore
+	} else {
+		sqliteStore, err := openSQLiteStore(cfg.DBFilePath, cfg.SQLite)
+		if err != nil {
+			return nil, err
+		}
+		store = sqliteStore
+	}
+	if migrate {
+		if err := migrateStore(store); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// migrateStore applies pending migrations, logging each one
+func migrateStore(store Store) error {
+	applied, err := store.Migrate()
+	for _, m := range applied {
+		slog.Info("Applied schema migration", "version", m.Version, "name", m.Name)
+	}
+	return err
+}
+
+// sqlDialect describes how a database differs from the SQL the stores are
+// written in, which is SQLite with ? placeholders.
+type sqlDialect struct {
+	// name selects the dialect's directory of migrations
+	name string
+	// numberedParams rewrites ? placeholders to $1, $2, ...
+	numberedParams bool
+	// now replaces CURRENT_TIMESTAMP, and must produce the sqlTime format
+	now string
+	// greatest and least are the scalar forms of MAX and MIN
+	greatest, least string
+	// elapsedSeconds returns an integer expression for the whole seconds
+	// between two timestamps
+	elapsedSeconds func(from, to string) string
+	// lockClause is appended to the SELECT picking a job to claim, so that
+	// concurrent claims skip rows another transaction is already claiming
+	lockClause        func(table string) string
+	isUniqueViolation func(err error) bool
+
+	// tableExistsQuery and columnExistsQuery count the tables and columns
+	// with the given names
+	tableExistsQuery, columnExistsQuery string
+	// migrationLock is run at the start of every migration transaction
+	migrationLock string
+	// tenantLock is run with a tenant ID before counting its jobs in the
+	// transaction inserting new ones
+	tenantLock string
+}
+
+// sqlStore implements Store for any database/sql driver. Queries are written
+// once and rewritten for the dialect by rebind.
+type sqlStore struct {
+	db *sql.DB
+	// readDB serves plain reads when the database is better used through a
+	// separate pool of readers; writes, transactions and UPDATE ... RETURNING
+	// always go through db
+	readDB  *sql.DB
+	dialect sqlDialect
+}
+
+// rebind rewrites a query written for SQLite into the store's dialect
+func (s *sqlStore) rebind(query string) string {
+	if s.dialect.now != "" {
+		query = strings.ReplaceAll(query, "CURRENT_TIMESTAMP", s.dialect.now)
+	}
+	if !s.dialect.numberedParams {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	return s.db.Exec(s.rebind(query), args...)
+}
+
+// query and queryRow are for statements that only read
+func (s *sqlStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return s.reader().Query(s.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.reader().QueryRow(s.rebind(query), args...)
+}
+
+func (s *sqlStore) reader() *sql.DB {
+	if s.readDB != nil {
+		return s.readDB
+	}
+	return s.db
+}
+
+// queryRower is a *sql.DB or a *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// inTx runs fn in a transaction, committing it if fn succeeds
+func (s *sqlStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) IsUniqueViolation(err error) bool {
+	return s.dialect.isUniqueViolation(err)
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
+		return err
+	}
+	if s.readDB != nil {
+		return s.readDB.PingContext(ctx)
+	}
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	if s.readDB != nil {
+		s.readDB.Close()
+	}
+	return s.db.Close()
+}
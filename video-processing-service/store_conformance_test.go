@@ -0,0 +1,453 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSQLiteStoreConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) Store {
+		store := setupTestDB(t)
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func TestPostgresStoreConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) Store {
+		return openTestPostgresStore(t)
+	})
+}
+
+func newTestJob(tenantID string, resolution int) Job {
+	return Job{
+		ID:           uuid.New().String(),
+		VideoID:      tenantID + "-video",
+		InputKey:     "input.mp4",
+		InputBucket:  "input-bucket",
+		OutputPath:   "outputs/",
+		OutputBucket: "output-bucket",
+		Resolution:   resolution,
+		Crf:          23,
+		CallbackURL:  "http://callback.example.com/done",
+		Status:       JobStatusEncodingPending,
+		TenantID:     tenantID,
+		Priority:     DefaultPriority,
+	}
+}
+
+// insertTestJobs stores jobs of any tenants without checking quotas
+func insertTestJobs(store JobStore, jobs []Job) error {
+	return store.InsertJobsWithinQuota(jobs, TenantLimits{}, time.Now())
+}
+
+// testStore is a Store with helpers that put jobs straight into a state.
+// Production code claims jobs only through DequeueJob, so the helpers are
+// defined here rather than on JobStore.
+type testStore interface {
+	Store
+	claimJob(jobID string) (bool, error)
+	incrementFailedCount(jobID string) error
+	schedulableJobs(opts DequeueOptions, now time.Time) ([]Job, error)
+}
+
+// claimJob marks a pending or failed job as running without leasing it
+func (s *sqlStore) claimJob(jobID string) (bool, error) {
+	res, err := s.exec(`UPDATE jobs SET status = ?, started_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status IN (?, ?)`,
+		int(JobStatusEncodingRunning), jobID, int(JobStatusEncodingPending), int(JobStatusEncodingFailed))
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *sqlStore) incrementFailedCount(jobID string) error {
+	_, err := s.exec(`UPDATE jobs SET failed_count = failed_count + 1, updated_at = CURRENT_TIMESTAMP WHERE id = ?`, jobID)
+	return err
+}
+
+// schedulableJobs returns every claimable encoding job in the order
+// DequeueJob would claim them
+func (s *sqlStore) schedulableJobs(opts DequeueOptions, now time.Time) ([]Job, error) {
+	query, args := s.schedulableJobsQuery(qualifiedJobColumns("j"), opts, now)
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanJobs(rows)
+}
+
+// testStoreConformance checks the behaviour every Store implementation must
+// share, so that the service runs the same on any of them
+func testStoreConformance(t *testing.T, open func(t *testing.T) Store) {
+	opts := DequeueOptions{
+		TenantDefaults: TenantLimits{Weight: 1},
+		AgingInterval:  time.Hour,
+		MaxFailures:    3,
+		WorkerID:       "worker-1",
+		LeaseDuration:  time.Minute,
+	}
+
+	t.Run("InsertGetAndList", func(t *testing.T) {
+		store := open(t)
+		a, b := newTestJob("acme", 360), newTestJob("acme", 720)
+		a.IdempotencyKey, b.IdempotencyKey = "key-1", "key-1"
+		other := newTestJob("other", 360)
+		deadline := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+		other.Deadline = sqlTime(deadline)
+		if err := insertTestJobs(store, []Job{a, b, other}); err != nil {
+			t.Fatalf("InsertJobs failed: %v", err)
+		}
+
+		job, err := store.GetJob(other.ID)
+		if err != nil || job.TenantID != "other" || job.Deadline != deadline.Format(time.RFC3339) || job.Status != JobStatusEncodingPending || job.CreatedAt == "" {
+			t.Errorf("GetJob returned %+v, %v", job, err)
+		}
+		if _, err := store.GetJob("missing"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Expected sql.ErrNoRows for missing job, got %v", err)
+		}
+
+		jobs, err := store.ListJobs(JobFilter{TenantID: "acme"})
+		if err != nil || len(jobs) != 2 {
+			t.Errorf("Expected 2 acme jobs, got %d, %v", len(jobs), err)
+		}
+		jobs, _ = store.ListJobs(JobFilter{Statuses: []JobStatus{JobStatusEncodingPending}, Limit: 1})
+		if len(jobs) != 1 {
+			t.Errorf("Expected limit to apply, got %d jobs", len(jobs))
+		}
+		jobs, _ = store.GetJobsByIdempotencyKey("acme", "key-1")
+		if len(jobs) != 2 {
+			t.Errorf("Expected 2 jobs for idempotency key, got %d", len(jobs))
+		}
+
+		// The same key, resolution and CRF may only be stored once per tenant
+		dup := newTestJob("acme", 360)
+		dup.IdempotencyKey = "key-1"
+		if err := insertTestJobs(store, []Job{newTestJob("acme", 1080), dup}); !store.IsUniqueViolation(err) {
+			t.Errorf("Expected unique violation, got %v", err)
+		}
+		if jobs, _ := store.ListJobs(JobFilter{TenantID: "acme"}); len(jobs) != 2 {
+			t.Errorf("Expected failed insert to store nothing, got %d jobs", len(jobs))
+		}
+	})
+
+	t.Run("Transitions", func(t *testing.T) {
+		store := open(t)
+		job := newTestJob("acme", 360)
+		insertTestJobs(store, []Job{job})
+
+		if ok, err := store.TransitionJob(job.ID, JobStatusCallbackPending, JobStatusEncodingSuccess); err != nil || ok {
+			t.Errorf("Expected transition from the wrong status to be refused, got %v, %v", ok, err)
+		}
+		if claimed, err := store.DequeueJob(opts, time.Now()); err != nil || claimed == nil {
+			t.Fatalf("DequeueJob returned %v, %v", claimed, err)
+		}
+		if claimed, _ := store.DequeueJob(opts, time.Now()); claimed != nil {
+			t.Errorf("Expected a running job not to be claimed twice")
+		}
+		if ok, err := store.TransitionJob(job.ID, JobStatusEncodingSuccess, JobStatusEncodingRunning); err != nil || !ok {
+			t.Errorf("TransitionJob returned %v, %v", ok, err)
+		}
+		got, _ := store.GetJob(job.ID)
+		if got.Status != JobStatusEncodingSuccess || got.StartedAt == "" {
+			t.Errorf("Unexpected job after transitions: %+v", got)
+		}
+	})
+
+	t.Run("DequeueLeasesAndRetries", func(t *testing.T) {
+		store := open(t)
+		urgent := newTestJob("acme", 720)
+		urgent.Priority = 9
+		insertTestJobs(store, []Job{newTestJob("acme", 360), urgent})
+
+		job, err := store.DequeueJob(opts, time.Now())
+		if err != nil || job == nil || job.ID != urgent.ID || job.Status != JobStatusEncodingRunning || job.WorkerID != opts.WorkerID {
+			t.Fatalf("Expected the urgent job to be leased, got %+v, %v", job, err)
+		}
+		if err := store.RenewLease(job.ID, "worker-2", time.Now().Add(time.Minute)); !errors.Is(err, ErrLeaseLost) {
+			t.Errorf("Expected ErrLeaseLost renewing another worker's lease, got %v", err)
+		}
+		if err := store.MarkJobFailed(job.ID, opts.WorkerID, time.Now().Add(time.Hour), 3, Attempt{Error: "encode failed"}); err != nil {
+			t.Fatalf("MarkJobFailed failed: %v", err)
+		}
+
+		// The failed job waits out its backoff while the other one is claimed
+		next, err := store.DequeueJob(opts, time.Now())
+		if err != nil || next == nil || next.ID == urgent.ID {
+			t.Fatalf("Expected the other job, got %+v, %v", next, err)
+		}
+		if err := store.MarkJobEncoded(next.ID, opts.WorkerID, 12.5, Attempt{}); err != nil {
+			t.Fatalf("MarkJobEncoded failed: %v", err)
+		}
+		if job, err := store.DequeueJob(opts, time.Now()); err != nil || job != nil {
+			t.Errorf("Expected nothing claimable, got %+v, %v", job, err)
+		}
+		retried, err := store.DequeueJob(opts, time.Now().Add(2*time.Hour))
+		if err != nil || retried == nil || retried.ID != urgent.ID || retried.FailedCount != 1 {
+			t.Errorf("Expected the failed job after its backoff, got %+v, %v", retried, err)
+		}
+
+		usage, err := store.GetTenantUsage("acme", time.Now())
+		if err != nil || usage.RunningEncodes != 1 || usage.QueuedJobs != 1 || usage.EncodedMinutesToday*60 != 12.5 {
+			t.Errorf("Unexpected usage %+v, %v", usage, err)
+		}
+	})
+
+	t.Run("QuotaCheckedInsert", func(t *testing.T) {
+		store := open(t)
+		limits := TenantLimits{MaxQueuedJobs: 3}
+		errs := make(chan error, 8)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- store.InsertJobsWithinQuota([]Job{newTestJob("quota", 240+i)}, limits, time.Now())
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		inserted := 0
+		for err := range errs {
+			var quotaErr *QuotaError
+			if err == nil {
+				inserted++
+			} else if !errors.As(err, &quotaErr) {
+				t.Errorf("Expected a QuotaError, got %v", err)
+			}
+		}
+		if usage, _ := store.GetTenantUsage("quota", time.Now()); inserted != 3 || usage.QueuedJobs != 3 {
+			t.Errorf("Expected concurrent submissions to queue 3 jobs, inserted %d with usage %+v", inserted, usage)
+		}
+	})
+
+	t.Run("SchedulingAcrossTenants", func(t *testing.T) {
+		store := open(t)
+		var jobs []Job
+		for i := 0; i < 3; i++ {
+			jobs = append(jobs, newTestJob("bulk", 240+i))
+		}
+		jobs = append(jobs, newTestJob("small", 240))
+		insertTestJobs(store, jobs)
+
+		limit := 1
+		if err := store.UpsertTenantSettings("bulk", TenantSettings{MaxConcurrentEncodes: &limit}); err != nil {
+			t.Fatalf("UpsertTenantSettings failed: %v", err)
+		}
+		first, _ := store.DequeueJob(opts, time.Now())
+		second, _ := store.DequeueJob(opts, time.Now())
+		if first == nil || second == nil || first.TenantID == second.TenantID {
+			t.Fatalf("Expected one job of each tenant, got %+v and %+v", first, second)
+		}
+		if job, _ := store.DequeueJob(opts, time.Now()); job != nil {
+			t.Errorf("Expected bulk to be held at its concurrency limit, got %+v", job)
+		}
+		schedulable, err := store.(testStore).schedulableJobs(opts, time.Now())
+		if err != nil || len(schedulable) != 0 {
+			t.Errorf("Expected no schedulable jobs, got %d, %v", len(schedulable), err)
+		}
+
+		settings, err := store.GetTenantSettings("bulk")
+		if err != nil || settings.MaxConcurrentEncodes == nil || *settings.MaxConcurrentEncodes != 1 || settings.Weight != nil {
+			t.Errorf("Unexpected settings %+v, %v", settings, err)
+		}
+		ids, err := store.ListTenantIDs()
+		if err != nil || fmt.Sprint(ids) != "[bulk small]" {
+			t.Errorf("Expected both tenants, got %v, %v", ids, err)
+		}
+	})
+
+	t.Run("ConcurrentClaimsRespectTenantLimit", func(t *testing.T) {
+		store := open(t)
+		var jobs []Job
+		for i := 0; i < 8; i++ {
+			jobs = append(jobs, newTestJob("solo", 240+i))
+		}
+		insertTestJobs(store, jobs)
+		limit := 1
+		if err := store.UpsertTenantSettings("solo", TenantSettings{MaxConcurrentEncodes: &limit}); err != nil {
+			t.Fatalf("UpsertTenantSettings failed: %v", err)
+		}
+
+		var wg sync.WaitGroup
+		claimed := make(chan string, len(jobs))
+		for i := 0; i < len(jobs); i++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				workerOpts := opts
+				workerOpts.WorkerID = fmt.Sprintf("worker-%d", worker)
+				job, err := store.DequeueJob(workerOpts, time.Now())
+				if err != nil {
+					t.Errorf("DequeueJob failed: %v", err)
+				}
+				if job != nil {
+					claimed <- job.ID
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(claimed)
+		if n := len(claimed); n != 1 {
+			t.Errorf("Expected exactly one claim for a tenant limited to one encode, got %d", n)
+		}
+	})
+
+	t.Run("CallbacksAndReaping", func(t *testing.T) {
+		store := open(t)
+		a, b := newTestJob("acme", 360), newTestJob("acme", 720)
+		a.Status, b.Status = JobStatusCallbackPending, JobStatusCallbackPending
+		insertTestJobs(store, []Job{a, b})
+
+		job, err := store.DequeueCallbackJob("cb-1", 2, time.Now().Add(time.Minute))
+		if err != nil || job == nil || job.Status != JobStatusCallbackInProgress {
+			t.Fatalf("DequeueCallbackJob returned %+v, %v", job, err)
+		}
+		if err := store.CompleteCallback(job.ID, "cb-1", Attempt{}, 2); err != nil {
+			t.Errorf("CompleteCallback failed: %v", err)
+		}
+		if err := store.CompleteCallback(job.ID, "cb-1", Attempt{}, 2); !errors.Is(err, ErrLeaseLost) {
+			t.Errorf("Expected completed callback to be fenced, got %v", err)
+		}
+
+		// An abandoned callback is requeued, then failed once out of attempts
+		for attempt := 1; attempt <= 2; attempt++ {
+			job, err := store.DequeueCallbackJob("cb-2", 2, time.Now().Add(time.Minute))
+			if err != nil || job == nil {
+				t.Fatalf("Attempt %d: DequeueCallbackJob returned %+v, %v", attempt, job, err)
+			}
+			if reaped, err := store.ReapExpiredLeases(3, 2, time.Now().Add(2*time.Minute)); err != nil || reaped != 1 {
+				t.Fatalf("Attempt %d: expected 1 reaped job, got %d, %v", attempt, reaped, err)
+			}
+		}
+		got, _ := store.GetJob(job.ID)
+		if got.Status != JobStatusCallbackSuccess {
+			t.Errorf("Expected completed callback to stay successful, got %v", got.Status)
+		}
+		got, _ = store.GetJob(b.ID)
+		if got.ID == job.ID {
+			got, _ = store.GetJob(a.ID)
+		}
+		if got.Status != JobStatusCallbackFailed || got.CallbackFailures != 2 {
+			t.Errorf("Expected abandoned callback to fail after 2 attempts, got %+v", got)
+		}
+	})
+
+	t.Run("JobHistory", func(t *testing.T) {
+		store := open(t)
+		job := newTestJob("acme", 720)
+		insertTestJobs(store, []Job{job})
+
+		// An abandoned attempt is reaped, the retry succeeds and its callback is queued
+		if claimed, _ := store.DequeueJob(opts, time.Now()); claimed == nil {
+			t.Fatal("Expected the job to be claimed")
+		}
+		if reaped, err := store.ReapExpiredLeases(3, 3, time.Now().Add(2*time.Minute)); err != nil || reaped != 1 {
+			t.Fatalf("Expected 1 reaped job, got %d, %v", reaped, err)
+		}
+		if claimed, _ := store.DequeueJob(opts, time.Now().Add(2*time.Minute)); claimed == nil {
+			t.Fatal("Expected the job to be claimed again")
+		}
+		if err := store.MarkJobEncoded(job.ID, opts.WorkerID, 30, Attempt{Duration: 1500 * time.Millisecond}); err != nil {
+			t.Fatalf("MarkJobEncoded failed: %v", err)
+		}
+		got, _ := store.GetJob(job.ID)
+		if got.Status != JobStatusCallbackPending || got.Outcome != JobOutcomeSucceeded || got.FinishedAt == "" {
+			t.Errorf("Expected encoded job to await its callback, got %+v", got)
+		}
+
+		events, err := store.ListJobEvents(job.ID)
+		if err != nil || len(events) != 5 {
+			t.Fatalf("Expected 5 events, got %+v, %v", events, err)
+		}
+		reaped, encoded := events[2], events[4]
+		if reaped.Type != JobEventEncodeLeaseExpired || reaped.WorkerID != opts.WorkerID || reaped.Attempt != 1 || reaped.Status != JobStatusEncodingFailed || reaped.Error == "" {
+			t.Errorf("Unexpected reaped event %+v", reaped)
+		}
+		if encoded.Type != JobEventEncoded || encoded.Attempt != 2 || encoded.Duration != 1500*time.Millisecond || encoded.ExitCode != nil || encoded.CreatedAt == "" {
+			t.Errorf("Unexpected encoded event %+v", encoded)
+		}
+	})
+
+	t.Run("AdminOperations", func(t *testing.T) {
+		store := open(t)
+		job := newTestJob("acme", 720)
+		insertTestJobs(store, []Job{job})
+
+		if ok, err := store.RequeueCallback(job.ID, "admin"); err != nil || ok {
+			t.Errorf("Expected a queued job's callback not to be requeued, got %v, %v", ok, err)
+		}
+		if ok, err := store.SetJobPriority(job.ID, 9, "admin"); err != nil || !ok {
+			t.Fatalf("SetJobPriority returned %v, %v", ok, err)
+		}
+		if ok, err := store.CancelJob(job.ID, "admin: duplicate"); err != nil || !ok {
+			t.Fatalf("CancelJob returned %v, %v", ok, err)
+		}
+		if ok, err := store.RetryJob(job.ID, "admin"); err != nil || !ok {
+			t.Fatalf("RetryJob returned %v, %v", ok, err)
+		}
+		got, _ := store.GetJob(job.ID)
+		if got.Status != JobStatusEncodingPending || got.Priority != 9 || got.FinishedAt != "" {
+			t.Errorf("Expected retried job to be queued again, got %+v", got)
+		}
+		events, _ := store.ListJobEvents(job.ID)
+		if len(events) != 4 || events[2].Type != JobEventCancelled || events[2].Detail != "admin: duplicate" || events[2].Status != JobStatusCallbackPending {
+			t.Errorf("Unexpected history %+v", events)
+		}
+
+		if ok, err := store.PurgeJob(job.ID); err != nil || ok {
+			t.Errorf("Expected a queued job not to be purged, got %v, %v", ok, err)
+		}
+		// A cancelled job is cancelled for good once its callback is delivered
+		store.CancelJob(job.ID, "admin")
+		if claimed, _ := store.DequeueCallbackJob("callback-worker", 3, time.Now().Add(time.Minute)); claimed == nil || claimed.Outcome != JobOutcomeCancelled {
+			t.Fatalf("Expected the cancellation callback to be claimed, got %+v", claimed)
+		}
+		if err := store.CompleteCallback(job.ID, "callback-worker", Attempt{}, 3); err != nil {
+			t.Fatalf("CompleteCallback failed: %v", err)
+		}
+		if got, _ := store.GetJob(job.ID); got.Status != JobStatusCancelled {
+			t.Errorf("Expected job to be cancelled after its callback, got %v", got.Status)
+		}
+		if ok, err := store.PurgeJob(job.ID); err != nil || !ok {
+			t.Fatalf("PurgeJob returned %v, %v", ok, err)
+		}
+		if _, err := store.GetJob(job.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Expected purged job to be gone, got %v", err)
+		}
+	})
+
+	t.Run("APIKeys", func(t *testing.T) {
+		store := open(t)
+		created, err := CreateAPIKey(store, CreateAPIKeyRequest{TenantID: "acme", InputBuckets: []string{"uploads"}})
+		if err != nil {
+			t.Fatalf("CreateAPIKey failed: %v", err)
+		}
+		key, err := GetAPIKeyByPlaintext(store, created.Key)
+		if err != nil || key.TenantID != "acme" || len(key.InputBuckets) != 1 || key.CreatedAt == "" {
+			t.Errorf("GetAPIKeyByPlaintext returned %+v, %v", key, err)
+		}
+		if err := store.RevokeAPIKey(created.ID); err != nil {
+			t.Errorf("RevokeAPIKey failed: %v", err)
+		}
+		if err := store.RevokeAPIKey(created.ID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Expected sql.ErrNoRows revoking twice, got %v", err)
+		}
+		if _, err := GetAPIKeyByPlaintext(store, created.Key); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("Expected revoked key to be rejected, got %v", err)
+		}
+		keys, err := store.ListAPIKeys()
+		if err != nil || len(keys) != 1 || keys[0].RevokedAt == "" {
+			t.Errorf("ListAPIKeys returned %+v, %v", keys, err)
+		}
+	})
+}
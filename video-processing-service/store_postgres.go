@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+
+	"github.com/lib/pq"
+)
+
+// PostgresStore keeps everything in PostgreSQL, so that API and worker
+// processes on any number of hosts can share one queue. Claims lock the
+// chosen row with FOR UPDATE SKIP LOCKED, so concurrent workers never wait
+// on or claim the same job.
+type PostgresStore struct {
+	sqlStore
+}
+
+// Timestamps are stored as UTC text in the same format as SQLite's
+// CURRENT_TIMESTAMP, so that both stores compare and return them identically.
+const postgresNow = `to_char(now() AT TIME ZONE 'UTC', 'YYYY-MM-DD HH24:MI:SS')`
+
+var postgresDialect = sqlDialect{
+	name:           "postgres",
+	numberedParams: true,
+	now:            postgresNow,
+	greatest:       "GREATEST",
+	least:          "LEAST",
+	elapsedSeconds: func(from, to string) string {
+		return "CAST(FLOOR(EXTRACT(EPOCH FROM CAST(" + to + " AS TIMESTAMP) - CAST(" + from + " AS TIMESTAMP))) AS INTEGER)"
+	},
+	lockClause: func(table string) string { return " FOR UPDATE OF " + table + " SKIP LOCKED" },
+	isUniqueViolation: func(err error) bool {
+		var pqErr *pq.Error
+		return errors.As(err, &pqErr) && pqErr.Code == "23505"
+	},
+	tableExistsQuery:  `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?`,
+	columnExistsQuery: `SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?`,
+	// An arbitrary application-wide key
+	migrationLock: `SELECT pg_advisory_xact_lock(7261534209)`,
+	tenantLock:    `SELECT pg_advisory_xact_lock(72615342, hashtext(?))`,
+}
+
+// NewPostgresStore connects to the PostgreSQL database at url and brings its
+// schema up to date
+func NewPostgresStore(url string) (*PostgresStore, error) {
+	store, err := openPostgresStore(url)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateStore(store); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// openPostgresStore connects to the PostgreSQL database at url without
+// migrating it
+func openPostgresStore(url string) (*PostgresStore, error) {
+	slog.Info("Connecting to PostgreSQL database")
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresStore{sqlStore{db: db, dialect: postgresDialect}}, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore keeps everything in a local SQLite file. It suits a single
+// host; processes sharing the file must run on the same machine.
+//
+// The database runs in WAL mode so that readers never block the writer.
+// Writes go through a single connection whose transactions take the write
+// lock up front, which queues writers in this process instead of failing
+// with SQLITE_BUSY, while reads are served by a separate pool of read-only
+// connections.
+type SQLiteStore struct {
+	sqlStore
+	path   string
+	params string
+}
+
+var sqliteDialect = sqlDialect{
+	name:     "sqlite",
+	greatest: "MAX",
+	least:    "MIN",
+	elapsedSeconds: func(from, to string) string {
+		return "CAST((julianday(" + to + ") - julianday(" + from + ")) * 86400 AS INTEGER)"
+	},
+	// SQLite has a single writer, so a claim can never race another one
+	lockClause: func(table string) string { return "" },
+	isUniqueViolation: func(err error) bool {
+		var sqliteErr sqlite3.Error
+		return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	},
+	tableExistsQuery:  `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`,
+	columnExistsQuery: `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`,
+	// Write transactions share a single connection, so migrations and quota
+	// checks need no locks
+}
+
+// NewSQLiteStore opens the SQLite database at path and brings its schema up
+// to date. Zero fields of cfg take their defaults.
+func NewSQLiteStore(path string, cfg SQLiteConfig) (*SQLiteStore, error) {
+	store, err := openSQLiteStore(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateStore(store); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// openSQLiteStore opens the SQLite database at path without migrating it
+func openSQLiteStore(path string, cfg SQLiteConfig) (*SQLiteStore, error) {
+	slog.Info("Initializing database", "path", path)
+	busyTimeout := cfg.BusyTimeout
+	if busyTimeout <= 0 {
+		busyTimeout = 5 * time.Second
+	}
+	readConnections := cfg.ReadConnections
+	if readConnections <= 0 {
+		readConnections = 4
+	}
+
+	params := fmt.Sprintf("_busy_timeout=%d&_journal_mode=WAL&_synchronous=NORMAL", busyTimeout.Milliseconds())
+	db, err := sql.Open("sqlite3", sqliteDSN(path, params+"&_txlock=immediate"))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	// Connect the writer first so the file is switched to WAL before any
+	// reader opens it
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	readDB, err := sql.Open("sqlite3", sqliteDSN(path, params+"&_query_only=true"))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	readDB.SetMaxOpenConns(readConnections)
+	readDB.SetMaxIdleConns(readConnections)
+
+	return &SQLiteStore{sqlStore: sqlStore{db: db, readDB: readDB, dialect: sqliteDialect}, path: path, params: params}, nil
+}
+
+// sqliteDSN appends connection parameters to a database path
+func sqliteDSN(path, params string) string {
+	if strings.Contains(path, "?") {
+		return path + "&" + params
+	}
+	return path + "?" + params
+}
+
+// IntegrityCheck runs PRAGMA integrity_check, returning an error describing
+// any corruption it finds
+func (s *SQLiteStore) IntegrityCheck() error {
+	rows, err := s.query(`PRAGMA integrity_check`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Backup writes a consistent copy of the database to dest, which must not
+// exist yet. The database stays online: the copy is taken from a read
+// snapshot on a connection of its own, so writers carry on meanwhile.
+func (s *SQLiteStore) Backup(dest string) error {
+	db, err := sql.Open("sqlite3", sqliteDSN(s.path, s.params))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec(`VACUUM INTO ?`, dest)
+	return err
+}
+
+// Vacuum rebuilds the database file, returning the space freed by deleted
+// jobs to the filesystem. Writers wait until it has finished.
+func (s *SQLiteStore) Vacuum() (err error) {
+	start := time.Now()
+	defer func() { sqliteVacuumDuration.WithLabelValues(resultLabel(err)).Observe(time.Since(start).Seconds()) }()
+	_, err = s.db.Exec(`VACUUM`)
+	return err
+}
+
+// StartSQLiteMaintenance periodically checks the integrity of a SQLite store,
+// backs it up to the configured path or bucket and vacuums it. It does
+// nothing for other stores.
+func StartSQLiteMaintenance(ctx *AppContext) {
+	store, ok := ctx.Store.(*SQLiteStore)
+	if !ok {
+		return
+	}
+	cfg := ctx.Config.SQLite
+
+	if cfg.IntegrityCheckInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(cfg.IntegrityCheckInterval)
+				if err := store.IntegrityCheck(); err != nil {
+					slog.Error("SQLite integrity check failed, database is damaged", "path", store.path, "error", err)
+				}
+			}
+		}()
+	}
+
+	if cfg.BackupInterval > 0 && (cfg.BackupPath != "" || cfg.BackupBucket != "") {
+		go func() {
+			for {
+				time.Sleep(cfg.BackupInterval)
+				if err := backupSQLiteStore(ctx, store, time.Now()); err != nil {
+					slog.Error("SQLite backup failed", "path", store.path, "error", err)
+				}
+			}
+		}()
+	}
+
+	if cfg.VacuumInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(cfg.VacuumInterval)
+				if err := store.Vacuum(); err != nil {
+					slog.Error("SQLite vacuum failed", "path", store.path, "error", err)
+				}
+			}
+		}()
+	}
+}
+
+// backupSQLiteStore takes a backup named after the database file and the
+// time, keeping it under the backup path and uploading it to the backup
+// bucket as configured. Old backups beyond the configured number are removed
+// from the backup path.
+func backupSQLiteStore(ctx *AppContext, store *SQLiteStore, now time.Time) error {
+	cfg := ctx.Config.SQLite
+	base := strings.TrimSuffix(filepath.Base(store.path), filepath.Ext(store.path))
+	name := fmt.Sprintf("%s-%s.db", base, now.UTC().Format("20060102T150405Z"))
+
+	dir := cfg.BackupPath
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "sqlite-backup")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	local := filepath.Join(dir, name)
+	if err := store.Backup(local); err != nil {
+		return err
+	}
+	if cfg.BackupBucket != "" {
+		if err := UploadFile(context.Background(), ctx.S3Client, cfg.BackupBucket, local, cfg.BackupPrefix+name); err != nil {
+			return err
+		}
+	}
+	slog.Info("Backed up SQLite database", "path", store.path, "backup", name)
+
+	if cfg.BackupPath != "" && cfg.BackupKeep > 0 {
+		return pruneSQLiteBackups(cfg.BackupPath, base, cfg.BackupKeep)
+	}
+	return nil
+}
+
+// pruneSQLiteBackups removes all but the newest keep backups of a database
+func pruneSQLiteBackups(dir, base string, keep int) error {
+	backups, err := filepath.Glob(filepath.Join(dir, base+"-*.db"))
+	if err != nil {
+		return err
+	}
+	// The timestamps in the names sort chronologically
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ErrCodeQuotaExceeded is returned with 429 when a tenant is over quota
+const ErrCodeQuotaExceeded = "quota_exceeded"
+
+// TenantLimits are the scheduling weight and quotas applied to a tenant.
+// A limit of zero means unlimited.
+type TenantLimits struct {
+	Weight                 int `json:"weight"`
+	MaxConcurrentEncodes   int `json:"maxConcurrentEncodes"`
+	MaxQueuedJobs          int `json:"maxQueuedJobs"`
+	MaxDailyEncodedMinutes int `json:"maxDailyEncodedMinutes"`
+}
+
+// TenantSettings are per-tenant overrides of the configured defaults.
+// Nil fields fall back to Config.TenantDefaults.
+type TenantSettings struct {
+	Weight                 *int `json:"weight"`
+	MaxConcurrentEncodes   *int `json:"maxConcurrentEncodes"`
+	MaxQueuedJobs          *int `json:"maxQueuedJobs"`
+	MaxDailyEncodedMinutes *int `json:"maxDailyEncodedMinutes"`
+}
+
+// TenantUsage is a tenant's current consumption of its quotas
+type TenantUsage struct {
+	RunningEncodes      int     `json:"runningEncodes"`
+	QueuedJobs          int     `json:"queuedJobs"`
+	EncodedMinutesToday float64 `json:"encodedMinutesToday"`
+}
+
+// TenantResponse is the admin API representation of a tenant
+type TenantResponse struct {
+	ID       string         `json:"id"`
+	Settings TenantSettings `json:"settings"`
+	Limits   TenantLimits   `json:"limits"`
+	Usage    TenantUsage    `json:"usage"`
+}
+
+// QuotaError is returned by SubmitJobs when a tenant may not queue more work
+type QuotaError struct {
+	Message string
+}
+
+func (e *QuotaError) Error() string {
+	return e.Message
+}
+
+// Apply returns the defaults overridden by any settings that are set
+func (s TenantSettings) Apply(defaults TenantLimits) TenantLimits {
+	limits := defaults
+	if s.Weight != nil {
+		limits.Weight = *s.Weight
+	}
+	if s.MaxConcurrentEncodes != nil {
+		limits.MaxConcurrentEncodes = *s.MaxConcurrentEncodes
+	}
+	if s.MaxQueuedJobs != nil {
+		limits.MaxQueuedJobs = *s.MaxQueuedJobs
+	}
+	if s.MaxDailyEncodedMinutes != nil {
+		limits.MaxDailyEncodedMinutes = *s.MaxDailyEncodedMinutes
+	}
+	if limits.Weight < 1 {
+		limits.Weight = 1
+	}
+	return limits
+}
+
+// Fetch a tenant's settings; tenants without a row use the defaults
+func (s *sqlStore) GetTenantSettings(tenantID string) (TenantSettings, error) {
+	var settings TenantSettings
+	var weight, maxConcurrent, maxQueued, maxMinutes sql.NullInt64
+	err := s.queryRow(`SELECT weight, max_concurrent_encodes, max_queued_jobs, max_daily_encoded_minutes FROM tenants WHERE id = ?`, tenantID).
+		Scan(&weight, &maxConcurrent, &maxQueued, &maxMinutes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return settings, nil
+	}
+	if err != nil {
+		return settings, err
+	}
+	settings.Weight = nullIntPtr(weight)
+	settings.MaxConcurrentEncodes = nullIntPtr(maxConcurrent)
+	settings.MaxQueuedJobs = nullIntPtr(maxQueued)
+	settings.MaxDailyEncodedMinutes = nullIntPtr(maxMinutes)
+	return settings, nil
+}
+
+// Create or replace a tenant's settings
+func (s *sqlStore) UpsertTenantSettings(tenantID string, settings TenantSettings) error {
+	_, err := s.exec(`INSERT INTO tenants (id, weight, max_concurrent_encodes, max_queued_jobs, max_daily_encoded_minutes) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET weight = excluded.weight, max_concurrent_encodes = excluded.max_concurrent_encodes,
+			max_queued_jobs = excluded.max_queued_jobs, max_daily_encoded_minutes = excluded.max_daily_encoded_minutes`,
+		tenantID, settings.Weight, settings.MaxConcurrentEncodes, settings.MaxQueuedJobs, settings.MaxDailyEncodedMinutes)
+	return err
+}
+
+// List the IDs of every tenant that has settings or jobs
+func (s *sqlStore) ListTenantIDs() ([]string, error) {
+	rows, err := s.query(`SELECT id FROM tenants UNION SELECT DISTINCT tenant_id FROM jobs ORDER BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Compute a tenant's running encodes, queued jobs and minutes encoded since
+// the start of the current UTC day
+func (s *sqlStore) GetTenantUsage(tenantID string, now time.Time) (TenantUsage, error) {
+	return s.tenantUsage(s.reader(), tenantID, now)
+}
+
+// tenantUsage computes the usage through db, which may be a transaction
+func (s *sqlStore) tenantUsage(db queryRower, tenantID string, now time.Time) (TenantUsage, error) {
+	var usage TenantUsage
+	var encodedSeconds float64
+	dayStart := now.UTC().Truncate(24 * time.Hour)
+	err := db.QueryRow(s.rebind(`SELECT
+			COALESCE(SUM(CASE WHEN status = ? THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN status IN (?, ?, ?) THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN finished_at >= ? THEN encoded_seconds ELSE 0 END), 0)
+		FROM jobs WHERE tenant_id = ?`),
+		int(JobStatusEncodingRunning),
+		int(JobStatusEncodingPending), int(JobStatusEncodingRunning), int(JobStatusEncodingFailed),
+		sqlTime(dayStart), tenantID).
+		Scan(&usage.RunningEncodes, &usage.QueuedJobs, &encodedSeconds)
+	usage.EncodedMinutesToday = encodedSeconds / 60
+	return usage, err
+}
+
+// hasQuota reports whether the limits restrict submissions at all.
+// Concurrent encode limits are enforced by the scheduler instead.
+func (l TenantLimits) hasQuota() bool {
+	return l.MaxQueuedJobs > 0 || l.MaxDailyEncodedMinutes > 0
+}
+
+// quotaError returns a QuotaError if queuing newJobs more jobs would exceed
+// the queued job limit or the tenant has used up today's encoding minutes.
+// The length of a queued video is not known until it is encoded, so the daily
+// minutes are a soft limit: jobs are accepted while any minutes are left, and
+// may take the tenant past the limit when they finish.
+func (l TenantLimits) quotaError(usage TenantUsage, newJobs int) error {
+	if l.MaxQueuedJobs > 0 && usage.QueuedJobs+newJobs > l.MaxQueuedJobs {
+		return &QuotaError{Message: fmt.Sprintf("Tenant has %d queued jobs; submitting %d more would exceed the limit of %d", usage.QueuedJobs, newJobs, l.MaxQueuedJobs)}
+	}
+	if l.MaxDailyEncodedMinutes > 0 && usage.EncodedMinutesToday >= float64(l.MaxDailyEncodedMinutes) {
+		return &QuotaError{Message: fmt.Sprintf("Tenant has used its daily quota of %d encoded minutes", l.MaxDailyEncodedMinutes)}
+	}
+	return nil
+}
+
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
+
+func tenantResponse(ctx *AppContext, tenantID string) (*TenantResponse, error) {
+	settings, err := ctx.Store.GetTenantSettings(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := ctx.Store.GetTenantUsage(tenantID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return &TenantResponse{
+		ID:       tenantID,
+		Settings: settings,
+		Limits:   settings.Apply(ctx.Config.TenantDefaults),
+		Usage:    usage,
+	}, nil
+}
+
+// ListTenantsHandler lists every known tenant with its limits and usage
+func ListTenantsHandler(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ids, err := ctx.Store.ListTenantIDs()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to list tenants: "+err.Error(), nil)
+			return
+		}
+		tenants := []TenantResponse{}
+		for _, id := range ids {
+			tenant, err := tenantResponse(ctx, id)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to load tenant: "+err.Error(), nil)
+				return
+			}
+			tenants = append(tenants, *tenant)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]TenantResponse{"tenants": tenants})
+	}
+}
+
+// PutTenantHandler replaces the settings of the tenant named in the path
+func PutTenantHandler(ctx *AppContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var settings TenantSettings
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, ctx.Config.MaxRequestBodyBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&settings); err != nil {
+			writeError(w, http.StatusBadRequest, ErrCodeInvalidJSON, "Invalid JSON: "+err.Error(), nil)
+			return
+		}
+
+		var fields []FieldError
+		checkNonNegative := func(field string, v *int, min int) {
+			if v != nil && *v < min {
+				fields = append(fields, FieldError{Field: field, Code: FieldCodeOutOfRange, Message: fmt.Sprintf("must be at least %d", min)})
+			}
+		}
+		checkNonNegative("weight", settings.Weight, 1)
+		checkNonNegative("maxConcurrentEncodes", settings.MaxConcurrentEncodes, 0)
+		checkNonNegative("maxQueuedJobs", settings.MaxQueuedJobs, 0)
+		checkNonNegative("maxDailyEncodedMinutes", settings.MaxDailyEncodedMinutes, 0)
+		if len(fields) > 0 {
+			writeError(w, http.StatusBadRequest, ErrCodeValidationFailed, "Request validation failed", fields)
+			return
+		}
+
+		tenantID := r.PathValue("id")
+		if err := ctx.Store.UpsertTenantSettings(tenantID, settings); err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to update tenant: "+err.Error(), nil)
+			return
+		}
+		tenant, err := tenantResponse(ctx, tenantID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, ErrCodeInternal, "Failed to load tenant: "+err.Error(), nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tenant)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the instrumentation scope and the default service name of spans
+const tracerName = "video-processing-service"
+
+// Routes polled by monitoring, which would drown out real requests if traced
+var untracedRoutes = map[string]bool{
+	"GET /metrics": true,
+	"GET /healthz": true,
+	"GET /readyz":  true,
+}
+
+// ConfigureTracing installs the tracer provider selected by exporter: "otlp"
+// sends spans to the collector at OTEL_EXPORTER_OTLP_ENDPOINT, "stdout"
+// prints them, and "none" records nothing. Trace context is propagated in
+// W3C traceparent headers either way. The returned function flushes
+// buffered spans.
+func ConfigureTracing(ctx context.Context, exporter string) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		spanExporter, err = otlptracehttp.New(ctx)
+	case "stdout", "console":
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, expected otlp, stdout or none", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporter, err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", tracerName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// startSpan starts a span of the service. The tracer is looked up on every
+// call so that spans always go to the current global provider.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// withSpan runs fn in a child span of ctx, recording its error on the span
+func withSpan(ctx context.Context, name string, fn func(context.Context) error, attrs ...attribute.KeyValue) error {
+	ctx, span := startSpan(ctx, name, trace.WithAttributes(attrs...))
+	defer span.End()
+	err := fn(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// TraceParent returns the W3C traceparent of the span in ctx, or an empty
+// string if there is none
+func TraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// jobTraceContext returns a context carrying the trace the job was submitted
+// in, so that spans of workers join the trace of the originating request
+func jobTraceContext(job *Job) context.Context {
+	carrier := propagation.MapCarrier{"traceparent": job.TraceParent}
+	return propagation.TraceContext{}.Extract(context.Background(), carrier)
+}
+
+// jobAttributes identify the job a span worked on
+func jobAttributes(job *Job, attempt int) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("job.id", job.ID),
+		attribute.String("job.video_id", job.VideoID),
+		attribute.String("job.tenant_id", job.TenantID),
+		attribute.Int("job.resolution", job.Resolution),
+		attribute.Int("job.attempt", attempt),
+	}
+}
+
+// startJobSpan starts a span of a worker processing the job, as a child of
+// the request that submitted it
+func startJobSpan(job *Job, name string, attempt int) (context.Context, trace.Span) {
+	return startSpan(jobTraceContext(job), name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(append(jobAttributes(job, attempt), attribute.String("worker.id", job.WorkerID))...))
+}
+
+// traceQueueWait records the time a job spent waiting for its first claim
+// as a span, after the fact
+func traceQueueWait(job *Job, claimedAt time.Time) {
+	if job.FailedCount > 0 {
+		return
+	}
+	created, err := time.Parse(time.RFC3339Nano, job.CreatedAt)
+	if err != nil {
+		return
+	}
+	_, span := startSpan(jobTraceContext(job), "queue wait",
+		trace.WithTimestamp(created),
+		trace.WithAttributes(jobAttributes(job, 1)...))
+	span.End(trace.WithTimestamp(claimedAt))
+}
+
+// TraceRequests wraps the router so that every request is served in a span,
+// continuing the caller's trace if the request carries a traceparent header.
+// Spans are named after the matched route rather than the path, so that job
+// IDs do not end up in span names.
+func TraceRequests(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		if !strings.Contains(route, " ") {
+			route = r.Method + " " + route
+		}
+		if untracedRoutes[route] {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := startSpan(ctx, route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("http.route", route),
+		))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// statusRecorder remembers the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestJobTraceContinuesFromSubmissionToCallback(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	if _, err := ConfigureTracing(context.Background(), "none"); err != nil {
+		t.Fatalf("ConfigureTracing failed: %v", err)
+	}
+
+	ctx := setupTestAppContext(t)
+	var callbackTraceParent string
+	callbacks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callbackTraceParent = r.Header.Get("traceparent")
+	}))
+	defer callbacks.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	rec := postProcessVideo(t, NewRouter(ctx), RequestPayload{
+		VideoId:     "vid123",
+		Input:       Input{Bucket: "input-bucket", Key: "input.mp4"},
+		Output:      Output{Bucket: "output-bucket", BasePath: "outputs/"},
+		Profiles:    []Profile{{Resolution: "720", Crf: 23}},
+		CallbackURL: "http://callback.example.com/done",
+	}, map[string]string{"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01"})
+	var resp ResponsePayload
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || len(resp.Jobs) != 1 {
+		t.Fatalf("Expected one job, got %d: %s", rec.Code, rec.Body.String())
+	}
+	job, err := ctx.Store.GetJob(resp.Jobs[0].JobID)
+	if err != nil || !strings.Contains(job.TraceParent, traceID) {
+		t.Fatalf("Expected job to store the request's trace, got %q, %v", job.TraceParent, err)
+	}
+
+	// The callback of the encoded job continues the same trace
+	opts := testDequeueOptions(ctx)
+	if _, err := ctx.Store.DequeueJob(opts, time.Now()); err != nil {
+		t.Fatalf("DequeueJob failed: %v", err)
+	}
+	if err := ctx.Store.MarkJobEncoded(job.ID, opts.WorkerID, 10, Attempt{Duration: time.Second}); err != nil {
+		t.Fatalf("MarkJobEncoded failed: %v", err)
+	}
+	callback, err := ctx.Store.DequeueCallbackJob("callback-worker", 3, time.Now().Add(time.Minute))
+	if err != nil || callback == nil {
+		t.Fatalf("DequeueCallbackJob returned %v, %v", callback, err)
+	}
+	callback.CallbackURL = callbacks.URL
+	ProcessCallbackJob(ctx, callback)
+	if !strings.HasPrefix(callbackTraceParent, "00-"+traceID+"-") {
+		t.Errorf("Expected callback to carry the job's trace, got traceparent %q", callbackTraceParent)
+	}
+
+	spans := map[string]bool{}
+	for _, span := range exporter.GetSpans() {
+		if span.SpanContext.TraceID().String() == traceID {
+			spans[span.Name] = true
+		}
+	}
+	for _, name := range []string{"POST /process-video", "insert jobs", "deliver callback"} {
+		if !spans[name] {
+			t.Errorf("Expected span %q in the job's trace, got %v", name, spans)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Machine-readable codes used in error responses
+const (
+	ErrCodeInvalidJSON         = "invalid_json"
+	ErrCodeBodyTooLarge        = "body_too_large"
+	ErrCodeValidationFailed    = "validation_failed"
+	ErrCodeIdempotencyConflict = "idempotency_conflict"
+	ErrCodeInternal            = "internal_error"
+
+	FieldCodeRequired      = "required"
+	FieldCodeUnknown       = "unknown_field"
+	FieldCodeInvalidFormat = "invalid_format"
+	FieldCodeOutOfRange    = "out_of_range"
+	FieldCodeDuplicate     = "duplicate"
+	FieldCodeTooLong       = "too_long"
+	FieldCodeInvalidBucket = "invalid_bucket_name"
+	FieldCodeInvalidKey    = "invalid_key"
+)
+
+// Limits enforced on request payloads
+const (
+	minResolution           = 144
+	maxResolution           = 4320
+	minCrf                  = 0
+	maxCrf                  = 51
+	maxProfiles             = 16
+	maxVideoIDLength        = 255
+	maxIdempotencyKeyLength = 255
+	maxObjectKeyLength      = 1024
+	maxCallbackURLLength    = 2048
+	minPriority             = 0
+	maxPriority             = 10
+	DefaultPriority         = 5
+)
+
+// S3 bucket names: 3-63 lowercase letters, digits, dots and hyphens,
+// starting and ending with a letter or digit.
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// ValidationError is returned by SubmitJobs when the request itself is bad
+// and retrying it unchanged can never succeed.
+type ValidationError struct {
+	Code    string
+	Message string
+	Fields  []FieldError
+}
+
+// FieldError describes a single invalid field of a request payload
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Fields) == 0 {
+		return e.Message
+	}
+	var parts []string
+	for _, f := range e.Fields {
+		parts = append(parts, f.Field+": "+f.Message)
+	}
+	return e.Message + ": " + strings.Join(parts, "; ")
+}
+
+// ErrorResponse is the error document returned by every endpoint
+type ErrorResponse struct {
+	Status  string       `json:"status"`
+	Code    string       `json:"code"`
+	Message string       `json:"error"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// writeError writes an ErrorResponse with the given HTTP status
+func writeError(w http.ResponseWriter, status int, code, message string, fields []FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Status:  "error",
+		Code:    code,
+		Message: message,
+		Fields:  fields,
+	})
+}
+
+// writeValidationError writes a ValidationError as a 400 or 413 response
+func writeValidationError(w http.ResponseWriter, err *ValidationError) {
+	status := http.StatusBadRequest
+	if err.Code == ErrCodeBodyTooLarge {
+		status = http.StatusRequestEntityTooLarge
+	}
+	writeError(w, status, err.Code, err.Message, err.Fields)
+}
+
+// DecodeRequestPayload strictly decodes a request payload, rejecting unknown
+// fields, trailing data and bodies longer than maxBytes.
+func DecodeRequestPayload(r io.Reader, maxBytes int64) (*RequestPayload, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, bodyTooLargeError(maxBytes)
+		}
+		return nil, &ValidationError{Code: ErrCodeInvalidJSON, Message: "Failed to read body: " + err.Error()}
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, bodyTooLargeError(maxBytes)
+	}
+
+	var reqPayload RequestPayload
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqPayload); err != nil {
+		if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			name, _ = strconv.Unquote(name)
+			return nil, &ValidationError{
+				Code:    ErrCodeValidationFailed,
+				Message: "Request validation failed",
+				Fields:  []FieldError{{Field: name, Code: FieldCodeUnknown, Message: "unknown field"}},
+			}
+		}
+		return nil, &ValidationError{Code: ErrCodeInvalidJSON, Message: "Invalid JSON: " + err.Error()}
+	}
+	if decoder.More() {
+		return nil, &ValidationError{Code: ErrCodeInvalidJSON, Message: "Invalid JSON: unexpected data after the request object"}
+	}
+	return &reqPayload, nil
+}
+
+func bodyTooLargeError(maxBytes int64) *ValidationError {
+	return &ValidationError{
+		Code:    ErrCodeBodyTooLarge,
+		Message: fmt.Sprintf("Request body must not exceed %d bytes", maxBytes),
+	}
+}
+
+// ValidateRequestPayload checks every field of a request payload and returns
+// a ValidationError listing all failing fields.
+func ValidateRequestPayload(reqPayload *RequestPayload) error {
+	var fields []FieldError
+	add := func(field, code, message string) {
+		fields = append(fields, FieldError{Field: field, Code: code, Message: message})
+	}
+
+	if len(reqPayload.VideoId) > maxVideoIDLength {
+		add("videoId", FieldCodeTooLong, fmt.Sprintf("must be at most %d characters", maxVideoIDLength))
+	}
+
+	validateBucket := func(field, bucket string) {
+		if bucket == "" {
+			add(field, FieldCodeRequired, "is required")
+		} else if msg := bucketNameProblem(bucket); msg != "" {
+			add(field, FieldCodeInvalidBucket, msg)
+		}
+	}
+	validateKey := func(field, key string) {
+		if key == "" {
+			add(field, FieldCodeRequired, "is required")
+		} else if msg := objectKeyProblem(key); msg != "" {
+			add(field, FieldCodeInvalidKey, msg)
+		}
+	}
+	validateBucket("input.bucket", reqPayload.Input.Bucket)
+	validateKey("input.key", reqPayload.Input.Key)
+	validateBucket("output.bucket", reqPayload.Output.Bucket)
+	validateKey("output.basePath", reqPayload.Output.BasePath)
+
+	// Validate callbackUrl format
+	if reqPayload.CallbackURL == "" {
+		add("callbackUrl", FieldCodeRequired, "is required")
+	} else if len(reqPayload.CallbackURL) > maxCallbackURLLength {
+		add("callbackUrl", FieldCodeTooLong, fmt.Sprintf("must be at most %d characters", maxCallbackURLLength))
+	} else {
+		parsedUrl, err := url.ParseRequestURI(reqPayload.CallbackURL)
+		if err != nil || parsedUrl.Host == "" || (parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https") {
+			add("callbackUrl", FieldCodeInvalidFormat, "must be an absolute http or https URL")
+		}
+	}
+
+	if len(reqPayload.IdempotencyKey) > maxIdempotencyKeyLength {
+		add("idempotencyKey", FieldCodeTooLong, fmt.Sprintf("must be at most %d characters", maxIdempotencyKeyLength))
+	}
+
+	if reqPayload.Priority != nil && (*reqPayload.Priority < minPriority || *reqPayload.Priority > maxPriority) {
+		add("priority", FieldCodeOutOfRange, fmt.Sprintf("must be between %d and %d", minPriority, maxPriority))
+	}
+	if reqPayload.Deadline != "" {
+		if _, err := time.Parse(time.RFC3339, reqPayload.Deadline); err != nil {
+			add("deadline", FieldCodeInvalidFormat, "must be an RFC 3339 timestamp")
+		}
+	}
+
+	if len(reqPayload.Profiles) == 0 {
+		add("profiles", FieldCodeRequired, "at least one profile is required")
+	} else if len(reqPayload.Profiles) > maxProfiles {
+		add("profiles", FieldCodeOutOfRange, fmt.Sprintf("at most %d profiles are allowed", maxProfiles))
+	}
+	fields = append(fields, profileFieldErrors(reqPayload.Profiles)...)
+
+	if len(fields) > 0 {
+		return &ValidationError{Code: ErrCodeValidationFailed, Message: "Request validation failed", Fields: fields}
+	}
+	return nil
+}
+
+// ParsedProfile is a profile whose resolution has been parsed and validated
+type ParsedProfile struct {
+	Resolution int
+	Crf        int
+	// Audio has the defaults of its codec filled in, and is nil if the
+	// profile leaves audio to ffmpeg
+	Audio     *AudioProfile
+	AudioOnly bool
+}
+
+// ParseProfiles validates every profile of a request, returning a
+// ValidationError listing each invalid field if any profile is bad.
+func ParseProfiles(profiles []Profile) ([]ParsedProfile, error) {
+	if fields := profileFieldErrors(profiles); len(fields) > 0 {
+		return nil, &ValidationError{Code: ErrCodeValidationFailed, Message: "Invalid profiles", Fields: fields}
+	}
+	var parsed []ParsedProfile
+	for _, profile := range profiles {
+		if profile.AudioOnly {
+			audio := profile.Audio
+			if audio == nil {
+				audio = &AudioProfile{}
+			}
+			parsed = append(parsed, ParsedProfile{Audio: withAudioDefaults(audio), AudioOnly: true})
+			continue
+		}
+		resolution, _ := strconv.Atoi(profile.Resolution)
+		parsed = append(parsed, ParsedProfile{Resolution: resolution, Crf: profile.Crf, Audio: withAudioDefaults(profile.Audio)})
+	}
+	return parsed, nil
+}
+
+// profileFieldErrors checks resolution, CRF and audio settings and rejects
+// profiles that would write to the same output file.
+func profileFieldErrors(profiles []Profile) []FieldError {
+	var fields []FieldError
+	seen := map[int]int{}
+	seenAudio := map[string]int{}
+	for i, profile := range profiles {
+		if profile.Audio != nil {
+			fields = append(fields, audioFieldErrors(i, profile.Audio, profile.AudioOnly)...)
+		}
+		if profile.AudioOnly {
+			if profile.Resolution != "" {
+				fields = append(fields, FieldError{
+					Field:   fmt.Sprintf("profiles[%d].resolution", i),
+					Code:    FieldCodeInvalidFormat,
+					Message: "must be omitted for audio-only profiles",
+				})
+			}
+			audio := profile.Audio
+			if audio == nil {
+				audio = &AudioProfile{}
+			}
+			name := AudioOutputFileName(withAudioDefaults(audio))
+			if first, ok := seenAudio[name]; ok {
+				fields = append(fields, FieldError{
+					Field:   fmt.Sprintf("profiles[%d].audio", i),
+					Code:    FieldCodeDuplicate,
+					Message: fmt.Sprintf("the same audio rendition is already requested by profiles[%d]", first),
+				})
+			} else {
+				seenAudio[name] = i
+			}
+			continue
+		}
+
+		resolution, err := strconv.Atoi(profile.Resolution)
+		if profile.Resolution == "" {
+			fields = append(fields, FieldError{
+				Field:   fmt.Sprintf("profiles[%d].resolution", i),
+				Code:    FieldCodeRequired,
+				Message: "is required unless the profile is audio only",
+			})
+		} else if err != nil {
+			fields = append(fields, FieldError{
+				Field:   fmt.Sprintf("profiles[%d].resolution", i),
+				Code:    FieldCodeInvalidFormat,
+				Message: fmt.Sprintf("resolution %q must be an integer", profile.Resolution),
+			})
+		} else if resolution < minResolution || resolution > maxResolution {
+			fields = append(fields, FieldError{
+				Field:   fmt.Sprintf("profiles[%d].resolution", i),
+				Code:    FieldCodeOutOfRange,
+				Message: fmt.Sprintf("resolution %d must be between %d and %d", resolution, minResolution, maxResolution),
+			})
+		} else if first, ok := seen[resolution]; ok {
+			fields = append(fields, FieldError{
+				Field:   fmt.Sprintf("profiles[%d].resolution", i),
+				Code:    FieldCodeDuplicate,
+				Message: fmt.Sprintf("resolution %d is already requested by profiles[%d]", resolution, first),
+			})
+		} else {
+			seen[resolution] = i
+		}
+		if profile.Crf < minCrf || profile.Crf > maxCrf {
+			fields = append(fields, FieldError{
+				Field:   fmt.Sprintf("profiles[%d].crf", i),
+				Code:    FieldCodeOutOfRange,
+				Message: fmt.Sprintf("crf %d must be between %d and %d", profile.Crf, minCrf, maxCrf),
+			})
+		}
+	}
+	return fields
+}
+
+// bucketNameProblem returns why a bucket name breaks the S3 naming rules,
+// or an empty string if it is valid.
+func bucketNameProblem(bucket string) string {
+	if !bucketNamePattern.MatchString(bucket) {
+		return "must be 3-63 lowercase letters, digits, dots or hyphens and start and end with a letter or digit"
+	}
+	if strings.Contains(bucket, "..") {
+		return "must not contain consecutive dots"
+	}
+	if net.ParseIP(bucket) != nil {
+		return "must not be formatted as an IP address"
+	}
+	return ""
+}
+
+// objectKeyProblem returns why an object key or prefix is unsafe to use,
+// or an empty string if it is valid.
+func objectKeyProblem(key string) string {
+	if len(key) > maxObjectKeyLength {
+		return fmt.Sprintf("must be at most %d bytes", maxObjectKeyLength)
+	}
+	if !utf8.ValidString(key) {
+		return "must be valid UTF-8"
+	}
+	if strings.HasPrefix(key, "/") {
+		return "must not start with a slash"
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return "must not contain control characters"
+		}
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." {
+			return "must not contain . or .. path segments"
+		}
+	}
+	return ""
+}